@@ -8,6 +8,7 @@ import (
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"errors"
 	"time"
+	"math"
 )
 
 //==============================================================================================================================
@@ -36,53 +37,84 @@ type Actor struct {
 }
 
 //reimbursement (reimbursement id, status, award id, amount)
+//Amount is what was actually paid; RequestedAmount is the expenditure amount the grantee asked for and
+//DisallowedAmount/ReasonCode record the part the grantor refused to pay. ClawedBack is the part of Amount taken back by
+//the Clawbacks so far, the payment stays in force until a reversal sets ReversedBy
 type Reimbursement struct {
-	ReimbursementId string `json:"reimbursementid"`
-	Amount          string `json:"amount"`
-	FromActor       string `json:"fromactor"`
-	ToActor         string `json:"toactor"`
-	Date            string `json:"date"`
-	ExpenditureId   string `json:"expenditureid"`
+	ReimbursementId  string   `json:"reimbursementid"`
+	Amount           string   `json:"amount"`
+	FromActor        string   `json:"fromactor"`
+	ToActor          string   `json:"toactor"`
+	Date             string   `json:"date"`
+	ExpenditureId    string   `json:"expenditureid"`
+	RequestedAmount  string   `json:"requestedamount"`
+	DisallowedAmount string   `json:"disallowedamount"`
+	ReasonCode       string   `json:"reasoncode"`
+	ReversalOf       string   `json:"reversalof"`
+	ReversedBy       string   `json:"reversedby"`
+	ClawedBack       string   `json:"clawedback"`
+	Clawbacks        []string `json:"clawbacks"`
 }
 
 //expenditure (expenditure id, amount, project id, date, type, reimbursement id)
+//ReversalOf/ReversedBy link a compensating expenditure and the one it reverses
+//Amount is in the award Currency; an expense paid in another currency keeps its OriginalAmount, OriginalCurrency and the
+//FxRate it was converted at. FiredRules are the allowability rules that fired when it was spent, and Approvers the
+//approval chain that must sign it before it is paid. Submitted is the transaction time it was spent at, which the
+//approval SLA is measured from, and Escalations the levels a late approval step was escalated to. Screening is the
+//supplier screening of the payee made when it was spent, and Documents the hashes of the receipts and invoices behind it.
+//InvoiceNumber, InvoiceDate and VendorRef identify the supplier's invoice, SuspectedDuplicates the earlier expenses it
+//may duplicate
 type Expenditure struct {
-	ExpenditureId string `json:"expenditureid"`
-	Amount        string `json:"amount"`
-	Date          string `json:"date"`
-	Type          string `json:"type"`
-	Status        string `json:"status"`
-	FromActor     string `json:"fromactor"`
-	ToActor       string `json:"toactor"`
+	ExpenditureId       string            `json:"expenditureid"`
+	Amount              string            `json:"amount"`
+	Date                string            `json:"date"`
+	Type                string            `json:"type"`
+	Status              string            `json:"status"`
+	FromActor           string            `json:"fromactor"`
+	ToActor             string            `json:"toactor"`
+	ReversalOf          string            `json:"reversalof"`
+	ReversedBy          string            `json:"reversedby"`
+	ReasonCode          string            `json:"reasoncode"`
+	AwardId             string            `json:"awardid"`
+	Currency            string            `json:"currency"`
+	OriginalAmount      string            `json:"originalamount"`
+	OriginalCurrency    string            `json:"originalcurrency"`
+	FxRate              string            `json:"fxrate"`
+	FxRateDate          string            `json:"fxratedate"`
+	ContractRef         string            `json:"contractref"`
+	FiredRules          []FiredRule       `json:"firedrules"`
+	Approvers           []string          `json:"approvers"`
+	Approvals           []Approval        `json:"approvals"`
+	Submitted           string            `json:"submitted"`
+	Escalations         []Escalation      `json:"escalations"`
+	Screening           SupplierScreening `json:"screening"`
+	Documents           []Document        `json:"documents"`
+	InvoiceNumber       string            `json:"invoicenumber"`
+	InvoiceDate         string            `json:"invoicedate"`
+	VendorRef           string            `json:"vendorref"`
+	SuspectedDuplicates []string          `json:"suspectedduplicates"`
+}
+
+//optional details of a spend, passed as a JSON object after the expense type
+type SpendOptions struct {
+	AwardId       string     `json:"awardid"`
+	Currency      string     `json:"currency"`
+	Date          string     `json:"date"`
+	ContractRef   string     `json:"contractref"`
+	Documents     []Document `json:"documents"`
+	InvoiceNumber string     `json:"invoicenumber"`
+	InvoiceDate   string     `json:"invoicedate"`
+	VendorRef     string     `json:"vendorref"`
 }
 
 var accountIndexStr = "_accountindex" // Define an index variable to track all the actors stored in the world state
 var expIndexStr = "_expindex"         // Define an index variable to track all the expenditures stored in the world state
 var reimbIndexStr = "_reimbindex"     // Define an index variable to track all the reimbursements stored in the world state
+var dateFormat = "2006-01-02"         // Layout of every record date
 var expNumber int = 0
 var reimbNumber int = 0
 
-var act1 = make([]string, 8, 8)
-var act2 = make([]string, 8, 8)
-var act3 = make([]string, 8, 8)
-var act4 = make([]string, 8, 8)
-var exp1 = make([]string, 7, 7)
-var exp2 = make([]string, 7, 7)
-var exp3 = make([]string, 7, 7)
-var exp4 = make([]string, 7, 7)
-var exp5 = make([]string, 7, 7)
-var exp6 = make([]string, 7, 7)
-var exp7 = make([]string, 7, 7)
-var exp8 = make([]string, 7, 7)
-var exp9 = make([]string, 7, 7)
-var rem1 = make([]string, 6, 6)
-var rem2 = make([]string, 6, 6)
-var rem3 = make([]string, 6, 6)
-var rem4 = make([]string, 6, 6)
-var rem5 = make([]string, 6, 6)
-var rem6 = make([]string, 6, 6)
-var rem7 = make([]string, 6, 6)
-
 // ============================================================================================================================
 //  Main - main - Starts up the chaincode
 // ============================================================================================================================
@@ -95,210 +127,81 @@ func main() {
 
 // ============================================================================================================================
 // SetUp Function - Called after the user deploys the chain code, before demo
-// Function: create 4 actors, update AwardParty struct, update Award struct
-// Call init_account, CreateAward, <not needed>--RequestAward
+// Function: load the demo fixture, 4 actors, an award and a sub-award, the supplier, 9 expenditures and 7 reimbursements
+// Call load_fixture, like loadfixture only an admin may
 // Invoke
 // ============================================================================================================================
 func (t *SimpleChaincode) SetUp(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	//------------------------------create roles----------------------------------------------
-	// grantor info
-	act1[0] = "ACT-101"        //ActorId
-	act1[1] = "PPM Foundation" //ActorName
-	act1[2] = "125000"         //Comiitted
-	act1[3] = "19500"          //Reimbursed
-	act1[4] = "-1"             //Awarded
-	act1[5] = "-1"             //Spent
-	act1[6] = "-1"             //Received
-	act1[7] = "-1"             //Delegated
-
-	// grantee info
-	act2[0] = "ACT-102"             //ActorId
-	act2[1] = "Stanford University" //ActorName
-	act2[2] = "-1"                  //Comiitted
-	act2[3] = "-1"                  //Reimbursed
-	act2[4] = "125000"              //Awarded
-	act2[5] = "23000"               //Spent
-	act2[6] = "10000"               //Received
-	act2[7] = "45000"               //Delegated
-
-	// sub-grantee info
-	act3[0] = "ACT-103"                 //ActorId
-	act3[1] = "John Hopkins University" //ActorName
-	act3[2] = "-1"                      //Comiitted
-	act3[3] = "-1"                      //Reimbursed
-	act3[4] = "45000"                   //Awarded
-	act3[5] = "12000"                   //Spent
-	act3[6] = "9500"                    //Received
-	act3[7] = "-1"                      //Delegated
-
-	// Supplier info -- shows spending form all the grantees and sub-grantees
-	act4[0] = "ACT-104"          //ActorId
-	act4[1] = "Dixon consulting" //ActorName
-	act4[2] = "-1"               //Comiitted
-	act4[3] = "-1"               //Reimbursed
-	act4[4] = "-1"               //Awarded
-	act4[5] = "-1"               //Spent
-	act4[6] = "35000"            //Received
-	act4[7] = "-1"               //Delegated
-
-	t.Init_actor(stub, act1)
-	t.Init_actor(stub, act2)
-	t.Init_actor(stub, act3)
-	t.Init_actor(stub, act4)
-
-	//----------------create expenses----------------------------------------------------------
-	// Expense
-
-	exp1[0] = "EXP-201"    //ExpenditureId
-	exp1[1] = "3000"       //Amount
-	exp1[2] = "2017-08-18" //Date
-	exp1[3] = "Travel"     //Type
-	exp1[4] = "Approved"   //Status
-	exp1[5] = "ACT-102"    //FromActor --Grantee spending
-	exp1[6] = "ACT-104"    //ToActor   --Supplier receiving the spending
-
-	exp2[0] = "EXP-202"    //ExpenditureId
-	exp2[1] = "8000"       //Amount
-	exp2[2] = "2017-08-19" //Date
-	exp2[3] = "Equipment"  //Type
-	exp2[4] = "Pending"    //Status
-	exp2[5] = "ACT-102"    //FromActor --Grantee spending
-	exp2[6] = "ACT-104"    //ToActor   --Supplier receiving the spending
-
-	exp3[0] = "EXP-203"    //ExpenditureId
-	exp3[1] = "4000"       //Amount
-	exp3[2] = "2017-08-20" //Date
-	exp3[3] = "Training"   //Type
-	exp3[4] = "Approved"   //Status
-	exp3[5] = "ACT-102"    //FromActor --Grantee spending
-	exp3[6] = "ACT-104"
-
-	exp4[0] = "EXP-204"          //ExpenditureId
-	exp4[1] = "3000"             //Amount
-	exp4[2] = "2017-08-25"       //Date
-	exp4[3] = "Software License" //Type
-	exp4[4] = "Approved"         //Status
-	exp4[5] = "ACT-102"          //FromActor --Grantee spending
-	exp4[6] = "ACT-104"
-
-	exp5[0] = "EXP-205"    //ExpenditureId
-	exp5[1] = "5000"       //Amount
-	exp5[2] = "2017-08-27" //Date
-	exp5[3] = "Specimens"  //Type
-	exp5[4] = "Approved"   //Status
-	exp5[5] = "ACT-102"    //FromActor --Grantee spending
-	exp5[6] = "ACT-104"
-
-	exp6[0] = "EXP-206"     //ExpenditureId
-	exp6[1] = "2000"        //Amount
-	exp6[2] = "2017-08-28"  //Date
-	exp6[3] = "Consultancy" //Type
-	exp6[4] = "Approved"    //Status
-	exp6[5] = "ACT-103"     //FromActor --Grantee spending
-	exp6[6] = "ACT-104"
-
-	exp7[0] = "EXP-207"    //ExpenditureId
-	exp7[1] = "7500"       //Amount
-	exp7[2] = "2017-08-31" //Date
-	exp7[3] = "Equipment"  //Type
-	exp7[4] = "Pending"    //Status
-	exp7[5] = "ACT-103"    //FromActor --Grantee spending
-	exp7[6] = "ACT-104"
-
-	exp8[0] = "EXP-208"    //ExpenditureId
-	exp8[1] = "1000"       //Amount
-	exp8[2] = "2017-09-01" //Date
-	exp8[3] = "Travel"     //Type
-	exp8[4] = "Approved"   //Status
-	exp8[5] = "ACT-103"    //FromActor --Grantee spending
-	exp8[6] = "ACT-104"
-
-	exp9[0] = "EXP-209"    //ExpenditureId
-	exp9[1] = "1500"       //Amount
-	exp9[2] = "2017-09-04" //Date
-	exp9[3] = "Training"   //Type
-	exp9[4] = "Approved"   //Status
-	exp9[5] = "ACT-103"    //FromActor --Grantee spending
-	exp9[6] = "ACT-104"
-
-	t.init_expenditure(stub, exp1)
-	t.init_expenditure(stub, exp2)
-	t.init_expenditure(stub, exp3)
-	t.init_expenditure(stub, exp4)
-	t.init_expenditure(stub, exp5)
-	t.init_expenditure(stub, exp6)
-	t.init_expenditure(stub, exp7)
-	t.init_expenditure(stub, exp8)
-	t.init_expenditure(stub, exp9)
-
-	//---------------------create reimbursement------------------------------------------------
-	// Reimbursement
-
-	rem1[0] = "REM-301"    //ReimbursementId
-	rem1[1] = "3000"       //Amount
-	rem1[2] = "ACT-101"    //FromActor
-	rem1[3] = "ACT-102"    //ToActor
-	rem1[4] = "2017-05-12" //Date
-	rem1[5] = "EXP-201"    //ExpenditureId
-
-	rem2[0] = "REM-302"    //ReimbursementId
-	rem2[1] = "4000"       //Amount
-	rem2[2] = "ACT-101"    //FromActor
-	rem2[3] = "ACT-102"    //ToActor
-	rem2[4] = "2017-05-14" //Date
-	rem2[5] = "EXP-203"    //ExpenditureId
-
-	rem3[0] = "REM-303"    //ReimbursementId
-	rem3[1] = "3000"       //Amount
-	rem3[2] = "ACT-101"    //FromActor
-	rem3[3] = "ACT-102"    //ToActor
-	rem3[4] = "2017-05-19" //Date
-	rem3[5] = "EXP-204"    //ExpenditureId
-
-	rem4[0] = "REM-304"    //ReimbursementId
-	rem4[1] = "5000"       //Amount
-	rem4[2] = "ACT-101"    //FromActor
-	rem4[3] = "ACT-102"    //ToActor
-	rem4[4] = "2017-05-21" //Date
-	rem4[5] = "EXP-205"    //ExpenditureId
-
-	rem5[0] = "REM-305"    //ReimbursementId
-	rem5[1] = "2000"       //Amount
-	rem5[2] = "ACT-102"    //FromActor
-	rem5[3] = "ACT-103"    //ToActor
-	rem5[4] = "2017-05-22" //Date
-	rem5[5] = "EXP-206"    //ExpenditureId
-
-	rem6[0] = "REM-306"    //ReimbursementId
-	rem6[1] = "1000"       //Amount
-	rem6[2] = "ACT-102"    //FromActor
-	rem6[3] = "ACT-103"    //ToActor
-	rem6[4] = "2017-05-26" //Date
-	rem6[5] = "EXP-208"    //ExpenditureId
-
-	rem7[0] = "REM-307"    //ReimbursementId
-	rem7[1] = "1500"       //Amount
-	rem7[2] = "ACT-102"    //FromAct
-	rem7[3] = "ACT-103"    //ToActor
-	rem7[4] = "2017-05-29" //Date
-	rem7[5] = "EXP-209"    //ExpenditureId
-
-	t.init_reimbursement(stub, rem1)
-	t.init_reimbursement(stub, rem2)
-	t.init_reimbursement(stub, rem3)
-	t.init_reimbursement(stub, rem4)
-	t.init_reimbursement(stub, rem5)
-	t.init_reimbursement(stub, rem6)
-	t.init_reimbursement(stub, rem7)
+	if !t.caller_has_role(stub, "admin") {
+		return nil, errors.New("Only an admin can load the demo fixture")
+	}
 
-	return nil, nil
+	fixture := Fixture{}
+	err := json.Unmarshal([]byte(demoFixture), &fixture)
+	if err != nil {
+		return nil, errors.New("Demo fixture is not valid JSON")
+	}
+
+	result, err := t.load_fixture(stub, fixture)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(result.Records); i++ {
+		if result.Records[i].Status != "Loaded" {
+			return nil, errors.New("Demo " + result.Records[i].Kind + " " + result.Records[i].Id + " failed to load: " + result.Records[i].Error)
+		}
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+
+	return resultAsBytes, nil
 }
 
+// demo data: the PPM Foundation funds Stanford, which sub-awards part of it to John Hopkins; both grantees spend with
+// Dixon consulting and are reimbursed for the approved expenses
+var demoFixture = `{
+	"actors": [
+		{"actorid": "ACT-101", "actorname": "PPM Foundation"},
+		{"actorid": "ACT-102", "actorname": "Stanford University"},
+		{"actorid": "ACT-103", "actorname": "John Hopkins University"},
+		{"actorid": "ACT-104", "actorname": "Dixon consulting"}
+	],
+	"awards": [
+		{"awardid": "AWD-401", "grantorid": "ACT-101", "granteeid": "ACT-102", "amount": "125000", "currency": "USD", "startdate": "2017-01-01", "enddate": "2018-12-31", "liquidationdays": "90"},
+		{"awardid": "AWD-402", "grantorid": "ACT-102", "granteeid": "ACT-103", "amount": "45000", "currency": "USD", "parentawardid": "AWD-401", "startdate": "2017-03-01", "enddate": "2018-06-30", "liquidationdays": "90"}
+	],
+	"suppliers": [
+		{"actorid": "ACT-104", "name": "Dixon consulting", "taxidhash": "b0583770ec509e79040a444624d55be4db44cb857be315b2b1a8413c9bf7f6a2", "status": "Verified", "verifiedby": "ACT-101", "verifieddate": "2017-01-01"}
+	],
+	"expenditures": [
+		{"expenditureid": "EXP-201", "amount": "3000", "date": "2017-08-18", "type": "Travel", "status": "Approved", "fromactor": "ACT-102", "toactor": "ACT-104"},
+		{"expenditureid": "EXP-202", "amount": "8000", "date": "2017-08-19", "type": "Equipment", "status": "Pending", "fromactor": "ACT-102", "toactor": "ACT-104"},
+		{"expenditureid": "EXP-203", "amount": "4000", "date": "2017-08-20", "type": "Training", "status": "Approved", "fromactor": "ACT-102", "toactor": "ACT-104"},
+		{"expenditureid": "EXP-204", "amount": "3000", "date": "2017-08-25", "type": "Software License", "status": "Approved", "fromactor": "ACT-102", "toactor": "ACT-104"},
+		{"expenditureid": "EXP-205", "amount": "5000", "date": "2017-08-27", "type": "Specimens", "status": "Approved", "fromactor": "ACT-102", "toactor": "ACT-104"},
+		{"expenditureid": "EXP-206", "amount": "2000", "date": "2017-08-28", "type": "Consultancy", "status": "Approved", "fromactor": "ACT-103", "toactor": "ACT-104"},
+		{"expenditureid": "EXP-207", "amount": "7500", "date": "2017-08-31", "type": "Equipment", "status": "Pending", "fromactor": "ACT-103", "toactor": "ACT-104"},
+		{"expenditureid": "EXP-208", "amount": "1000", "date": "2017-09-01", "type": "Travel", "status": "Approved", "fromactor": "ACT-103", "toactor": "ACT-104"},
+		{"expenditureid": "EXP-209", "amount": "1500", "date": "2017-09-04", "type": "Training", "status": "Approved", "fromactor": "ACT-103", "toactor": "ACT-104"}
+	],
+	"reimbursements": [
+		{"reimbursementid": "REM-301", "amount": "3000", "fromactor": "ACT-101", "toactor": "ACT-102", "date": "2017-05-12", "expenditureid": "EXP-201"},
+		{"reimbursementid": "REM-302", "amount": "4000", "fromactor": "ACT-101", "toactor": "ACT-102", "date": "2017-05-14", "expenditureid": "EXP-203"},
+		{"reimbursementid": "REM-303", "amount": "3000", "fromactor": "ACT-101", "toactor": "ACT-102", "date": "2017-05-19", "expenditureid": "EXP-204"},
+		{"reimbursementid": "REM-304", "amount": "5000", "fromactor": "ACT-101", "toactor": "ACT-102", "date": "2017-05-21", "expenditureid": "EXP-205"},
+		{"reimbursementid": "REM-305", "amount": "2000", "fromactor": "ACT-102", "toactor": "ACT-103", "date": "2017-05-22", "expenditureid": "EXP-206"},
+		{"reimbursementid": "REM-306", "amount": "1000", "fromactor": "ACT-102", "toactor": "ACT-103", "date": "2017-05-26", "expenditureid": "EXP-208"},
+		{"reimbursementid": "REM-307", "amount": "1500", "fromactor": "ACT-102", "toactor": "ACT-103", "date": "2017-05-29", "expenditureid": "EXP-209"}
+	]
+}`
+
 func (t *SimpleChaincode) init_reimbursement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var err error
 
-	if len(args) != 6 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 6")
+	//       0         1         2           3         4        5             6               7             8
+	// "remid", "amount", "fromactor", "toactor", "date", "expid", [requested amount, disallowed amount, reason code]
+	if len(args) != 6 && len(args) != 9 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 6 or 9")
 	}
 
 	//input sanitation
@@ -335,6 +238,22 @@ func (t *SimpleChaincode) init_reimbursement(stub shim.ChaincodeStubInterface, a
 	remDate := args[4]
 	remExpId := args[5]
 
+	//without an explicit approval the whole expenditure was paid
+	requested := remAmount
+	disallowed := 0.0
+	reasonCode := ""
+	if len(args) == 9 {
+		requested, err = strconv.ParseFloat(args[6], 64)
+		if err != nil {
+			return nil, errors.New("7th argument must be a numeric string")
+		}
+		disallowed, err = strconv.ParseFloat(args[7], 64)
+		if err != nil {
+			return nil, errors.New("8th argument must be a numeric string")
+		}
+		reasonCode = args[8]
+	}
+
 	//check if account already exists
 	accountAsBytes, err := stub.GetState(remId)
 	if err != nil {
@@ -347,12 +266,19 @@ func (t *SimpleChaincode) init_reimbursement(stub shim.ChaincodeStubInterface, a
 		return nil, errors.New("This reimbursement arleady exists")
 	}
 
-	remAmountStr := strconv.FormatFloat(remAmount, 'f', -1, 64)
+	newRem := Reimbursement{}
+	newRem.ReimbursementId = remId
+	newRem.Amount = strconv.FormatFloat(remAmount, 'f', -1, 64)
+	newRem.FromActor = remFromActor
+	newRem.ToActor = remToActor
+	newRem.Date = remDate
+	newRem.ExpenditureId = remExpId
+	newRem.RequestedAmount = strconv.FormatFloat(requested, 'f', -1, 64)
+	newRem.DisallowedAmount = strconv.FormatFloat(disallowed, 'f', -1, 64)
+	newRem.ReasonCode = reasonCode
 
-	//build the expenditure json string
-	str := `{"reimbursementid": "` + remId + `", "amount": "` + remAmountStr + `", "fromactor": "` + remFromActor + `", "toActor": "` + remToActor + `", "date": "` + remDate + `", "expenditureid": "` + remExpId + `"}`
-	//jsonAsBytesActor, _ := json.Marshal(newActor)
-	err = stub.PutState(remId, []byte(str))
+	jsonAsBytesRem, _ := json.Marshal(newRem)
+	err = stub.PutState(remId, jsonAsBytesRem)
 	if err != nil {
 		return nil, err
 	}
@@ -445,23 +371,17 @@ func (t *SimpleChaincode) init_expenditure(stub shim.ChaincodeStubInterface, arg
 		return nil, errors.New("This expenditure arleady exists")
 	}
 
-	expAmountStr := strconv.FormatFloat(expAmount, 'f', -1, 64)
+	newExp := Expenditure{}
+	newExp.ExpenditureId = expId
+	newExp.Amount = strconv.FormatFloat(expAmount, 'f', -1, 64)
+	newExp.Date = expDate
+	newExp.Type = expType
+	newExp.Status = expStatus
+	newExp.FromActor = fromActor
+	newExp.ToActor = toActor
 
-	//newActor := Actor{}
-	//newActor.ActorId = actorId
-	//newActor.ActorName = actorName
-	//newActor.Balance = balance
-
-	//	   expDate := arg[2]
-	///  expType := arg[3]
-	/// expStatus := arg[4]
-	//fromActor := arg[5]
-	//toActor := arg[6]
-
-	//build the expenditure json string
-	str := `{"expenditureid": "` + expId + `", "amount": "` + expAmountStr + `", "date": "` + expDate + `", "type": "` + expType + `", "status": "` + expStatus + `", "fromactor": "` + fromActor + `", "toactor": "` + toActor + `"}`
-	//jsonAsBytesActor, _ := json.Marshal(newActor)
-	err = stub.PutState(expId, []byte(str))
+	jsonAsBytesExp, _ := json.Marshal(newExp)
+	err = stub.PutState(expId, jsonAsBytesExp)
 	if err != nil {
 		return nil, err
 	}
@@ -494,73 +414,231 @@ func (t *SimpleChaincode) ReleaseFund(stub shim.ChaincodeStubInterface, args []s
 	//arg[0] actor id
 	//arg[1] ... exp id
 
-	// get all expense ids
-	var expenseIds []string
+	if len(args) < 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting actor id and at least 1 expenditure id")
+	}
+
+	// every listed expense is reimbursed in full
+	var remIds []string
 	for i := 1; i < len(args); i++ {
-		expenseIds = append(expenseIds, args[i])
+		oneExp, err := t.get_expenditure(stub, args[i])
+		if err != nil {
+			return nil, err
+		}
+		err = t.authorise_release(stub, args[0], oneExp)
+		if err != nil {
+			return nil, err
+		}
+		remId, err := t.approve_expenditure(stub, args[0], oneExp, oneExp.Amount, "0", "")
+		if err != nil {
+			return nil, err
+		}
+		remIds = append(remIds, remId)
+
+		err = t.evaluate_alerts(stub, oneExp.AwardId, remId)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// get Actor A -- from actor
-	fromActorAsBytes, err := stub.GetState(args[0])
+	remIdsAsBytes, _ := json.Marshal(remIds)
+	return remIdsAsBytes, nil
+}
+
+// ============================================================================================================================
+// ApproveExpense Function - Called when the grantor approves only part of one or more expenditures
+// Function: update Expenditure struct (status), create a Reimbursement for the approved amount recording requested vs paid,
+// update Actor struct (transfer the approved amount)
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) ApproveExpense(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//     0           1          2                  3                  4         5 ...
+	// "actor id"  "exp id"  "approved amount"  "disallowed amount"  "reason"  "exp id" ...
+
+	if len(args) < 5 || (len(args)-1)%4 != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting actor id followed by groups of exp id, approved amount, disallowed amount, reason code")
+	}
+
+	var remIds []string
+	for i := 1; i < len(args); i += 4 {
+		oneExp, err := t.get_expenditure(stub, args[i])
+		if err != nil {
+			return nil, err
+		}
+		err = t.authorise_release(stub, args[0], oneExp)
+		if err != nil {
+			return nil, err
+		}
+		remId, err := t.approve_expenditure(stub, args[0], oneExp, args[i+1], args[i+2], args[i+3])
+		if err != nil {
+			return nil, err
+		}
+		remIds = append(remIds, remId)
+
+		err = t.evaluate_alerts(stub, oneExp.AwardId, remId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	remIdsAsBytes, _ := json.Marshal(remIds)
+	return remIdsAsBytes, nil
+}
+
+// ============================================================================================================================
+// get_expenditure - read one expenditure from the world state, failing if it was never created
+// ============================================================================================================================
+func (t *SimpleChaincode) get_expenditure(stub shim.ChaincodeStubInterface, expId string) (Expenditure, error) {
+	oneExp := Expenditure{}
+	expAsBytes, err := stub.GetState(expId)
 	if err != nil {
-		return nil, errors.New("Failed to get from actor")
+		return oneExp, errors.New("Failed to get expenditure")
 	}
-	fromActor := Actor{}
-	json.Unmarshal(fromActorAsBytes, &fromActor)
+	json.Unmarshal(expAsBytes, &oneExp)
+	if oneExp.ExpenditureId != expId {
+		return oneExp, errors.New("Expenditure " + expId + " does not exist")
+	}
+	return oneExp, nil
+}
 
-	//get the exp index array
-	expsIndexAsBytes, err := stub.GetState(expIndexStr)
+// ============================================================================================================================
+// get_reimbursement - read one reimbursement from the world state, failing if it was never created
+// ============================================================================================================================
+func (t *SimpleChaincode) get_reimbursement(stub shim.ChaincodeStubInterface, remId string) (Reimbursement, error) {
+	oneRem := Reimbursement{}
+	remAsBytes, err := stub.GetState(remId)
 	if err != nil {
-		return nil, errors.New("Failed to get expenditure index")
+		return oneRem, errors.New("Failed to get reimbursement")
 	}
-	var expIndex []string
-	json.Unmarshal(expsIndexAsBytes, &expIndex)
+	json.Unmarshal(remAsBytes, &oneRem)
+	if oneRem.ReimbursementId != remId {
+		return oneRem, errors.New("Reimbursement " + remId + " does not exist")
+	}
+	return oneRem, nil
+}
 
-	//loop through to get exp.fromActor as toActor for reimbursement
-	for i := 0; i < len(expenseIds); i++ {
-		for j := 0; j < len(expIndex); j++ {
-			if expIndex[j] == expenseIds[i] {
-				// get to actor ID
-				oneExpAsByte, err1 := stub.GetState(expIndex[j])
-				if err1 != nil {
-					return nil, errors.New("Failed to get expenditure")
-				}
-				oneExp := Expenditure{}
-				json.Unmarshal(oneExpAsByte, &oneExp)
+// ============================================================================================================================
+// put_expenditure - store an expenditure that has already been added to the expenditure index
+// ============================================================================================================================
+func (t *SimpleChaincode) put_expenditure(stub shim.ChaincodeStubInterface, oneExp Expenditure) error {
+	oneExpAsBytes, _ := json.Marshal(oneExp)
+	return stub.PutState(oneExp.ExpenditureId, oneExpAsBytes)
+}
 
-				//TODO CHECK IF THE EXP STATUS IS "Pending"
+// ============================================================================================================================
+// tx_time - the timestamp of the current transaction, the same on every peer unlike the local clock
+// ============================================================================================================================
+func tx_time(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, errors.New("Failed to get transaction timestamp")
+	}
+	return time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC(), nil
+}
 
-				// transfer balance
-				t.Transfer_balance(stub, []string{args[0], oneExp.FromActor, oneExp.Amount, "fund"})
+// ============================================================================================================================
+// next_expenditure_id / next_reimbursement_id - the id init_expenditure / init_reimbursement will be called with next
+// ============================================================================================================================
+func next_expenditure_id() string {
+	return "EXP-" + strconv.Itoa(expNumber+201)
+}
 
-				// change exp status
-				oneExp.Status = "Approved"
-				oneExpAsByte, _ = json.Marshal(oneExp)
-				err = stub.PutState(oneExp.ExpenditureId, oneExpAsByte)
+func next_reimbursement_id() string {
+	return "REM-" + strconv.Itoa(reimbNumber+301)
+}
 
-				// create a new reimbursement
-				var remid string = "REM-"
-				ii := strconv.Itoa(reimbNumber + 301)
-				remid += ii
+// ============================================================================================================================
+// approve_expenditure - pay the approved part of a pending expenditure and disallow the rest
+// The approved and disallowed amounts must add up to the expenditure amount, and a reason code is required whenever
+// something is disallowed. Returns the id of the reimbursement that records requested vs paid.
+// ============================================================================================================================
+func (t *SimpleChaincode) approve_expenditure(stub shim.ChaincodeStubInterface, actorId string, oneExp Expenditure, approvedStr string, disallowedStr string, reasonCode string) (string, error) {
+	if oneExp.Status != "Pending" {
+		return "", errors.New("Expenditure " + oneExp.ExpenditureId + " is not pending")
+	}
+	err := t.check_award_open(stub, oneExp.AwardId)
+	if err != nil {
+		return "", err
+	}
 
-				current_time := time.Now().Local()
+	requested, err := strconv.ParseFloat(oneExp.Amount, 64)
+	if err != nil {
+		return "", errors.New("Expenditure " + oneExp.ExpenditureId + " has a non-numeric amount")
+	}
+	approved, err := strconv.ParseFloat(approvedStr, 64)
+	if err != nil || approved < 0 {
+		return "", errors.New("Approved amount must be a non-negative numeric string")
+	}
+	disallowed, err := strconv.ParseFloat(disallowedStr, 64)
+	if err != nil || disallowed < 0 {
+		return "", errors.New("Disallowed amount must be a non-negative numeric string")
+	}
+	if math.Abs(approved+disallowed-requested) > 0.000001 {
+		return "", errors.New("Approved and disallowed amounts must add up to " + oneExp.Amount + " for " + oneExp.ExpenditureId)
+	}
+	if disallowed > 0 && len(reasonCode) <= 0 {
+		return "", errors.New("A reason code is required to disallow costs on " + oneExp.ExpenditureId)
+	}
+	if approvals_outstanding(oneExp) && !approval_rejected(oneExp) {
+		return "", errors.New("Expenditure " + oneExp.ExpenditureId + " still needs the approval of " + oneExp.Approvers[len(oneExp.Approvals)])
+	}
 
-				t.init_reimbursement(stub, []string{remid, oneExp.Amount, args[0], oneExp.FromActor, current_time.String(), expIndex[j]})
+	approvedAmountStr := strconv.FormatFloat(approved, 'f', -1, 64)
+	remid := next_reimbursement_id()
 
-			}
+	// transfer balance
+	if approved > 0 {
+		_, err = t.Transfer_balance(stub, []string{actorId, oneExp.FromActor, approvedAmountStr, "fund", remid})
+		if err != nil {
+			return "", err
 		}
 	}
 
-	return nil, nil
+	// change exp status
+	if disallowed == 0 {
+		oneExp.Status = "Approved"
+	} else if approved == 0 {
+		oneExp.Status = "Disallowed"
+	} else {
+		oneExp.Status = "Partially Approved"
+	}
+	oneExpAsByte, _ := json.Marshal(oneExp)
+	err = stub.PutState(oneExp.ExpenditureId, oneExpAsByte)
+	if err != nil {
+		return "", err
+	}
+
+	// create a new reimbursement, also for a fully disallowed expense so the audit trail is complete
+	current_time, err := tx_time(stub)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = t.init_reimbursement(stub, []string{remid, approvedAmountStr, actorId, oneExp.FromActor, current_time.Format(dateFormat), oneExp.ExpenditureId, oneExp.Amount, strconv.FormatFloat(disallowed, 'f', -1, 64), reasonCode})
+	if err != nil {
+		return "", err
+	}
+
+	return remid, nil
 }
 
 // ============================================================================================================================
 // Query Function - Called when query all expenditure
-// Function: query all the expenditures of this award
+// Function: query all the expenditures of this award the caller may see
 // Query
 // ============================================================================================================================
 func (t *SimpleChaincode) QueryAllExpenses(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	//args[0] = ""
+	//args[0] = optional from date
+	//args[1] = optional to date
+
+	from, to, err := date_range(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
 
 	//get the exp index
 	expsIndexAsBytes, err := stub.GetState(expIndexStr)
@@ -578,6 +656,9 @@ func (t *SimpleChaincode) QueryAllExpenses(stub shim.ChaincodeStubInterface, arg
 		}
 		oneExpense := Expenditure{}
 		json.Unmarshal(expAsBytes, &oneExpense)
+		if !in_date_range(oneExpense.Date, from, to) || !view.can_see(oneExpense.FromActor, oneExpense.ToActor) {
+			continue
+		}
 		expenses = append(expenses, oneExpense)
 	}
 
@@ -590,10 +671,21 @@ func (t *SimpleChaincode) QueryAllExpenses(stub shim.ChaincodeStubInterface, arg
 
 // ============================================================================================================================
 // Query Function - Called when query pending expenditure
-// Function: query all the pending expenditures of this award
+// Function: query all the pending expenditures of this award the caller may see
 // Query
 // ============================================================================================================================
 func (t *SimpleChaincode) QueryPendingExpenses(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//args[0] = optional from date
+	//args[1] = optional to date
+
+	from, to, err := date_range(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
 
 	expsIndexAsBytes, err := stub.GetState(expIndexStr)
 	if err != nil {
@@ -611,7 +703,7 @@ func (t *SimpleChaincode) QueryPendingExpenses(stub shim.ChaincodeStubInterface,
 		oneExpense := Expenditure{}
 		json.Unmarshal(expAsBytes, &oneExpense)
 
-		if oneExpense.Status == "Pending" {
+		if oneExpense.Status == "Pending" && in_date_range(oneExpense.Date, from, to) && view.can_see(oneExpense.FromActor, oneExpense.ToActor) {
 			expenses = append(expenses, oneExpense)
 		}
 	}
@@ -625,15 +717,85 @@ func (t *SimpleChaincode) QueryPendingExpenses(stub shim.ChaincodeStubInterface,
 }
 
 
+// ============================================================================================================================
+// Query Function - Called when query disallowed costs
+// Function: list every reimbursement the caller sees with a disallowed amount, grouped per grantee, for the audit file. Clawbacks show up
+// as disallowed costs and reversals as negative ones.
+// Query
+// ============================================================================================================================
+func (t *SimpleChaincode) QueryDisallowedCosts(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//args[0] = optional grantee id
+
+	type DisallowedCosts struct {
+		GranteeId       string          `json:"granteeid"`
+		TotalDisallowed string          `json:"totaldisallowed"`
+		Reimbursements  []Reimbursement `json:"reimbursements"`
+	}
+
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
+	reimbsIndexAsBytes, err := stub.GetState(reimbIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get reimbursement index")
+	}
+	var reimbIndex []string
+	json.Unmarshal(reimbsIndexAsBytes, &reimbIndex)
+
+	var grantees []DisallowedCosts
+	var totals []float64
+	for i := 0; i < len(reimbIndex); i++ {
+		reimbAsBytes, err := stub.GetState(reimbIndex[i])
+		if err != nil {
+			return nil, errors.New("Failed to get reimbursement")
+		}
+		oneReimburse := Reimbursement{}
+		json.Unmarshal(reimbAsBytes, &oneReimburse)
+
+		disallowed, err := strconv.ParseFloat(oneReimburse.DisallowedAmount, 64)
+		// reversals carry a negative disallowed amount so they net off against the original
+		if err != nil || disallowed == 0 {
+			continue
+		}
+		if len(args) > 0 && len(args[0]) > 0 && oneReimburse.ToActor != args[0] {
+			continue
+		}
+		if !view.can_see(oneReimburse.FromActor, oneReimburse.ToActor) {
+			continue
+		}
+
+		j := 0
+		for j < len(grantees) && grantees[j].GranteeId != oneReimburse.ToActor {
+			j++
+		}
+		if j == len(grantees) {
+			grantees = append(grantees, DisallowedCosts{GranteeId: oneReimburse.ToActor})
+			totals = append(totals, 0)
+		}
+		totals[j] += disallowed
+		grantees[j].TotalDisallowed = strconv.FormatFloat(totals[j], 'f', -1, 64)
+		grantees[j].Reimbursements = append(grantees[j].Reimbursements, oneReimburse)
+	}
+
+	resultAsBytes, _ := json.Marshal(grantees)
+
+	return resultAsBytes, nil
+}
+
 // ============================================================================================================================
 // Query Function - Called when query block chain diagram
-// Function: query all the transactions of this award before certain date
+// Function: query all the transactions the caller sees of this award before certain date
 // Query
 // ============================================================================================================================
 func (t *SimpleChaincode) QueryBlockChain(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	//threshold date
 	thresholdDate := time.Date(
 		2017, 05, 14, 20, 34, 58, 651387237, time.UTC)
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
 
 	// get all expenditure index
 	expsIndexAsBytes, err := stub.GetState(expIndexStr)
@@ -657,7 +819,7 @@ func (t *SimpleChaincode) QueryBlockChain(stub shim.ChaincodeStubInterface, args
 			return nil, errors.New(dateStr)
 		}
 		diff := date.Sub(thresholdDate)
-		if  diff > 0 {
+		if  diff > 0 && view.can_see(oneExpense.FromActor, oneExpense.ToActor) {
 			expenses = append(expenses, oneExpense)
 		}
 
@@ -684,7 +846,7 @@ func (t *SimpleChaincode) QueryBlockChain(stub shim.ChaincodeStubInterface, args
 		dateStr := oneReimburse.Date
 		date, err := time.Parse("2006-01-02", dateStr)
 		diff := date.Sub(thresholdDate)
-		if diff > 0{
+		if diff > 0 && view.can_see(oneReimburse.FromActor, oneReimburse.ToActor) {
 			reimbursements = append(reimbursements, oneReimburse)
 		}
 
@@ -702,10 +864,15 @@ func (t *SimpleChaincode) QueryBlockChain(stub shim.ChaincodeStubInterface, args
 
 // ============================================================================================================================
 // Query Function - Called when query actors' wallets
-// Function: query the balance of all actors
+// Function: query the balance of every actor the caller may see
 // Query
 // ============================================================================================================================
 func (t *SimpleChaincode) QueryWallet(stub shim.ChaincodeStubInterface, args []string) ([]byte, error){
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
+
 	actorIndexAsBytes, err := stub.GetState(accountIndexStr)
 	if err != nil {
 		return nil, errors.New("Failed to get actor index")
@@ -723,6 +890,9 @@ func (t *SimpleChaincode) QueryWallet(stub shim.ChaincodeStubInterface, args []s
 		}
 		oneActor := Actor{}
 		json.Unmarshal(actorAsBytes,&oneActor)
+		if !view.can_see(oneActor.ActorId) {
+			continue
+		}
 		allActors = append(allActors, oneActor)
 		//resultAsBytes = append(resultAsBytes, actorAsBytes...)
 	}
@@ -741,8 +911,12 @@ func (t *SimpleChaincode) QueryWallet(stub shim.ChaincodeStubInterface, args []s
 // Invoke
 // ============================================================================================================================
 func (t *SimpleChaincode) Spend(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	//     0           1        2        3
-	// "from id"   "to id"   "amount"  "type"
+	//     0           1        2        3           4
+	// "from id"   "to id"   "amount"  "type"  [options json]
+
+	if len(args) < 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting at least 4")
+	}
 
 	//get from actor
 	accountAAsBytes, err := stub.GetState(args[0])
@@ -767,47 +941,203 @@ func (t *SimpleChaincode) Spend(stub shim.ChaincodeStubInterface, args []string)
 		return nil, errors.New(args[2])
 	}
 
-	//get date
-	current_time := time.Now().Local()
+	//get options
+	options := SpendOptions{}
+	if len(args) > 4 && len(args[4]) > 0 {
+		err = json.Unmarshal([]byte(args[4]), &options)
+		if err != nil {
+			return nil, errors.New("5th argument must be a JSON object of spend options")
+		}
+	}
+
+	//get date, an invoice may be dated before the transaction but never after it
+	current_time, err := tx_time(stub)
+	if err != nil {
+		return nil, err
+	}
+	expDate := current_time.Format(dateFormat)
+	if len(options.Date) > 0 {
+		date, err := time.Parse(dateFormat, options.Date)
+		if err != nil {
+			return nil, errors.New("Expenditure date must be formatted " + dateFormat)
+		}
+		if date.After(current_time) {
+			return nil, errors.New("Expenditure date " + options.Date + " is in the future")
+		}
+		expDate = options.Date
+	}
+
+	//get the award the expense is charged to and convert into its currency
+	award, err := t.find_award(stub, resA.ActorId, options.AwardId)
+	if err != nil {
+		return nil, err
+	}
+	if award_status(award) != "Active" {
+		return nil, errors.New("Award " + award.AwardId + " is " + award_status(award) + " and takes no more expenses")
+	}
+	err = check_award_period(award, expDate, current_time)
+	if err != nil {
+		return nil, err
+	}
+
+	//the payee must be a verified supplier that is not debarred on the day it is paid
+	screening, err := t.screen_supplier(stub, args[1], current_time.Format(dateFormat))
+	if err != nil {
+		return nil, err
+	}
+
+	//an invoice of the supplier is paid only once
+	if len(options.InvoiceDate) > 0 {
+		invoiceDate, err := time.Parse(dateFormat, options.InvoiceDate)
+		if err != nil {
+			return nil, errors.New("Invoice date must be formatted " + dateFormat)
+		}
+		if invoiceDate.After(current_time) {
+			return nil, errors.New("Invoice date " + options.InvoiceDate + " is in the future")
+		}
+	}
+	if len(options.InvoiceNumber) > 0 {
+		err = t.check_invoice(stub, resB.ActorId, options.InvoiceNumber)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	//check the supporting documents sent with the expense
+	documents, err := check_documents(options.Documents, 0, resA.ActorId, current_time)
+	if err != nil {
+		return nil, err
+	}
+	options.Documents = documents
+
+	converted, fxRate, err := t.convert_amount(stub, amount, options.Currency, award.Currency, expDate)
+	if err != nil {
+		return nil, err
+	}
+	convertedStr := strconv.FormatFloat(converted, 'f', -1, 64)
+
+	//check the allowability rules, a rejection stops the expense here
+	firedRules, err := t.evaluate_rules(stub, award, args[3], converted, options)
+	if err != nil {
+		return nil, err
+	}
 
 	// populate
-	var expid string = "EXP-"
-	ii := strconv.Itoa(expNumber + 201)
-	expid += ii
+	expid := next_expenditure_id()
 
 	var expstatus string
 
 	// compare with threshold to determine status
-	if amount > 6000 {
+	if converted > 6000 {
 		expstatus = "Pending"
 	} else {
 		expstatus = "Approved"
 	}
 
-	t.init_expenditure(stub, []string{expid, strconv.FormatFloat(amount, 'f', -1, 64), current_time.String(), args[3], expstatus, resA.ActorId, resB.ActorId})
-	//exp := Expenditure{}
-	//exp.Amount = strconv.FormatFloat(amount, 'f', -1, 64)
-	//exp.Date = current_time.String()
-	//exp.Type = args[3]
-	//exp.ExpenditureId = "ex1"
-	//exp.FromActor = resA.ActorId
-	//exp.ToActor = resB.ActorId
+	// a rule may require review whatever the amount
+	for i := 0; i < len(firedRules); i++ {
+		if firedRules[i].Action == "pending" {
+			expstatus = "Pending"
+		}
+	}
 
-	t.Transfer_balance(stub, []string{args[0], args[1], args[2], "spend"})
+	// and an equal payment to the supplier shortly before or after
+	window, err := t.duplicate_window(stub)
+	if err != nil {
+		return nil, err
+	}
+	candidate := Expenditure{Amount: convertedStr, Currency: award.Currency, Date: expDate, ToActor: resB.ActorId, InvoiceNumber: options.InvoiceNumber}
+	if len(options.Currency) > 0 {
+		candidate.OriginalAmount = strconv.FormatFloat(amount, 'f', -1, 64)
+		candidate.OriginalCurrency = options.Currency
+	}
+	suspects, err := t.payment_suspects(stub, candidate, window)
+	if err != nil {
+		return nil, err
+	}
+	if len(suspects) > 0 {
+		expstatus = "Pending"
+	}
+
+	// so does an approval chain covering the amount
+	chain, err := t.find_approval_chain(stub, award.AwardId, converted)
+	if err != nil {
+		return nil, err
+	}
+	if len(chain.Approvers) > 0 {
+		expstatus = "Pending"
+	}
+
+	_, err = t.init_expenditure(stub, []string{expid, convertedStr, expDate, args[3], expstatus, resA.ActorId, resB.ActorId})
+	if err != nil {
+		return nil, err
+	}
+
+	newExp, err := t.get_expenditure(stub, expid)
+	if err != nil {
+		return nil, err
+	}
+	newExp.AwardId = award.AwardId
+	newExp.Currency = award.Currency
+	if len(options.Currency) > 0 {
+		newExp.OriginalAmount = strconv.FormatFloat(amount, 'f', -1, 64)
+		newExp.OriginalCurrency = options.Currency
+		newExp.FxRate = fxRate.Rate
+		newExp.FxRateDate = fxRate.Date
+	}
+	newExp.ContractRef = options.ContractRef
+	newExp.FiredRules = firedRules
+	newExp.Approvers = chain.Approvers
+	newExp.Submitted = current_time.Format(time.RFC3339)
+	newExp.Screening = screening
+	newExp.Documents = documents
+	newExp.InvoiceNumber = options.InvoiceNumber
+	newExp.InvoiceDate = options.InvoiceDate
+	newExp.VendorRef = options.VendorRef
+	newExp.SuspectedDuplicates = suspects
+	err = t.put_expenditure(stub, newExp)
+	if err != nil {
+		return nil, err
+	}
+	if len(options.InvoiceNumber) > 0 {
+		err = t.register_invoice(stub, resB.ActorId, options.InvoiceNumber, expid)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = t.register_payment(stub, newExp)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = t.Transfer_balance(stub, []string{args[0], args[1], convertedStr, "spend", expid})
+	if err != nil {
+		return nil, err
+	}
 
 	/*If the status of this exp is "Approved", then a reimbursement will be  auto generated and released*/
-	//TODO CALL INIT_REIMBURSEMENT TO GENERATE A NEW REIMBURSEMENT
 	if expstatus == "Approved"{
-		var remid string = "REM-"
-		ii := strconv.Itoa(reimbNumber + 301)
-		remid += ii
+		remid := next_reimbursement_id()
+
+		funder := award_funder(award)
+
+		_, err = t.init_reimbursement(stub, []string{remid, convertedStr, funder, resA.ActorId, current_time.Format(dateFormat), expid})
+		if err != nil {
+			return nil, err
+		}
 
-		current_time := time.Now().Local()
-		t.init_reimbursement(stub, []string{remid, strconv.FormatFloat(amount, 'f', -1, 64),"ACT-101", resA.ActorId, current_time.String(), expid})
+		_, err = t.Transfer_balance(stub, []string{funder, args[0], convertedStr, "fund", remid})
+		if err != nil {
+			return nil, err
+		}
+	}
 
-		t.Transfer_balance(stub, []string{"ACT-101", args[0], args[2], "fund"})
+	//tell the grantor about the thresholds this expense crossed
+	err = t.evaluate_alerts(stub, award.AwardId, expid)
+	if err != nil {
+		return nil, err
 	}
-	return nil, nil
+	return []byte(expid), nil
 }
 
 // ============================================================================================================================
@@ -851,14 +1181,66 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string
 		return nil, err
 	}
 
+	err = stub.PutState(journalIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stub.PutState(awardIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stub.PutState(ruleIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stub.PutState(chainIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stub.PutState(delegationIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stub.PutState(supplierIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stub.PutState(debarmentIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
 	return nil, nil
 }
 
 // ============================================================================================================================
 // Invoke - Called on chaincode invoke. Takes a function name passed and calls that function. Converts some
 //		    initial arguments passed to other things for use in the called function.
+//			A first argument "requestid=<id>" makes the invoke idempotent, see request.go.
 // ============================================================================================================================
 func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	requestId, args := split_request_id(args)
+	if len(requestId) > 0 {
+		return t.invoke_once(stub, requestId, function, args)
+	}
+	return t.dispatch_invoke(stub, function, args)
+}
+
+// ============================================================================================================================
+// dispatch_invoke - call the invoke function with the given name
+// ============================================================================================================================
+func (t *SimpleChaincode) dispatch_invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+
+	// an auditor only reads
+	if t.caller_has_role(stub, "auditor") && !t.caller_has_role(stub, "admin") {
+		return nil, errors.New("An auditor cannot invoke " + function)
+	}
 
 	// Handle different functions
 	if function == "init" { //initialize the chaincode state, used as reset
@@ -871,12 +1253,64 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function stri
 		return t.Init_actor(stub, args)
 	} else if function == "setup" {
 		return t.SetUp(stub, args)
+	} else if function == "loadfixture" {
+		return t.LoadFixture(stub, args)
 	} else if function == "spend" {
 		return t.Spend(stub, args)
+	} else if function == "spendbatch" {
+		return t.SpendBatch(stub, args)
 	} else if function == "releasefund" {
 		return t.ReleaseFund(stub, args)
+	} else if function == "approveexpense" {
+		return t.ApproveExpense(stub, args)
+	} else if function == "reversereimbursement" {
+		return t.ReverseReimbursement(stub, args)
+	} else if function == "reverseexpenditure" {
+		return t.ReverseExpenditure(stub, args)
+	} else if function == "clawback" {
+		return t.Clawback(stub, args)
+	} else if function == "createaward" {
+		return t.CreateAward(stub, args)
+	} else if function == "submitfinalreport" {
+		return t.SubmitFinalReport(stub, args)
+	} else if function == "closeaward" {
+		return t.CloseAward(stub, args)
+	} else if function == "putrule" {
+		return t.PutRule(stub, args)
+	} else if function == "deleterule" {
+		return t.DeleteRule(stub, args)
+	} else if function == "putapprovalchain" {
+		return t.PutApprovalChain(stub, args)
+	} else if function == "recordapproval" {
+		return t.RecordApproval(stub, args)
+	} else if function == "delegateapproval" {
+		return t.DelegateApproval(stub, args)
+	} else if function == "revokedelegation" {
+		return t.RevokeDelegation(stub, args)
+	} else if function == "setapprovalsla" {
+		return t.SetApprovalSla(stub, args)
+	} else if function == "setalertrules" {
+		return t.SetAlertRules(stub, args)
+	} else if function == "acknowledgealert" {
+		return t.AcknowledgeAlert(stub, args)
+	} else if function == "setduplicatewindow" {
+		return t.SetDuplicateWindow(stub, args)
+	} else if function == "escalateapprovals" {
+		return t.EscalateApprovals(stub, args)
+	} else if function == "registersupplier" {
+		return t.RegisterSupplier(stub, args)
+	} else if function == "verifysupplier" {
+		return t.VerifySupplier(stub, args)
+	} else if function == "uploaddebarments" {
+		return t.UploadDebarments(stub, args)
+	} else if function == "attachdocument" {
+		return t.AttachDocument(stub, args)
+	} else if function == "setfxprovider" {
+		return t.SetFxProvider(stub, args)
+	} else if function == "postfxrate" {
+		return t.PostFxRate(stub, args)
 	} else if function == "transferbalance" {
-		return t.Transfer_balance(stub, args)
+		return t.TransferBalance(stub, args)
 	}
 
 	return nil, errors.New("Received unknown function invocation: " + function)
@@ -898,6 +1332,48 @@ func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function strin
 		return t.QueryBlockChain(stub, args)
 	} else if function == "querywallet"{
 		return t.QueryWallet(stub, args)
+	} else if function == "querydisallowedcosts" {
+		return t.QueryDisallowedCosts(stub, args)
+	} else if function == "queryjournal" {
+		return t.QueryJournal(stub, args)
+	} else if function == "querytrialbalance" {
+		return t.QueryTrialBalance(stub, args)
+	} else if function == "querywalletasof" {
+		return t.QueryWalletAsOf(stub, args)
+	} else if function == "querystatement" {
+		return t.QueryStatement(stub, args)
+	} else if function == "queryforecast" {
+		return t.QueryForecast(stub, args)
+	} else if function == "queryalerts" {
+		return t.QueryAlerts(stub, args)
+	} else if function == "queryaging" {
+		return t.QueryAging(stub, args)
+	} else if function == "querysuspectedduplicates" {
+		return t.QuerySuspectedDuplicates(stub, args)
+	} else if function == "verifyledger" {
+		return t.VerifyLedger(stub, args)
+	} else if function == "queryawards" {
+		return t.QueryAwards(stub, args)
+	} else if function == "queryfxrate" {
+		return t.QueryFxRate(stub, args)
+	} else if function == "queryrules" {
+		return t.QueryRules(stub, args)
+	} else if function == "queryapprovalchains" {
+		return t.QueryApprovalChains(stub, args)
+	} else if function == "querydelegations" {
+		return t.QueryDelegations(stub, args)
+	} else if function == "queryoverdueapprovals" {
+		return t.QueryOverdueApprovals(stub, args)
+	} else if function == "querysuppliers" {
+		return t.QuerySuppliers(stub, args)
+	} else if function == "querydebarments" {
+		return t.QueryDebarments(stub, args)
+	} else if function == "queryaggregate" {
+		return t.QueryAggregate(stub, args)
+	} else if function == "queryfederalfinancialreport" {
+		return t.QueryFederalFinancialReport(stub, args)
+	} else if function == "verifydocument" {
+		return t.VerifyDocument(stub, args)
 	}
 	fmt.Println("query did not find func: " + function) //error
 
@@ -922,6 +1398,15 @@ func (t *SimpleChaincode) read(stub shim.ChaincodeStubInterface, args []string)
 		return nil, errors.New(jsonResp)
 	}
 
+	// a record the caller may not see reads as if it did not exist
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
+	if !view.can_see_record(name, valAsbytes) {
+		return nil, nil
+	}
+
 	return valAsbytes, nil
 }
 
@@ -934,7 +1419,11 @@ func (t *SimpleChaincode) Delete(stub shim.ChaincodeStubInterface, args []string
 	}
 
 	name := args[0]
-	err := stub.DelState(name) //remove the key from chaincode state
+	err := t.check_record_open(stub, name)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.DelState(name) //remove the key from chaincode state
 	if err != nil {
 		return nil, errors.New("Failed to delete state")
 	}
@@ -960,7 +1449,7 @@ func (t *SimpleChaincode) Delete(stub shim.ChaincodeStubInterface, args []string
 }
 
 // ============================================================================================================================
-// Write - directly write a variable into chaincode world state
+// Write - directly write a variable into chaincode world state, admins only and never a wallet or the journal
 // ============================================================================================================================
 func (t *SimpleChaincode) Write(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var name, value string
@@ -970,8 +1459,19 @@ func (t *SimpleChaincode) Write(stub shim.ChaincodeStubInterface, args []string)
 		return nil, errors.New("Incorrect number of arguments. Expecting 2. name of the variable and value to set")
 	}
 
+	if !t.caller_has_role(stub, "admin") {
+		return nil, errors.New("Only an admin can write the world state directly")
+	}
 	name = args[0]
 	value = args[1]
+	// wallets and the journal only change through journal entries
+	if strings.HasPrefix(name, "ACT-") || strings.HasPrefix(name, "JNL-") || name == journalIndexStr {
+		return nil, errors.New(name + " can only be changed through a journal entry")
+	}
+	err = t.check_record_open(stub, name)
+	if err != nil {
+		return nil, err
+	}
 	err = stub.PutState(name, []byte(value))
 	if err != nil {
 		return nil, err
@@ -1041,21 +1541,8 @@ func (t *SimpleChaincode) Init_actor(stub shim.ChaincodeStubInterface, args []st
 	if res.ActorId == actorId {
 		return nil, errors.New("This account arleady exists")
 	}
-	committedStr := strconv.FormatFloat(committed, 'f', -1, 64)
-	reimbursedStr := strconv.FormatFloat(reimbursed, 'f', -1, 64)
-	awardedStr := strconv.FormatFloat(awarded, 'f', -1, 64)
-	spentStr := strconv.FormatFloat(spent, 'f', -1, 64)
-	receivedStr := strconv.FormatFloat(received, 'f', -1, 64)
-	delegatedStr := strconv.FormatFloat(delegated, 'f', -1, 64)
-
-	//newActor := Actor{}
-	//newActor.ActorId = actorId
-	//newActor.ActorName = actorName
-	//newActor.Balance = balance
-
-	//build the account json string 
-	str := `{"actorid": "` + actorId + `", "actorName": "` + actorName + `", "committed": "` + committedStr + `", "reimbursed": "` + reimbursedStr + `", "awarded": "` + awardedStr + `", "spent": "` + spentStr + `", "received": "` + receivedStr + `", "delegated": "` + delegatedStr + `"}`
-	//jsonAsBytesActor, _ := json.Marshal(newActor)
+	//build the account json string, the wallet starts empty and is filled by the opening journal entry
+	str := `{"actorid": "` + actorId + `", "actorName": "` + actorName + `", "committed": "0", "reimbursed": "0", "awarded": "0", "spent": "0", "received": "0", "delegated": "0"}`
 	err = stub.PutState(actorId, []byte(str))
 	if err != nil {
 		return nil, err
@@ -1073,19 +1560,67 @@ func (t *SimpleChaincode) Init_actor(stub shim.ChaincodeStubInterface, args []st
 	accountIndex = append(accountIndex, actorId)
 	jsonAsBytes, _ := json.Marshal(accountIndex)
 	err = stub.PutState(accountIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	//post the opening balances against the opening account, negative figures mean "not applicable"
+	openings := []float64{committed, reimbursed, awarded, spent, received, delegated}
+	accounts := []string{"committed", "reimbursed", "awarded", "spent", "received", "delegated"}
+	var lines []JournalLine
+	for i := 0; i < len(openings); i++ {
+		if openings[i] <= 0 {
+			continue
+		}
+		openingStr := strconv.FormatFloat(openings[i], 'f', -1, 64)
+		if debit_normal(accounts[i]) {
+			lines = append(lines, debit_line(actorId, accounts[i], openingStr), credit_line("", openingAccount, openingStr))
+		} else {
+			lines = append(lines, credit_line(actorId, accounts[i], openingStr), debit_line("", openingAccount, openingStr))
+		}
+	}
+	if len(lines) > 0 {
+		_, err = t.post_journal_entry(stub, "opening", actorId, lines)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return nil, nil
 }
 
+// ============================================================================================================================
+// TransferBalance Function - Called when an admin transfers a balance directly, outside of the spend and fund flows
+// Function: only the plain spend and fund transfers are allowed, the other kinds are posted by the functions that
+// create the awards, delegations and reversals they belong to
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) TransferBalance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//     0         1         2         3            4
+	// "actorA", "actorB", "100.20"  "function"  [reference]
+
+	if len(args) < 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+	if !t.caller_has_role(stub, "admin") {
+		return nil, errors.New("Only an admin can transfer a balance directly")
+	}
+	if args[3] != "spend" && args[3] != "fund" {
+		return nil, errors.New("4th argument must be spend or fund")
+	}
+
+	return t.Transfer_balance(stub, args)
+}
+
 // ============================================================================================================================
 // Transfer Balance - Create a transaction between two accounts, transfer a certain amount of balance
+// Every transfer is posted as a balanced journal entry; the actor wallets are only ever changed by the posting.
 // ============================================================================================================================
 func (t *SimpleChaincode) Transfer_balance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
-	//     0         1         2         3
-	// "actorA", "actorB", "100.20"  "function"
+	//     0         1         2         3            4
+	// "actorA", "actorB", "100.20"  "function"  [reference]
 	var err error
-	var newAmountA, newAmountB float64
 
 	if len(args) < 4 {
 		return nil, errors.New("Incorrect number of arguments. Expecting 4")
@@ -1096,6 +1631,12 @@ func (t *SimpleChaincode) Transfer_balance(stub shim.ChaincodeStubInterface, arg
 	if err != nil {
 		return nil, errors.New("3rd argument must be a numeric string")
 	}
+	amountStr := strconv.FormatFloat(amount, 'f', -1, 64)
+
+	reference := ""
+	if len(args) > 4 {
+		reference = args[4]
+	}
 
 	accountAAsBytes, err := stub.GetState(args[0])
 	if err != nil {
@@ -1103,6 +1644,9 @@ func (t *SimpleChaincode) Transfer_balance(stub shim.ChaincodeStubInterface, arg
 	}
 	resA := Actor{}
 	json.Unmarshal(accountAAsBytes, &resA)
+	if resA.ActorId != args[0] {
+		return nil, errors.New("Actor " + args[0] + " does not exist")
+	}
 
 	accountBAsBytes, err := stub.GetState(args[1])
 	if err != nil {
@@ -1110,77 +1654,75 @@ func (t *SimpleChaincode) Transfer_balance(stub shim.ChaincodeStubInterface, arg
 	}
 	resB := Actor{}
 	json.Unmarshal(accountBAsBytes, &resB)
+	if resB.ActorId != args[1] {
+		return nil, errors.New("Actor " + args[1] + " does not exist")
+	}
+
+	var lines []JournalLine
 
 	switch args[3] {
 
 	case "spend":
 		fmt.Println("INSIDE CASE SPEND==========================")
-		AwardA, err := strconv.ParseFloat(resA.Awarded, 64)
+		// the available balance comes from the journal, not from the wallet counters
+		AwardA, err := t.journal_balance(stub, args[0], "awarded")
 		if err != nil {
 			return nil, err
 		}
-		BalanceA, err := strconv.ParseFloat(resA.Spent, 64)
-		if err != nil {
-			return nil, err
-		}
-		BalanceB, err := strconv.ParseFloat(resB.Received, 64)
+		SpentA, err := t.journal_balance(stub, args[0], "spent")
 		if err != nil {
 			return nil, err
 		}
 		//Check if accountA has enough balance to transact or not
-		if ( AwardA - amount) < 0 {
+		if AwardA - SpentA - amount < -0.000001 {
 			return nil, errors.New(args[0] + " doesn't have enough balance to complete transaction")
 		}
 
-		newAmountA = BalanceA + amount
-		newAmountB = BalanceB + amount
-		newAmountStrA := strconv.FormatFloat(newAmountA, 'f', -1, 64)
-		newAmountStrB := strconv.FormatFloat(newAmountB, 'f', -1, 64)
-
-		resA.Spent = newAmountStrA
-		resB.Received = newAmountStrB
+		lines = []JournalLine{debit_line(args[0], "spent", amountStr), credit_line(args[1], "received", amountStr)}
 
 	case "fund":
 		AwardA, err := strconv.ParseFloat(resA.Committed, 64)
 		if err != nil {
 			return []byte("error in resA.Committed"), err
 		}
-		BalanceA, err:= strconv.ParseFloat(resA.Reimbursed, 64)
-		if err != nil {
-			return nil, err
-		}
-		BalanceB, err := strconv.ParseFloat(resB.Received, 64)
+		// a grantee funds its sub-grantees out of what it delegated to them
+		DelegatedA, err := strconv.ParseFloat(resA.Delegated, 64)
 		if err != nil {
 			return nil, err
 		}
 		//Check if accountA has enough balance to transact or not
-		if  AwardA - amount < 0 {
+		if  AwardA + DelegatedA - amount < 0 {
 			return nil, errors.New(args[0] + " doesn't have enough balance to complete transaction")
 		}
 
+		lines = []JournalLine{debit_line(args[0], "reimbursed", amountStr), credit_line(args[1], "received", amountStr)}
 
-		newAmountA = BalanceA + amount
-		newAmountB = BalanceB + amount
-		newAmountStrA := strconv.FormatFloat(newAmountA, 'f', -1, 64)
-		newAmountStrB := strconv.FormatFloat(newAmountB, 'f', -1, 64)
+	case "reversespend":
+		lines = []JournalLine{credit_line(args[0], "spent", amountStr), debit_line(args[1], "received", amountStr)}
 
-		resA.Reimbursed = newAmountStrA
-		resB.Received = newAmountStrB
+	case "reversefund":
+		lines = []JournalLine{credit_line(args[0], "reimbursed", amountStr), debit_line(args[1], "received", amountStr)}
 
-	}
+	case "award":
+		lines = []JournalLine{credit_line(args[0], "committed", amountStr), debit_line(args[1], "awarded", amountStr)}
 
-	jsonAAsBytes, _ := json.Marshal(resA)
-	err = stub.PutState(args[0], jsonAAsBytes)
-	if err != nil {
-		return nil, err
+	case "delegate":
+		lines = []JournalLine{credit_line(args[0], "delegated", amountStr), debit_line(args[1], "awarded", amountStr)}
+
+	case "returnaward":
+		lines = []JournalLine{debit_line(args[0], "committed", amountStr), credit_line(args[1], "awarded", amountStr)}
+
+	case "returndelegate":
+		lines = []JournalLine{debit_line(args[0], "delegated", amountStr), credit_line(args[1], "awarded", amountStr)}
+
+	default:
+		return nil, errors.New("Unknown transfer function " + args[3])
 	}
 
-	jsonBAsBytes, _ := json.Marshal(resB)
-	err = stub.PutState(args[1], jsonBAsBytes)
+	entryId, err := t.post_journal_entry(stub, args[3], reference, lines)
 	if err != nil {
 		return nil, err
 	}
 
-
-	return nil, nil
+	return []byte(entryId), nil
 }
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Aggregates - totals over expenditures or reimbursements grouped by one dimension, so dashboards do not have to
+//				 download every record. Compensating records are included with their negative amounts, so a reversed
+//				 expense nets to zero in the sum.
+//
+//	Dimensions:	actor   - the grantee: who spent an expenditure, who received a reimbursement
+//				type    - the expense type, for a reimbursement that of the expense it paid
+//				status  - the expenditure status; a reimbursement is Paid, Reversed or Reversal
+//				award   - the award charged, for a reimbursement that of the expense it paid
+//				month   - the record date as 2017-08
+//				quarter - the record date as 2017-Q3
+//==============================================================================================================================
+
+// one group of an aggregate (key, count, sum, min, max, average)
+type AggregateGroup struct {
+	Key     string `json:"key"`
+	Count   int    `json:"count"`
+	Sum     string `json:"sum"`
+	Min     string `json:"min"`
+	Max     string `json:"max"`
+	Average string `json:"average"`
+}
+
+type Aggregate struct {
+	Records string           `json:"records"`
+	GroupBy string           `json:"groupby"`
+	From    string           `json:"from"`
+	To      string           `json:"to"`
+	Groups  []AggregateGroup `json:"groups"`
+}
+
+// ============================================================================================================================
+// Query Function - Called when query totals of expenditures or reimbursements
+// Function: group the records the caller sees dated within the optional range and return count, sum, min, max and
+// average per group
+// Query
+// ============================================================================================================================
+func (t *SimpleChaincode) QueryAggregate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//        0                               1                       2              3
+	// "expenditures|reimbursements"  "actor|type|status|..."  [from date]  [to date]
+
+	if len(args) < 2 || len(args) > 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2 to 4")
+	}
+	if args[0] != "expenditures" && args[0] != "reimbursements" {
+		return nil, errors.New("1st argument must be expenditures or reimbursements")
+	}
+	switch args[1] {
+	case "actor", "type", "status", "award", "month", "quarter":
+	default:
+		return nil, errors.New("2nd argument must be actor, type, status, award, month or quarter")
+	}
+	from, to, err := date_range(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	result := Aggregate{Records: args[0], GroupBy: args[1], From: from, To: to}
+	var sums, mins, maxs []float64
+	add := func(key string, amount float64) {
+		k := 0
+		for k < len(result.Groups) && result.Groups[k].Key != key {
+			k++
+		}
+		if k == len(result.Groups) {
+			result.Groups = append(result.Groups, AggregateGroup{Key: key})
+			sums = append(sums, 0)
+			mins = append(mins, math.Inf(1))
+			maxs = append(maxs, math.Inf(-1))
+		}
+		result.Groups[k].Count++
+		sums[k] += amount
+		mins[k] = math.Min(mins[k], amount)
+		maxs[k] = math.Max(maxs[k], amount)
+	}
+
+	if args[0] == "expenditures" {
+		expsIndexAsBytes, err := stub.GetState(expIndexStr)
+		if err != nil {
+			return nil, errors.New("Failed to get expenditure index")
+		}
+		var expIndex []string
+		json.Unmarshal(expsIndexAsBytes, &expIndex)
+
+		for i := 0; i < len(expIndex); i++ {
+			oneExp, err := t.get_expenditure(stub, expIndex[i])
+			if err != nil {
+				return nil, err
+			}
+			if !in_date_range(oneExp.Date, from, to) || !view.can_see(oneExp.FromActor, oneExp.ToActor) {
+				continue
+			}
+			amount, err := strconv.ParseFloat(oneExp.Amount, 64)
+			if err != nil {
+				return nil, errors.New("Expenditure " + oneExp.ExpenditureId + " has a non-numeric amount")
+			}
+			key, err := aggregate_key(args[1], oneExp.FromActor, oneExp.Type, oneExp.Status, oneExp.AwardId, oneExp.Date)
+			if err != nil {
+				return nil, err
+			}
+			add(key, amount)
+		}
+	} else {
+		reimbsIndexAsBytes, err := stub.GetState(reimbIndexStr)
+		if err != nil {
+			return nil, errors.New("Failed to get reimbursement index")
+		}
+		var reimbIndex []string
+		json.Unmarshal(reimbsIndexAsBytes, &reimbIndex)
+
+		for i := 0; i < len(reimbIndex); i++ {
+			oneRem, err := t.get_reimbursement(stub, reimbIndex[i])
+			if err != nil {
+				return nil, err
+			}
+			if !in_date_range(oneRem.Date, from, to) || !view.can_see(oneRem.FromActor, oneRem.ToActor) {
+				continue
+			}
+			amount, err := strconv.ParseFloat(oneRem.Amount, 64)
+			if err != nil {
+				return nil, errors.New("Reimbursement " + oneRem.ReimbursementId + " has a non-numeric amount")
+			}
+
+			status := "Paid"
+			if len(oneRem.ReversalOf) > 0 {
+				status = "Reversal"
+			} else if len(oneRem.ReversedBy) > 0 {
+				status = "Reversed"
+			}
+			oneExp := Expenditure{}
+			if len(oneRem.ExpenditureId) > 0 {
+				oneExp, _ = t.get_expenditure(stub, oneRem.ExpenditureId)
+			}
+			key, err := aggregate_key(args[1], oneRem.ToActor, oneExp.Type, status, oneExp.AwardId, oneRem.Date)
+			if err != nil {
+				return nil, err
+			}
+			add(key, amount)
+		}
+	}
+
+	for k := 0; k < len(result.Groups); k++ {
+		result.Groups[k].Sum = strconv.FormatFloat(sums[k], 'f', -1, 64)
+		result.Groups[k].Min = strconv.FormatFloat(mins[k], 'f', -1, 64)
+		result.Groups[k].Max = strconv.FormatFloat(maxs[k], 'f', -1, 64)
+		result.Groups[k].Average = strconv.FormatFloat(math.Round(sums[k]/float64(result.Groups[k].Count)*100)/100, 'f', -1, 64)
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+
+	return resultAsBytes, nil
+}
+
+// ============================================================================================================================
+// aggregate_key - the group a record falls in for a dimension
+// ============================================================================================================================
+func aggregate_key(groupBy string, actorId string, expType string, status string, awardId string, date string) (string, error) {
+	switch groupBy {
+	case "actor":
+		return actorId, nil
+	case "type":
+		return expType, nil
+	case "status":
+		return status, nil
+	case "award":
+		return awardId, nil
+	}
+
+	recordDate, err := time.Parse(dateFormat, date)
+	if err != nil {
+		return "", errors.New("Record date " + date + " is not formatted as " + dateFormat)
+	}
+	if groupBy == "month" {
+		return recordDate.Format("2006-01"), nil
+	}
+	return recordDate.Format("2006") + "-Q" + strconv.Itoa((int(recordDate.Month())+2)/3), nil
+}
+
+// ============================================================================================================================
+// date_range - the optional from and to dates at args[i] and args[i+1], either may be empty for an open end
+// ============================================================================================================================
+func date_range(args []string, i int) (string, string, error) {
+	var from, to string
+	if len(args) > i && len(args[i]) > 0 {
+		_, err := time.Parse(dateFormat, args[i])
+		if err != nil {
+			return "", "", errors.New("From date must be formatted as " + dateFormat)
+		}
+		from = args[i]
+	}
+	if len(args) > i+1 && len(args[i+1]) > 0 {
+		_, err := time.Parse(dateFormat, args[i+1])
+		if err != nil {
+			return "", "", errors.New("To date must be formatted as " + dateFormat)
+		}
+		to = args[i+1]
+	}
+	if len(from) > 0 && len(to) > 0 && to < from {
+		return "", "", errors.New("To date cannot be before the from date")
+	}
+	return from, to, nil
+}
+
+// ============================================================================================================================
+// in_date_range - whether a record date lies within a range, both ends included
+// ============================================================================================================================
+func in_date_range(date string, from string, to string) bool {
+	if len(from) > 0 && date < from {
+		return false
+	}
+	return len(to) <= 0 || date <= to
+}
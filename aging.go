@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Aging report - the expenditures still waiting for money: pending ones and approved ones no reimbursement has paid,
+//				   grouped by grantee and funder into buckets of 0-30, 31-60, 61-90 and 90+ days. The age is counted
+//				   in whole days from the expenditure date to the transaction timestamp. The funder is the grantor of
+//				   the award the expense is charged to, or of the grantee's first award for expenses charged to none.
+//==============================================================================================================================
+
+// one expenditure on the aging report (expenditure id, date, age in days, status, amount)
+type AgingItem struct {
+	ExpenditureId string `json:"expenditureid"`
+	Date          string `json:"date"`
+	AgeDays       int    `json:"agedays"`
+	Status        string `json:"status"`
+	Amount        string `json:"amount"`
+}
+
+// the expenditures of one age range, with the oldest of them
+type AgingBucket struct {
+	Bucket string    `json:"bucket"`
+	Count  int       `json:"count"`
+	Amount string    `json:"amount"`
+	Oldest AgingItem `json:"oldest"`
+}
+
+type AgingGroup struct {
+	GranteeId string        `json:"granteeid"`
+	FunderId  string        `json:"funderid"`
+	Count     int           `json:"count"`
+	Amount    string        `json:"amount"`
+	Buckets   []AgingBucket `json:"buckets"`
+}
+
+type AgingReport struct {
+	AsOf    string        `json:"asof"`
+	Groups  []AgingGroup  `json:"groups"`
+	Buckets []AgingBucket `json:"buckets"`
+}
+
+var agingBuckets = []string{"0-30", "31-60", "61-90", "90+"} // Age ranges of the aging report, in days
+
+// ============================================================================================================================
+// Query Function - Called when query the aging of the expenditures waiting for money
+// Function: bucket the pending and approved but unreimbursed expenditures the caller sees by age per grantee and funder,
+// optionally of one grantee, with the totals per bucket
+// Query
+// ============================================================================================================================
+func (t *SimpleChaincode) QueryAging(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//args[0] = optional grantee id
+
+	current_time, err := tx_time(stub)
+	if err != nil {
+		return nil, err
+	}
+	today, _ := time.Parse(dateFormat, current_time.Format(dateFormat))
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// the expenditures a reimbursement in force has paid, a reversal and the payment it reversed pay nothing
+	reimbsIndexAsBytes, err := stub.GetState(reimbIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get reimbursement index")
+	}
+	var reimbIndex []string
+	json.Unmarshal(reimbsIndexAsBytes, &reimbIndex)
+	paid := map[string]bool{}
+	for i := 0; i < len(reimbIndex); i++ {
+		oneRem, err := t.get_reimbursement(stub, reimbIndex[i])
+		if err != nil {
+			return nil, err
+		}
+		if len(oneRem.ExpenditureId) > 0 && len(oneRem.ReversalOf) <= 0 && len(oneRem.ReversedBy) <= 0 {
+			paid[oneRem.ExpenditureId] = true
+		}
+	}
+
+	expsIndexAsBytes, err := stub.GetState(expIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get expenditure index")
+	}
+	var expIndex []string
+	json.Unmarshal(expsIndexAsBytes, &expIndex)
+
+	report := AgingReport{AsOf: current_time.Format(dateFormat)}
+	groupSums := [][]float64{}
+	totalSums := make([]float64, len(agingBuckets))
+	for k := 0; k < len(agingBuckets); k++ {
+		report.Buckets = append(report.Buckets, AgingBucket{Bucket: agingBuckets[k]})
+	}
+
+	for i := 0; i < len(expIndex); i++ {
+		oneExp, err := t.get_expenditure(stub, expIndex[i])
+		if err != nil {
+			return nil, err
+		}
+		if oneExp.Status != "Pending" && (oneExp.Status != "Approved" || paid[oneExp.ExpenditureId]) {
+			continue
+		}
+		if len(args) > 0 && len(args[0]) > 0 && oneExp.FromActor != args[0] {
+			continue
+		}
+		if !view.can_see(oneExp.FromActor, oneExp.ToActor) {
+			continue
+		}
+
+		amount, err := strconv.ParseFloat(oneExp.Amount, 64)
+		if err != nil {
+			return nil, errors.New("Expenditure " + oneExp.ExpenditureId + " has a non-numeric amount")
+		}
+		expDate, err := time.Parse(dateFormat, oneExp.Date)
+		if err != nil {
+			return nil, errors.New("Expenditure " + oneExp.ExpenditureId + " has an invalid date")
+		}
+		ageDays := int(today.Sub(expDate).Hours() / 24)
+		if ageDays < 0 {
+			ageDays = 0
+		}
+		item := AgingItem{ExpenditureId: oneExp.ExpenditureId, Date: oneExp.Date, AgeDays: ageDays, Status: oneExp.Status, Amount: oneExp.Amount}
+
+		award, err := t.find_award(stub, oneExp.FromActor, oneExp.AwardId)
+		if err != nil {
+			return nil, err
+		}
+
+		g := 0
+		for g < len(report.Groups) && (report.Groups[g].GranteeId != oneExp.FromActor || report.Groups[g].FunderId != award.GrantorId) {
+			g++
+		}
+		if g == len(report.Groups) {
+			group := AgingGroup{GranteeId: oneExp.FromActor, FunderId: award.GrantorId}
+			for k := 0; k < len(agingBuckets); k++ {
+				group.Buckets = append(group.Buckets, AgingBucket{Bucket: agingBuckets[k]})
+			}
+			report.Groups = append(report.Groups, group)
+			groupSums = append(groupSums, make([]float64, len(agingBuckets)))
+		}
+
+		k := aging_bucket(ageDays)
+		report.Groups[g].Count++
+		add_to_bucket(&report.Groups[g].Buckets[k], &groupSums[g][k], item, amount)
+		add_to_bucket(&report.Buckets[k], &totalSums[k], item, amount)
+	}
+
+	for g := 0; g < len(report.Groups); g++ {
+		sum := 0.0
+		for k := 0; k < len(agingBuckets); k++ {
+			sum += groupSums[g][k]
+			report.Groups[g].Buckets[k].Amount = format_amount(groupSums[g][k])
+		}
+		report.Groups[g].Amount = format_amount(sum)
+	}
+	for k := 0; k < len(agingBuckets); k++ {
+		report.Buckets[k].Amount = format_amount(totalSums[k])
+	}
+
+	reportAsBytes, _ := json.Marshal(report)
+
+	return reportAsBytes, nil
+}
+
+// ============================================================================================================================
+// aging_bucket - the position in agingBuckets of an age in days
+// ============================================================================================================================
+func aging_bucket(ageDays int) int {
+	if ageDays <= 30 {
+		return 0
+	} else if ageDays <= 60 {
+		return 1
+	} else if ageDays <= 90 {
+		return 2
+	}
+	return 3
+}
+
+// ============================================================================================================================
+// add_to_bucket - count an expenditure in a bucket, keeping the oldest one seen
+// ============================================================================================================================
+func add_to_bucket(bucket *AgingBucket, sum *float64, item AgingItem, amount float64) {
+	bucket.Count++
+	*sum += amount
+	if bucket.Count == 1 || item.AgeDays > bucket.Oldest.AgeDays {
+		bucket.Oldest = item
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Threshold alerts - rules a grantor stores on an award, evaluated after every Spend on the award, every payment
+//					   of one of its expenses, by ReleaseFund, ApproveExpense or the last approval of a chain, every
+//					   reversal and by EscalateApprovals, so an expense that waits with nothing else happening on the
+//					   award still raises its SLA alert. An alert is raised once per crossing and recorded for the
+//					   grantor to acknowledge; it is cleared once its measure drops back, so a later crossing raises it
+//					   again. The alerts raised in a transaction are emitted together as one "alerts" chaincode event,
+//					   since a transaction carries a single event.
+//
+//	Rule types:	funds    - the expenses charged to the award reach each of the Thresholds, percentages of its amount
+//				category - the expenses of one type (Category) exceed the budget Limit of that type
+//				sla      - a pending expense has waited Days, the award's approval SLA if empty, for its approval
+//==============================================================================================================================
+
+type AlertRule struct {
+	Type       string   `json:"type"`
+	Thresholds []string `json:"thresholds"`
+	Category   string   `json:"category"`
+	Limit      string   `json:"limit"`
+	Days       string   `json:"days"`
+}
+
+// Key tells apart the alerts of a rule: the threshold crossed, the category overspent or the expenditure overdue.
+// ClearedDate is set when the measure dropped back below the rule
+type Alert struct {
+	AlertId          string `json:"alertid"`
+	AwardId          string `json:"awardid"`
+	RecipientId      string `json:"recipientid"`
+	Type             string `json:"type"`
+	Key              string `json:"key"`
+	Message          string `json:"message"`
+	Reference        string `json:"reference"`
+	TxId             string `json:"txid"`
+	Date             string `json:"date"`
+	Status           string `json:"status"`
+	AcknowledgedBy   string `json:"acknowledgedby"`
+	AcknowledgedDate string `json:"acknowledgeddate"`
+	ClearedDate      string `json:"cleareddate"`
+}
+
+var alertIndexStr = "_alertindex" // Define an index variable to track all the alerts stored in the world state
+
+// ============================================================================================================================
+// SetAlertRules Function - Called when the grantor chooses what it wants to be alerted about on an award
+// Function: update Award struct (alert rules), an empty array removes them
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) SetAlertRules(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//      0                 1
+	// "award id"  "alert rules json array"
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	award, err := t.get_award(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if !t.caller_has_role(stub, "admin") {
+		callerId, err := t.get_caller_actor(stub)
+		if err != nil {
+			return nil, err
+		}
+		if callerId != award.GrantorId {
+			return nil, errors.New("Only the grantor " + award.GrantorId + " can set the alert rules of " + award.AwardId)
+		}
+	}
+
+	var rules []AlertRule
+	err = json.Unmarshal([]byte(args[1]), &rules)
+	if err != nil {
+		return nil, errors.New("2nd argument must be a JSON array of alert rules")
+	}
+	for i := 0; i < len(rules); i++ {
+		err = check_alert_rule(rules[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	award.AlertRules = rules
+	err = t.put_award(stub, award)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// ============================================================================================================================
+// AcknowledgeAlert Function - Called when the grantor has seen an alert
+// Function: update Alert struct (status, acknowledged by and date)
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) AcknowledgeAlert(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//args[0] alert id
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	alertAsBytes, err := stub.GetState(args[0])
+	if err != nil {
+		return nil, errors.New("Failed to get alert")
+	}
+	alert := Alert{}
+	json.Unmarshal(alertAsBytes, &alert)
+	if alert.AlertId != args[0] {
+		return nil, errors.New("Alert " + args[0] + " does not exist")
+	}
+	if alert.Status != "Open" {
+		return nil, errors.New("Alert " + alert.AlertId + " is already " + alert.Status)
+	}
+
+	callerId, err := t.get_caller_actor(stub)
+	if err != nil {
+		return nil, err
+	}
+	if callerId != alert.RecipientId && !t.caller_has_role(stub, "admin") {
+		return nil, errors.New("Only " + alert.RecipientId + " can acknowledge alert " + alert.AlertId)
+	}
+
+	current_time, err := tx_time(stub)
+	if err != nil {
+		return nil, err
+	}
+	alert.Status = "Acknowledged"
+	alert.AcknowledgedBy = callerId
+	alert.AcknowledgedDate = current_time.Format(time.RFC3339)
+
+	alertAsBytes, _ = json.Marshal(alert)
+	err = stub.PutState(alert.AlertId, alertAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Query Function - Called when query alerts
+// Function: list the alerts addressed to an actor the caller sees, optionally of one award and with one status (Open or
+// Acknowledged)
+// Query
+// ============================================================================================================================
+func (t *SimpleChaincode) QueryAlerts(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//      0           1
+	// [award id]  [status]
+
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
+	alerts, err := t.get_alerts(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Alert
+	for i := 0; i < len(alerts); i++ {
+		if len(args) > 0 && len(args[0]) > 0 && alerts[i].AwardId != args[0] {
+			continue
+		}
+		if len(args) > 1 && len(args[1]) > 0 && alerts[i].Status != args[1] {
+			continue
+		}
+		if !view.can_see(alerts[i].RecipientId) {
+			continue
+		}
+		result = append(result, alerts[i])
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+
+	return resultAsBytes, nil
+}
+
+// ============================================================================================================================
+// check_alert_rule - reject an alert rule that could never be evaluated
+// ============================================================================================================================
+func check_alert_rule(rule AlertRule) error {
+	switch rule.Type {
+	case "funds":
+		if len(rule.Thresholds) <= 0 {
+			return errors.New("A funds alert rule needs at least one threshold")
+		}
+		for i := 0; i < len(rule.Thresholds); i++ {
+			percent, err := strconv.ParseFloat(rule.Thresholds[i], 64)
+			if err != nil || percent <= 0 {
+				return errors.New("Alert threshold " + rule.Thresholds[i] + " must be a positive percentage")
+			}
+		}
+	case "category":
+		if len(rule.Category) <= 0 {
+			return errors.New("A category alert rule needs the expense type it budgets")
+		}
+		limit, err := strconv.ParseFloat(rule.Limit, 64)
+		if err != nil || limit < 0 {
+			return errors.New("The limit of category " + rule.Category + " must be a non-negative amount")
+		}
+	case "sla":
+		if len(rule.Days) > 0 {
+			days, err := strconv.Atoi(rule.Days)
+			if err != nil || days <= 0 {
+				return errors.New("The days of an sla alert rule must be a positive whole number")
+			}
+		}
+	default:
+		return errors.New("Alert rule type must be funds, category or sla")
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// evaluate_alerts - raise the alerts of an award whose rules were crossed, clear those whose measure dropped back and
+// emit those raised in this transaction
+// ============================================================================================================================
+func (t *SimpleChaincode) evaluate_alerts(stub shim.ChaincodeStubInterface, awardId string, reference string) error {
+	if len(awardId) <= 0 {
+		return nil
+	}
+	award, err := t.get_award(stub, awardId)
+	if err != nil {
+		return err
+	}
+	if len(award.AlertRules) <= 0 {
+		return nil
+	}
+	amount, err := strconv.ParseFloat(award.Amount, 64)
+	if err != nil {
+		return errors.New("Award " + award.AwardId + " has a non-numeric amount")
+	}
+	current_time, err := tx_time(stub)
+	if err != nil {
+		return err
+	}
+
+	// what the award has spent, in total and per type, and what is waiting for approval
+	expsIndexAsBytes, err := stub.GetState(expIndexStr)
+	if err != nil {
+		return errors.New("Failed to get expenditure index")
+	}
+	var expIndex []string
+	json.Unmarshal(expsIndexAsBytes, &expIndex)
+	spent := 0.0
+	perType := map[string]float64{}
+	var pending []Expenditure
+	for i := 0; i < len(expIndex); i++ {
+		oneExp, err := t.get_expenditure(stub, expIndex[i])
+		if err != nil {
+			return err
+		}
+		if oneExp.AwardId != award.AwardId || oneExp.Status == "Disallowed" {
+			continue
+		}
+		expAmount, err := strconv.ParseFloat(oneExp.Amount, 64)
+		if err != nil {
+			return errors.New("Expenditure " + oneExp.ExpenditureId + " has a non-numeric amount")
+		}
+		spent += expAmount
+		perType[oneExp.Type] += expAmount
+		if oneExp.Status == "Pending" {
+			pending = append(pending, oneExp)
+		}
+	}
+
+	// the rules crossed now, in the order they are raised
+	var crossed []Alert
+	crossing := map[string]bool{}
+	raise := func(alertType string, key string, message string, ref string) {
+		crossing[alertType+"/"+key] = true
+		crossed = append(crossed, Alert{AwardId: award.AwardId, RecipientId: award.GrantorId, Type: alertType, Key: key, Message: message, Reference: ref})
+	}
+
+	for i := 0; i < len(award.AlertRules); i++ {
+		rule := award.AlertRules[i]
+		switch rule.Type {
+		case "funds":
+			for j := 0; j < len(rule.Thresholds); j++ {
+				percent, _ := strconv.ParseFloat(rule.Thresholds[j], 64)
+				if spent < amount*percent/100 {
+					continue
+				}
+				raise("funds", rule.Thresholds[j], "Award "+award.AwardId+" has spent "+format_amount(spent)+" of "+award.Amount+", crossing "+rule.Thresholds[j]+"% of its funds", reference)
+			}
+		case "category":
+			limit, _ := strconv.ParseFloat(rule.Limit, 64)
+			if perType[rule.Category] <= limit {
+				continue
+			}
+			raise("category", rule.Category, "Award "+award.AwardId+" has spent "+format_amount(perType[rule.Category])+" on "+rule.Category+", over its budget of "+rule.Limit, reference)
+		case "sla":
+			days, err := strconv.Atoi(rule.Days)
+			if err != nil {
+				days, err = strconv.Atoi(award.SlaDays)
+				if err != nil || days <= 0 {
+					continue
+				}
+			}
+			for j := 0; j < len(pending); j++ {
+				since, err := step_started(pending[j])
+				if err != nil {
+					return err
+				}
+				ageDays := int(current_time.Sub(since).Hours() / 24)
+				if ageDays < days {
+					continue
+				}
+				raise("sla", pending[j].ExpenditureId, "Expenditure "+pending[j].ExpenditureId+" has waited "+strconv.Itoa(ageDays)+" days for approval, over the SLA of "+strconv.Itoa(days), pending[j].ExpenditureId)
+			}
+		}
+	}
+
+	// an alert still raised for the same crossing is not raised again, one whose measure dropped back is cleared
+	alerts, err := t.get_alerts(stub)
+	if err != nil {
+		return err
+	}
+	raised := map[string]bool{}
+	for i := 0; i < len(alerts); i++ {
+		if alerts[i].AwardId != award.AwardId || len(alerts[i].ClearedDate) > 0 {
+			continue
+		}
+		if crossing[alerts[i].Type+"/"+alerts[i].Key] {
+			raised[alerts[i].Type+"/"+alerts[i].Key] = true
+			continue
+		}
+		alerts[i].ClearedDate = current_time.Format(time.RFC3339)
+		alertAsBytes, _ := json.Marshal(alerts[i])
+		err = stub.PutState(alerts[i].AlertId, alertAsBytes)
+		if err != nil {
+			return err
+		}
+	}
+	for i := 0; i < len(crossed); i++ {
+		if raised[crossed[i].Type+"/"+crossed[i].Key] {
+			continue
+		}
+		raised[crossed[i].Type+"/"+crossed[i].Key] = true
+		err = t.add_alert(stub, crossed[i], current_time)
+		if err != nil {
+			return err
+		}
+	}
+
+	return t.emit_alerts(stub)
+}
+
+// ============================================================================================================================
+// add_alert - record a new open alert and add it to the alert index
+// ============================================================================================================================
+func (t *SimpleChaincode) add_alert(stub shim.ChaincodeStubInterface, alert Alert, current_time time.Time) error {
+	alertsAsBytes, err := stub.GetState(alertIndexStr)
+	if err != nil {
+		return errors.New("Failed to get alert index")
+	}
+	var alertIndex []string
+	json.Unmarshal(alertsAsBytes, &alertIndex)
+
+	alert.AlertId = "ALR-" + strconv.Itoa(len(alertIndex)+1)
+	alert.TxId = stub.GetTxID()
+	alert.Date = current_time.Format(time.RFC3339)
+	alert.Status = "Open"
+
+	alertAsBytes, _ := json.Marshal(alert)
+	err = stub.PutState(alert.AlertId, alertAsBytes)
+	if err != nil {
+		return err
+	}
+
+	//append the index
+	alertIndex = append(alertIndex, alert.AlertId)
+	jsonAsBytes, _ := json.Marshal(alertIndex)
+	return stub.PutState(alertIndexStr, jsonAsBytes)
+}
+
+// ============================================================================================================================
+// emit_alerts - set the "alerts" event of the transaction to every alert it raised so far, on any award
+// ============================================================================================================================
+func (t *SimpleChaincode) emit_alerts(stub shim.ChaincodeStubInterface) error {
+	alerts, err := t.get_alerts(stub)
+	if err != nil {
+		return err
+	}
+	txId := stub.GetTxID()
+	var raised []Alert
+	for i := 0; i < len(alerts); i++ {
+		if alerts[i].TxId == txId {
+			raised = append(raised, alerts[i])
+		}
+	}
+	if len(raised) <= 0 {
+		return nil
+	}
+
+	raisedAsBytes, _ := json.Marshal(raised)
+	return stub.SetEvent("alerts", raisedAsBytes)
+}
+
+// ============================================================================================================================
+// get_alerts - read every alert in the order they were raised
+// ============================================================================================================================
+func (t *SimpleChaincode) get_alerts(stub shim.ChaincodeStubInterface) ([]Alert, error) {
+	alertsAsBytes, err := stub.GetState(alertIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get alert index")
+	}
+	var alertIndex []string
+	json.Unmarshal(alertsAsBytes, &alertIndex)
+
+	var alerts []Alert
+	for i := 0; i < len(alertIndex); i++ {
+		alertAsBytes, err := stub.GetState(alertIndex[i])
+		if err != nil {
+			return nil, errors.New("Failed to get alert")
+		}
+		alert := Alert{}
+		json.Unmarshal(alertAsBytes, &alert)
+		alerts = append(alerts, alert)
+	}
+
+	return alerts, nil
+}
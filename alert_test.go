@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiscardedBatchRaisesNoAlertEvent(t *testing.T) {
+	cc, m := setup(t)
+	m.attrs["actorid"] = "ACT-101"
+	must(t)(cc.Invoke(m, "setalertrules", []string{"AWD-401", `[{"type":"funds","thresholds":["50"]}]`}))
+
+	m.attrs["actorid"] = "ACT-102"
+	sheet := `[{"fromactor":"ACT-102","toactor":"ACT-104","amount":"70000","type":"Travel","options":{"awardid":"AWD-401"}},
+	{"fromactor":"ACT-102","toactor":"ACT-104","amount":"x","type":"Travel"}]`
+	m.events = nil
+	_, err := cc.Invoke(m, "spendbatch", []string{sheet, "all"})
+	fails(t, nil, err, "Line 2 of the expense sheet failed")
+	if len(m.events) != 0 {
+		t.Fatal(m.events)
+	}
+	if m.state["ALR-1"] != nil {
+		t.Fatal("discarded sheet raised an alert")
+	}
+
+	r := must(t)(cc.Invoke(m, "spendbatch", []string{sheet, "besteffort"}))
+	if !strings.Contains(r, `"applied":true`) || len(m.events) != 1 || !strings.Contains(m.events[0], `"key":"50"`) {
+		t.Fatal(r, m.events)
+	}
+}
+
+func TestApprovalsRaiseAlerts(t *testing.T) {
+	cc, m := setup(t)
+	m.attrs["actorid"] = "ACT-101"
+	must(t)(cc.Invoke(m, "putrule", []string{"R-TRV", "AWD-401", "Travel", "always", "", "pending", "Travel is reviewed"}))
+	must(t)(cc.Invoke(m, "setalertrules", []string{"AWD-401", `[{"type":"sla","days":"2"}]`}))
+	must(t)(cc.Invoke(m, "spend", []string{"ACT-102", "ACT-104", "100", "Travel", `{"awardid":"AWD-401"}`}))
+	must(t)(cc.Invoke(m, "spend", []string{"ACT-102", "ACT-104", "200", "Travel", `{"awardid":"AWD-401"}`}))
+
+	// releasing EXP-210 finds EXP-211 over its SLA
+	m.ts += 3 * 86400
+	m.events = nil
+	must(t)(cc.Invoke(m, "recordapproval", []string{"EXP-210", "approve"}))
+	if len(m.events) != 1 || !strings.Contains(m.events[0], `"key":"EXP-211"`) {
+		t.Fatal(m.events)
+	}
+
+	// approving EXP-211 in part finds EXP-212 over its SLA
+	must(t)(cc.Invoke(m, "spend", []string{"ACT-102", "ACT-104", "300", "Travel", `{"awardid":"AWD-401"}`}))
+	m.ts += 3 * 86400
+	m.events = nil
+	must(t)(cc.Invoke(m, "approveexpense", []string{"ACT-101", "EXP-211", "150", "50", "AUDIT"}))
+	if len(m.events) != 1 || !strings.Contains(m.events[0], `"key":"EXP-212"`) {
+		t.Fatal(m.events)
+	}
+}
+
+func TestOverdueApprovalAlertsWithoutFurtherSpend(t *testing.T) {
+	cc, m := setup(t)
+	m.attrs["actorid"] = "ACT-101"
+	must(t)(cc.Invoke(m, "putrule", []string{"R-TRV", "AWD-401", "Travel", "always", "", "pending", "Travel is reviewed"}))
+	must(t)(cc.Invoke(m, "setalertrules", []string{"AWD-401", `[{"type":"sla","days":"2"}]`}))
+	must(t)(cc.Invoke(m, "spend", []string{"ACT-102", "ACT-104", "100", "Travel", `{"awardid":"AWD-401"}`}))
+
+	m.ts += 3 * 86400
+	m.events = nil
+	must(t)(cc.Invoke(m, "escalateapprovals", nil))
+	if len(m.events) != 1 || !strings.Contains(m.events[0], `"key":"EXP-210"`) {
+		t.Fatal(m.events)
+	}
+	m.ts += 60
+	m.events = nil
+	must(t)(cc.Invoke(m, "escalateapprovals", nil))
+	if len(m.events) != 0 {
+		t.Fatal(m.events)
+	}
+}
+
+func TestAlertRaisedAgainAfterAReversal(t *testing.T) {
+	cc, m := setup(t)
+	m.attrs["role"] = "admin"
+	must(t)(cc.Invoke(m, "setalertrules", []string{"AWD-401", `[{"type":"funds","thresholds":["50"]}]`}))
+	must(t)(cc.Invoke(m, "spend", []string{"ACT-102", "ACT-104", "70000", "Travel", `{"awardid":"AWD-401"}`}))
+
+	// the reversal brings the award back under 50%, the next crossing is alerted again
+	must(t)(cc.Invoke(m, "reverseexpenditure", []string{"EXP-210", "REFUND"}))
+	alert := must(t)(cc.Query(m, "read", []string{"ALR-1"}))
+	if !strings.Contains(alert, `"cleareddate":"2017-07-14T02:40:00Z"`) {
+		t.Fatal(alert)
+	}
+	m.events = nil
+	must(t)(cc.Invoke(m, "spend", []string{"ACT-102", "ACT-104", "70000", "Travel", `{"awardid":"AWD-401"}`}))
+	if len(m.events) != 1 || !strings.Contains(m.events[0], `"alertid":"ALR-2"`) || !strings.Contains(m.events[0], `"key":"50"`) {
+		t.Fatal(m.events)
+	}
+}
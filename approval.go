@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Approval chains - an award can require several signers for expenses within an amount band, e.g. the grantee's PI
+//					  and then the grantor's program officer for anything above 10000. Spend copies the approvers of
+//					  the matching chain onto the expenditure and leaves it Pending; each approver then records a
+//					  decision in turn. The funds are released once the last approver has approved, and a rejection
+//					  disallows the expense.
+//==============================================================================================================================
+
+type ApprovalChain struct {
+	ChainId   string   `json:"chainid"`
+	AwardId   string   `json:"awardid"`
+	MinAmount string   `json:"minamount"`
+	MaxAmount string   `json:"maxamount"`
+	Approvers []string `json:"approvers"`
+}
+
+// one decision recorded against an expenditure (approver id, decision, transaction time, comment)
+// ApproverId signed for OnBehalfOf, the approver the step was waiting for, either through a delegation or because the
+// step had escalated to Level
+type Approval struct {
+	ApproverId   string `json:"approverid"`
+	Decision     string `json:"decision"`
+	Date         string `json:"date"`
+	Comment      string `json:"comment"`
+	OnBehalfOf   string `json:"onbehalfof"`
+	DelegationId string `json:"delegationid"`
+	Level        int    `json:"level"`
+}
+
+var chainIndexStr = "_chainindex" // Define an index variable to track all the approval chains stored in the world state
+var chainKeyPrefix = "CHAIN-"     // Prefix of the world state key of a chain, so a chain id cannot overwrite another record
+
+// ============================================================================================================================
+// PutApprovalChain Function - Called when the grantor sets who must sign expenses of an award within an amount band
+// Function: the chain applies to expenses above the min amount and up to the max amount, an empty max has no upper
+// bound, and the approvers sign in the order given
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) PutApprovalChain(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//      0           1            2             3              4             5 ...
+	// "chain id"  "award id"  "min amount"  "max amount"  "approver id"  "approver id" ...
+
+	if len(args) < 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting chain id, award id, min amount, max amount and at least 1 approver")
+	}
+	if len(args[0]) <= 0 {
+		return nil, errors.New("1st argument must be a non-empty string")
+	}
+
+	award, err := t.get_award(stub, args[1])
+	if err != nil {
+		return nil, err
+	}
+	if !t.caller_has_role(stub, "admin") {
+		callerId, err := t.get_caller_actor(stub)
+		if err != nil {
+			return nil, err
+		}
+		if callerId != award.GrantorId {
+			return nil, errors.New("Only the grantor " + award.GrantorId + " can set the approval chains of " + award.AwardId)
+		}
+	}
+
+	minAmount, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || minAmount < 0 {
+		return nil, errors.New("3rd argument must be a non-negative numeric string")
+	}
+	chain := ApprovalChain{}
+	chain.ChainId = args[0]
+	chain.AwardId = award.AwardId
+	chain.MinAmount = strconv.FormatFloat(minAmount, 'f', -1, 64)
+	if len(args[3]) > 0 {
+		maxAmount, err := strconv.ParseFloat(args[3], 64)
+		if err != nil || maxAmount <= minAmount {
+			return nil, errors.New("4th argument must be empty or a numeric string above the min amount")
+		}
+		chain.MaxAmount = strconv.FormatFloat(maxAmount, 'f', -1, 64)
+	}
+
+	for i := 4; i < len(args); i++ {
+		actorAsBytes, err := stub.GetState(args[i])
+		if err != nil {
+			return nil, errors.New("Failed to get approver")
+		}
+		actor := Actor{}
+		json.Unmarshal(actorAsBytes, &actor)
+		if actor.ActorId != args[i] {
+			return nil, errors.New("Approver " + args[i] + " does not exist")
+		}
+		for j := 0; j < len(chain.Approvers); j++ {
+			if chain.Approvers[j] == args[i] {
+				return nil, errors.New("Approver " + args[i] + " is listed twice")
+			}
+		}
+		chain.Approvers = append(chain.Approvers, args[i])
+	}
+
+	//a chain may be replaced, but not an unrelated record with the same key
+	chainAsBytes, err := stub.GetState(chainKeyPrefix + chain.ChainId)
+	if err != nil {
+		return nil, errors.New("Failed to get chain id")
+	}
+	existing := ApprovalChain{}
+	json.Unmarshal(chainAsBytes, &existing)
+	if len(chainAsBytes) > 0 && existing.ChainId != chain.ChainId {
+		return nil, errors.New(chain.ChainId + " is already used by another record")
+	}
+	if existing.ChainId == chain.ChainId && existing.AwardId != chain.AwardId {
+		return nil, errors.New("Chain " + chain.ChainId + " belongs to " + existing.AwardId)
+	}
+
+	chainAsBytes, _ = json.Marshal(chain)
+	err = stub.PutState(chainKeyPrefix+chain.ChainId, chainAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing.ChainId == chain.ChainId {
+		return nil, nil
+	}
+
+	//get the chain index
+	chainsAsBytes, err := stub.GetState(chainIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get approval chain index")
+	}
+	var chainIndex []string
+	json.Unmarshal(chainsAsBytes, &chainIndex)
+
+	//append the index
+	chainIndex = append(chainIndex, chain.ChainId)
+	jsonAsBytes, _ := json.Marshal(chainIndex)
+	err = stub.PutState(chainIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// ============================================================================================================================
+// RecordApproval Function - Called when an approver signs off or rejects a pending expenditure
+// Function: update Expenditure struct (approvals), and once the chain is complete release the funds or, on a rejection,
+// disallow the expense
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) RecordApproval(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//     0          1            2
+	// "exp id"  "decision"  [comment]
+
+	if len(args) != 2 && len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2 or 3")
+	}
+	decision := strings.ToLower(args[1])
+	if decision != "approve" && decision != "reject" {
+		return nil, errors.New("2nd argument must be approve or reject")
+	}
+	comment := ""
+	if len(args) == 3 {
+		comment = args[2]
+	}
+
+	oneExp, err := t.get_expenditure(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if oneExp.Status != "Pending" {
+		return nil, errors.New("Expenditure " + oneExp.ExpenditureId + " is not pending")
+	}
+	if len(oneExp.AwardId) <= 0 {
+		return nil, errors.New("Expenditure " + oneExp.ExpenditureId + " is not charged to an award")
+	}
+	err = t.check_award_open(stub, oneExp.AwardId)
+	if err != nil {
+		return nil, err
+	}
+
+	award, err := t.get_award(stub, oneExp.AwardId)
+	if err != nil {
+		return nil, err
+	}
+
+	// without a chain the grantor alone signs
+	if len(oneExp.Approvers) <= 0 {
+		oneExp.Approvers = []string{award.GrantorId}
+	}
+
+	callerId, err := t.get_caller_actor(stub)
+	if err != nil {
+		return nil, err
+	}
+	current_time, err := tx_time(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// the waiting approver, an escalation approver the step has reached, or a delegate of either may sign
+	approval, err := t.authorise_approval(stub, oneExp, award, callerId, current_time)
+	if err != nil {
+		return nil, err
+	}
+	approval.Decision = decision
+	approval.Date = current_time.Format(time.RFC3339)
+	approval.Comment = comment
+
+	oneExp.Approvals = append(oneExp.Approvals, approval)
+	err = t.put_expenditure(stub, oneExp)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(approval.DelegationId) > 0 {
+		err = t.log_delegation_use(stub, approval.DelegationId, oneExp.ExpenditureId, current_time)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if decision == "reject" {
+		remId, err := t.approve_expenditure(stub, award.GrantorId, oneExp, "0", oneExp.Amount, "REJECTED")
+		if err != nil {
+			return nil, err
+		}
+		return []byte(remId), nil
+	}
+
+	if len(oneExp.Approvals) == len(oneExp.Approvers) {
+		remId, err := t.approve_expenditure(stub, award.GrantorId, oneExp, oneExp.Amount, "0", "")
+		if err != nil {
+			return nil, err
+		}
+		err = t.evaluate_alerts(stub, oneExp.AwardId, remId)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(remId), nil
+	}
+
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Query Function - Called when query approval chains
+// Function: query all the approval chains of the awards the caller sees, optionally only those of one award
+// Query
+// ============================================================================================================================
+func (t *SimpleChaincode) QueryApprovalChains(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//args[0] = optional award id
+
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
+	chains, err := t.get_approval_chains(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []ApprovalChain
+	for i := 0; i < len(chains); i++ {
+		if len(args) > 0 && len(args[0]) > 0 && chains[i].AwardId != args[0] {
+			continue
+		}
+		award, err := t.get_award(stub, chains[i].AwardId)
+		if err != nil {
+			return nil, err
+		}
+		if !view.can_see(award.GrantorId, award.GranteeId) {
+			continue
+		}
+		result = append(result, chains[i])
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+
+	return resultAsBytes, nil
+}
+
+// ============================================================================================================================
+// find_approval_chain - the first chain of the award whose band contains the amount, empty if there is none
+// ============================================================================================================================
+func (t *SimpleChaincode) find_approval_chain(stub shim.ChaincodeStubInterface, awardId string, amount float64) (ApprovalChain, error) {
+	if len(awardId) <= 0 {
+		return ApprovalChain{}, nil
+	}
+
+	chains, err := t.get_approval_chains(stub)
+	if err != nil {
+		return ApprovalChain{}, err
+	}
+	for i := 0; i < len(chains); i++ {
+		if chains[i].AwardId != awardId {
+			continue
+		}
+		minAmount, err := strconv.ParseFloat(chains[i].MinAmount, 64)
+		if err != nil || amount <= minAmount {
+			continue
+		}
+		if len(chains[i].MaxAmount) > 0 {
+			maxAmount, err := strconv.ParseFloat(chains[i].MaxAmount, 64)
+			if err != nil || amount > maxAmount {
+				continue
+			}
+		}
+		return chains[i], nil
+	}
+
+	return ApprovalChain{}, nil
+}
+
+// ============================================================================================================================
+// get_approval_chains - read every approval chain in the order they were added
+// ============================================================================================================================
+func (t *SimpleChaincode) get_approval_chains(stub shim.ChaincodeStubInterface) ([]ApprovalChain, error) {
+	chainsAsBytes, err := stub.GetState(chainIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get approval chain index")
+	}
+	var chainIndex []string
+	json.Unmarshal(chainsAsBytes, &chainIndex)
+
+	var chains []ApprovalChain
+	for i := 0; i < len(chainIndex); i++ {
+		chainAsBytes, err := stub.GetState(chainKeyPrefix + chainIndex[i])
+		if err != nil {
+			return nil, errors.New("Failed to get approval chain")
+		}
+		chain := ApprovalChain{}
+		json.Unmarshal(chainAsBytes, &chain)
+		chains = append(chains, chain)
+	}
+
+	return chains, nil
+}
+
+// ============================================================================================================================
+// authorise_release - check that the caller may pay or disallow an expenditure for the funder named: the funder must be
+// the one paying the expense's award, and the caller must be bound to it, be the last approver of the expense's chain
+// or be an admin
+// ============================================================================================================================
+func (t *SimpleChaincode) authorise_release(stub shim.ChaincodeStubInterface, funderId string, oneExp Expenditure) error {
+	award := Award{}
+	if len(oneExp.AwardId) > 0 {
+		var err error
+		award, err = t.get_award(stub, oneExp.AwardId)
+		if err != nil {
+			return err
+		}
+	}
+	funder := award_funder(award)
+	if funderId != funder {
+		return errors.New("Expenditure " + oneExp.ExpenditureId + " is funded by " + funder + ", not " + funderId)
+	}
+	if t.caller_has_role(stub, "admin") {
+		return nil
+	}
+
+	callerId, err := t.get_caller_actor(stub)
+	if err != nil {
+		return err
+	}
+	if callerId == funder || (len(oneExp.Approvers) > 0 && callerId == oneExp.Approvers[len(oneExp.Approvers)-1]) {
+		return nil
+	}
+	return errors.New("Only the funder " + funder + " or the last approver can release or disallow " + oneExp.ExpenditureId)
+}
+
+// ============================================================================================================================
+// award_funder - who pays the expenses of an award: its grantor, expenses outside any award fall back to the demo grantor
+// ============================================================================================================================
+func award_funder(award Award) string {
+	if len(award.AwardId) > 0 {
+		return award.GrantorId
+	}
+	return "ACT-101"
+}
+
+// ============================================================================================================================
+// approval_rejected - whether a signer of the expenditure's approval chain rejected it, which ends the chain early
+// ============================================================================================================================
+func approval_rejected(oneExp Expenditure) bool {
+	return len(oneExp.Approvals) > 0 && oneExp.Approvals[len(oneExp.Approvals)-1].Decision == "reject"
+}
+
+// ============================================================================================================================
+// approvals_outstanding - whether an expenditure still waits for signers of its approval chain
+// ============================================================================================================================
+func approvals_outstanding(oneExp Expenditure) bool {
+	return len(oneExp.Approvals) < len(oneExp.Approvers)
+}
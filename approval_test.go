@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChainIdCannotOverwriteAnotherRecord(t *testing.T) {
+	cc, m := setup(t)
+	m.attrs["actorid"] = "ACT-101"
+
+	// a chain named like an award is kept apart from the award
+	must(t)(cc.Invoke(m, "putapprovalchain", []string{"AWD-402", "AWD-401", "1000", "", "ACT-102", "ACT-101"}))
+	award := must(t)(cc.Query(m, "read", []string{"AWD-402"}))
+	if !strings.Contains(award, `"awardid":"AWD-402"`) || strings.Contains(award, `"chainid"`) {
+		t.Fatal(award)
+	}
+	must(t)(cc.Invoke(m, "spend", []string{"ACT-102", "ACT-104", "2000", "Travel"}))
+	exp := must(t)(cc.Query(m, "read", []string{"EXP-210"}))
+	if !strings.Contains(exp, `"approvers":["ACT-102","ACT-101"]`) {
+		t.Fatal(exp)
+	}
+}
+
+func TestNoApprovalOutstanding(t *testing.T) {
+	cc, m := setup(t)
+	m.attrs["actorid"] = "ACT-101"
+
+	// a pending expense whose every approver has signed waits for no one
+	must(t)(cc.Invoke(m, "setapprovalsla", []string{"AWD-401", "5", "ACT-103"}))
+	must(t)(cc.Invoke(m, "spend", []string{"ACT-102", "ACT-104", "2000", "Travel"}))
+	oneExp, err := cc.get_expenditure(m, "EXP-210")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oneExp.Status = "Pending"
+	oneExp.Submitted = "2017-01-01T00:00:00Z"
+	oneExp.Approvers = []string{"ACT-101"}
+	oneExp.Approvals = []Approval{{ApproverId: "ACT-101", Decision: "approve", Date: "2017-01-02T00:00:00Z"}}
+	err = cc.put_expenditure(m, oneExp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cc.Invoke(m, "recordapproval", []string{"EXP-210", "approve"})
+	fails(t, nil, err, "waits for no further approval")
+	overdue := must(t)(cc.Query(m, "queryoverdueapprovals", nil))
+	if !strings.Contains(overdue, `{"approverid":"ACT-101","overdue":[{"expenditureid":"EXP-210"`) {
+		t.Fatal(overdue)
+	}
+}
+
+func TestReleaseNeedsTheFunderAndTheChain(t *testing.T) {
+	cc, m := setup(t)
+
+	m.attrs["actorid"] = "ACT-103"
+	_, err := cc.Invoke(m, "releasefund", []string{"ACT-101", "EXP-202"})
+	fails(t, nil, err, "Only the funder ACT-101 or the last approver")
+	m.attrs["actorid"] = "ACT-101"
+	_, err = cc.Invoke(m, "releasefund", []string{"ACT-102", "EXP-202"})
+	fails(t, nil, err, "is funded by ACT-101, not ACT-102")
+
+	// disallowing the whole expense skips no signer either, but a signer's rejection closes it
+	must(t)(cc.Invoke(m, "putapprovalchain", []string{"CH-1", "AWD-401", "1000", "", "ACT-102", "ACT-101"}))
+	must(t)(cc.Invoke(m, "spend", []string{"ACT-102", "ACT-104", "2000", "Travel"}))
+	_, err = cc.Invoke(m, "approveexpense", []string{"ACT-101", "EXP-210", "0", "2000", "AUDIT"})
+	fails(t, nil, err, "still needs the approval of ACT-102")
+	m.attrs["actorid"] = "ACT-102"
+	must(t)(cc.Invoke(m, "recordapproval", []string{"EXP-210", "reject"}))
+	exp := must(t)(cc.Query(m, "read", []string{"EXP-210"}))
+	if !strings.Contains(exp, `"status":"Disallowed"`) {
+		t.Fatal(exp)
+	}
+}
+
+func TestApprovalStepStartsAtTheSignature(t *testing.T) {
+	cc, m := setup(t)
+	m.attrs["actorid"] = "ACT-101"
+	must(t)(cc.Invoke(m, "setapprovalsla", []string{"AWD-401", "1", "ACT-103"}))
+	must(t)(cc.Invoke(m, "putapprovalchain", []string{"CH-1", "AWD-401", "1000", "", "ACT-102", "ACT-101"}))
+	must(t)(cc.Invoke(m, "spend", []string{"ACT-102", "ACT-104", "2000", "Travel"}))
+
+	// signed in the afternoon, the next step is not a day old the following morning
+	m.ts += 36 * 3600
+	m.attrs["actorid"] = "ACT-102"
+	must(t)(cc.Invoke(m, "recordapproval", []string{"EXP-210", "approve"}))
+	exp := must(t)(cc.Query(m, "read", []string{"EXP-210"}))
+	if !strings.Contains(exp, `"date":"2017-07-15T14:40:00Z"`) {
+		t.Fatal(exp)
+	}
+	m.ts += 15 * 3600
+	m.attrs["actorid"] = "ACT-101"
+	overdue := must(t)(cc.Query(m, "queryoverdueapprovals", nil))
+	if strings.Contains(overdue, `"EXP-210"`) {
+		t.Fatal(overdue)
+	}
+}
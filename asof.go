@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Point-in-time balances - the wallets of the actors rebuilt from the journal entries posted up to a moment, e.g.
+//							 the last day of a fiscal year. Every entry is dated with the timestamp of the
+//							 transaction that posted it.
+//==============================================================================================================================
+
+// a journal entry counted in a point-in-time balance (entry id, date, function, reference, transaction id)
+type IncludedEntry struct {
+	EntryId   string `json:"entryid"`
+	Date      string `json:"date"`
+	Function  string `json:"function"`
+	Reference string `json:"reference"`
+	TxId      string `json:"txid"`
+}
+
+type WalletAsOf struct {
+	AsOf    string          `json:"asof"`
+	Wallets []Actor         `json:"wallets"`
+	Entries []IncludedEntry `json:"entries"`
+}
+
+// ============================================================================================================================
+// Query Function - Called when query the wallets as they were at a moment
+// Function: replay the journal up to the moment for one actor or, with an empty actor id, every actor the caller sees,
+// and list the entries that were included. A date alone means the end of that day (UTC).
+// Query
+// ============================================================================================================================
+func (t *SimpleChaincode) QueryWalletAsOf(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//      0                  1
+	// "actor id|"  "RFC 3339 timestamp|date"
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+	asOf, err := time.Parse(time.RFC3339Nano, args[1])
+	if err != nil {
+		day, err := time.Parse(dateFormat, args[1])
+		if err != nil {
+			return nil, errors.New("2nd argument must be an RFC 3339 timestamp or a date formatted as " + dateFormat)
+		}
+		asOf = day.Add(24*time.Hour - time.Nanosecond)
+	}
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	actorIndexAsBytes, err := stub.GetState(accountIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get actor index")
+	}
+	var actorIndex []string
+	json.Unmarshal(actorIndexAsBytes, &actorIndex)
+
+	// every wallet starts empty and is filled by replaying the journal
+	result := WalletAsOf{AsOf: asOf.Format(time.RFC3339Nano)}
+	position := map[string]int{}
+	for i := 0; i < len(actorIndex); i++ {
+		if (len(args[0]) > 0 && actorIndex[i] != args[0]) || !view.can_see(actorIndex[i]) {
+			continue
+		}
+		actorAsBytes, err := stub.GetState(actorIndex[i])
+		if err != nil {
+			return nil, errors.New("Failed to get actor " + actorIndex[i])
+		}
+		actor := Actor{}
+		json.Unmarshal(actorAsBytes, &actor)
+		position[actor.ActorId] = len(result.Wallets)
+		result.Wallets = append(result.Wallets, Actor{ActorId: actor.ActorId, ActorName: actor.ActorName, Committed: "0", Reimbursed: "0", Awarded: "0", Spent: "0", Received: "0", Delegated: "0"})
+	}
+	if len(args[0]) > 0 && len(result.Wallets) <= 0 {
+		return nil, errors.New("Actor " + args[0] + " does not exist")
+	}
+
+	entries, err := t.get_journal(stub)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(entries); i++ {
+		posted, err := journal_time(entries[i])
+		if err != nil {
+			return nil, err
+		}
+		if posted.After(asOf) {
+			continue
+		}
+
+		included := false
+		for j := 0; j < len(entries[i].Lines); j++ {
+			line := entries[i].Lines[j]
+			k, ok := position[line.ActorId]
+			if !ok || line.Account == openingAccount {
+				continue
+			}
+			_, err := apply_journal_line(&result.Wallets[k], line)
+			if err != nil {
+				return nil, err
+			}
+			included = true
+		}
+		if included {
+			result.Entries = append(result.Entries, IncludedEntry{EntryId: entries[i].EntryId, Date: entries[i].Date, Function: entries[i].Function, Reference: entries[i].Reference, TxId: entries[i].TxId})
+		}
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+
+	return resultAsBytes, nil
+}
+
+// ============================================================================================================================
+// apply_journal_line - add the effect of a journal line to the wallet of its actor and return the change
+// ============================================================================================================================
+func apply_journal_line(wallet *Actor, line JournalLine) (float64, error) {
+	counter, err := actor_counter(wallet, line.Account)
+	if err != nil {
+		return 0, err
+	}
+	balance, _ := strconv.ParseFloat(*counter, 64)
+	change, err := line_balance(line)
+	if err != nil {
+		return 0, err
+	}
+	*counter = strconv.FormatFloat(balance+change, 'f', -1, 64)
+	return change, nil
+}
+
+// ============================================================================================================================
+// journal_time - when a journal entry was posted, the transaction timestamp it was dated with
+// ============================================================================================================================
+func journal_time(entry JournalEntry) (time.Time, error) {
+	posted, err := time.Parse(time.RFC3339Nano, entry.Date)
+	if err != nil {
+		return time.Time{}, errors.New("Journal entry " + entry.EntryId + " has an unreadable date " + entry.Date)
+	}
+	return posted, nil
+}
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Award - a grant from a grantor to a grantee, in a single currency. A sub-award names its parent award and is
+//			granted by the grantee of that parent out of what was awarded to it, no more than the parent has
+//			left after its other sub-awards and the expenses charged to it.
+//			Expenses must be dated within the award period and submitted no later than LiquidationDays after its end.
+//			An award is Active until the grantee submits its final report, Closing until the grantor closes it, and
+//			Closed afterwards, when its unspent balance has been returned and its records are locked.
+//			SlaDays and EscalationPath set how long an approval step may wait and who it escalates to, see delegation.go.
+//==============================================================================================================================
+
+type Award struct {
+	AwardId         string      `json:"awardid"`
+	GrantorId       string      `json:"grantorid"`
+	GranteeId       string      `json:"granteeid"`
+	Amount          string      `json:"amount"`
+	Currency        string      `json:"currency"`
+	ParentAwardId   string      `json:"parentawardid"`
+	StartDate       string      `json:"startdate"`
+	EndDate         string      `json:"enddate"`
+	LiquidationDays string      `json:"liquidationdays"`
+	Status          string      `json:"status"`
+	FinalReport     string      `json:"finalreport"`
+	FinalReportDate string      `json:"finalreportdate"`
+	ClosedDate      string      `json:"closeddate"`
+	ReturnedAmount  string      `json:"returnedamount"`
+	SlaDays         string      `json:"sladays"`
+	EscalationPath  []string    `json:"escalationpath"`
+	AlertRules      []AlertRule `json:"alertrules"`
+}
+
+var awardIndexStr = "_awardindex" // Define an index variable to track all the awards stored in the world state
+
+// ============================================================================================================================
+// CreateAward Function - Called when a grantor awards a grant or a grantee delegates part of its award to a sub-grantee
+// Function: create a new Award struct, update Actor struct (Committed/Delegated of the grantor, Awarded of the grantee)
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) CreateAward(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//      0            1              2            3          4                5                6            7               8
+	// "award id"  "grantor id"   "grantee id"   "amount"  "currency"  [parent award id  [start date  end date  liquidation days]]
+
+	if len(args) != 5 && len(args) != 6 && len(args) != 9 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 5, 6 or 9")
+	}
+	for i := 0; i < 5; i++ {
+		if len(args[i]) <= 0 {
+			return nil, errors.New("Argument " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	amount, err := strconv.ParseFloat(args[3], 64)
+	if err != nil || amount <= 0 {
+		return nil, errors.New("4th argument must be a positive numeric string")
+	}
+	if !valid_currency(args[4]) {
+		return nil, errors.New("5th argument must be a 3 letter currency code")
+	}
+
+	//check if award already exists
+	awardAsBytes, err := stub.GetState(args[0])
+	if err != nil {
+		return nil, errors.New("Failed to get award id")
+	}
+	award := Award{}
+	json.Unmarshal(awardAsBytes, &award)
+	if award.AwardId == args[0] {
+		return nil, errors.New("This award arleady exists")
+	}
+
+	award.AwardId = args[0]
+	award.GrantorId = args[1]
+	award.GranteeId = args[2]
+	award.Amount = strconv.FormatFloat(amount, 'f', -1, 64)
+	award.Currency = args[4]
+	award.Status = "Active"
+
+	if len(args) == 9 {
+		start, err := time.Parse(dateFormat, args[6])
+		if err != nil {
+			return nil, errors.New("7th argument must be a date formatted " + dateFormat)
+		}
+		end, err := time.Parse(dateFormat, args[7])
+		if err != nil {
+			return nil, errors.New("8th argument must be a date formatted " + dateFormat)
+		}
+		if end.Before(start) {
+			return nil, errors.New("An award cannot end before it starts")
+		}
+		liquidationDays, err := strconv.Atoi(args[8])
+		if err != nil || liquidationDays < 0 {
+			return nil, errors.New("9th argument must be a non-negative number of days")
+		}
+		award.StartDate = args[6]
+		award.EndDate = args[7]
+		award.LiquidationDays = strconv.Itoa(liquidationDays)
+	}
+
+	function := "award"
+	if len(args) >= 6 && len(args[5]) > 0 {
+		parent, err := t.get_award(stub, args[5])
+		if err != nil {
+			return nil, err
+		}
+		if parent.GranteeId != award.GrantorId {
+			return nil, errors.New(award.GrantorId + " is not the grantee of " + parent.AwardId)
+		}
+		if parent.Currency != award.Currency {
+			return nil, errors.New("A sub-award must be in the currency of its parent award, " + parent.Currency)
+		}
+		if award_status(parent) != "Active" {
+			return nil, errors.New("Award " + parent.AwardId + " is " + award_status(parent))
+		}
+		// a sub-award cannot outlive its parent
+		if len(parent.StartDate) > 0 && (len(award.StartDate) <= 0 || award.StartDate < parent.StartDate || award.EndDate > parent.EndDate) {
+			return nil, errors.New("A sub-award must fall within the period of its parent award, " + parent.StartDate + " to " + parent.EndDate)
+		}
+		// nor pass on more than the parent has left
+		remaining, err := t.award_remaining(stub, parent)
+		if err != nil {
+			return nil, err
+		}
+		if amount > remaining+0.000001 {
+			return nil, errors.New("A sub-award cannot exceed the " + format_amount(remaining) + " left on its parent award " + parent.AwardId)
+		}
+		award.ParentAwardId = parent.AwardId
+		function = "delegate"
+	}
+
+	err = t.put_award(stub, award)
+	if err != nil {
+		return nil, err
+	}
+
+	//get the award index
+	awardsAsBytes, err := stub.GetState(awardIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get award index")
+	}
+	var awardIndex []string
+	json.Unmarshal(awardsAsBytes, &awardIndex)
+
+	//append the index
+	awardIndex = append(awardIndex, award.AwardId)
+	jsonAsBytes, _ := json.Marshal(awardIndex)
+	err = stub.PutState(awardIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = t.Transfer_balance(stub, []string{award.GrantorId, award.GranteeId, award.Amount, function, award.AwardId})
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// ============================================================================================================================
+// SubmitFinalReport Function - Called when the grantee has finished the work and submits its final report
+// Function: update Award struct (status Closing, final report), after which no more expenses can be charged to it
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) SubmitFinalReport(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//      0                1
+	// "award id"   "final report reference"
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+	if len(args[1]) <= 0 {
+		return nil, errors.New("2nd argument must be a non-empty string")
+	}
+
+	award, err := t.get_award(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	callerId, err := t.get_caller_actor(stub)
+	if err != nil {
+		return nil, err
+	}
+	if callerId != award.GranteeId {
+		return nil, errors.New("Only the grantee " + award.GranteeId + " can submit the final report of " + award.AwardId)
+	}
+	if award_status(award) != "Active" {
+		return nil, errors.New("Award " + award.AwardId + " is " + award_status(award))
+	}
+
+	current_time, err := tx_time(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	award.Status = "Closing"
+	award.FinalReport = args[1]
+	award.FinalReportDate = current_time.Format(dateFormat)
+	err = t.put_award(stub, award)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// ============================================================================================================================
+// CloseAward Function - Called when the grantor closes out an award after the final report
+// Function: close every open sub-award, return the unspent balance of each to its grantor, update Award struct (status
+// Closed), after which nothing charged to the award can be written
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) CloseAward(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//      0
+	// "award id"
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	award, err := t.get_award(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	callerId, err := t.get_caller_actor(stub)
+	if err != nil {
+		return nil, err
+	}
+	if callerId != award.GrantorId {
+		return nil, errors.New("Only the grantor " + award.GrantorId + " can close " + award.AwardId)
+	}
+	if award_status(award) != "Closing" {
+		return nil, errors.New("Award " + award.AwardId + " is " + award_status(award) + ", the final report must be submitted first")
+	}
+
+	err = t.close_award(stub, award)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// ============================================================================================================================
+// close_award - close the sub-awards first, then refuse if an expense is still undecided, and return what was neither
+// spent nor delegated
+// ============================================================================================================================
+func (t *SimpleChaincode) close_award(stub shim.ChaincodeStubInterface, award Award) error {
+	awards, err := t.get_awards(stub)
+	if err != nil {
+		return err
+	}
+
+	amount, err := strconv.ParseFloat(award.Amount, 64)
+	if err != nil {
+		return errors.New("Award " + award.AwardId + " has a non-numeric amount")
+	}
+	used := 0.0
+	for i := 0; i < len(awards); i++ {
+		if awards[i].ParentAwardId != award.AwardId {
+			continue
+		}
+		subAward := awards[i]
+		if award_status(subAward) != "Closed" {
+			err = t.close_award(stub, subAward)
+			if err != nil {
+				return err
+			}
+			subAward, err = t.get_award(stub, subAward.AwardId)
+			if err != nil {
+				return err
+			}
+		}
+		subAmount, err := strconv.ParseFloat(subAward.Amount, 64)
+		if err != nil {
+			return errors.New("Award " + subAward.AwardId + " has a non-numeric amount")
+		}
+		returned, err := strconv.ParseFloat(subAward.ReturnedAmount, 64)
+		if err != nil {
+			returned = 0
+		}
+		used += subAmount - returned
+	}
+
+	expsIndexAsBytes, err := stub.GetState(expIndexStr)
+	if err != nil {
+		return errors.New("Failed to get expenditure index")
+	}
+	var expIndex []string
+	json.Unmarshal(expsIndexAsBytes, &expIndex)
+
+	for i := 0; i < len(expIndex); i++ {
+		oneExp, err := t.get_expenditure(stub, expIndex[i])
+		if err != nil {
+			return err
+		}
+		if oneExp.AwardId != award.AwardId {
+			continue
+		}
+		if oneExp.Status == "Pending" {
+			return errors.New("Expenditure " + oneExp.ExpenditureId + " of " + award.AwardId + " is still pending")
+		}
+		expAmount, err := strconv.ParseFloat(oneExp.Amount, 64)
+		if err != nil {
+			return errors.New("Expenditure " + oneExp.ExpenditureId + " has a non-numeric amount")
+		}
+		used += expAmount
+	}
+
+	unspent := amount - used
+	if unspent < 0 {
+		unspent = 0
+	}
+	unspentStr := strconv.FormatFloat(unspent, 'f', -1, 64)
+
+	if unspent > 0 {
+		function := "returnaward"
+		if len(award.ParentAwardId) > 0 {
+			function = "returndelegate"
+		}
+		_, err = t.Transfer_balance(stub, []string{award.GrantorId, award.GranteeId, unspentStr, function, award.AwardId})
+		if err != nil {
+			return err
+		}
+	}
+
+	current_time, err := tx_time(stub)
+	if err != nil {
+		return err
+	}
+
+	award.Status = "Closed"
+	award.ClosedDate = current_time.Format(dateFormat)
+	award.ReturnedAmount = unspentStr
+	return t.put_award(stub, award)
+}
+
+// ============================================================================================================================
+// award_remaining - the amount of an award neither passed on in sub-awards, less what they returned, nor charged by
+// expenditures; a reversal is charged with the negated amount, so a reversed expense costs nothing
+// ============================================================================================================================
+func (t *SimpleChaincode) award_remaining(stub shim.ChaincodeStubInterface, award Award) (float64, error) {
+	remaining, err := strconv.ParseFloat(award.Amount, 64)
+	if err != nil {
+		return 0, errors.New("Award " + award.AwardId + " has a non-numeric amount")
+	}
+
+	awards, err := t.get_awards(stub)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < len(awards); i++ {
+		if awards[i].ParentAwardId != award.AwardId {
+			continue
+		}
+		subAmount, err := strconv.ParseFloat(awards[i].Amount, 64)
+		if err != nil {
+			return 0, errors.New("Award " + awards[i].AwardId + " has a non-numeric amount")
+		}
+		returned, err := strconv.ParseFloat(awards[i].ReturnedAmount, 64)
+		if err != nil {
+			returned = 0
+		}
+		remaining -= subAmount - returned
+	}
+
+	expenses, err := t.get_expenditures(stub)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < len(expenses); i++ {
+		if expenses[i].AwardId != award.AwardId {
+			continue
+		}
+		expAmount, err := strconv.ParseFloat(expenses[i].Amount, 64)
+		if err != nil {
+			return 0, errors.New("Expenditure " + expenses[i].ExpenditureId + " has a non-numeric amount")
+		}
+		remaining -= expAmount
+	}
+
+	return remaining, nil
+}
+
+// ============================================================================================================================
+// Query Function - Called when query awards
+// Function: query all the awards the caller sees, optionally only those granted to or by one actor
+// Query
+// ============================================================================================================================
+func (t *SimpleChaincode) QueryAwards(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//args[0] = optional actor id
+
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
+	awards, err := t.get_awards(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Award
+	for i := 0; i < len(awards); i++ {
+		if len(args) > 0 && len(args[0]) > 0 && awards[i].GrantorId != args[0] && awards[i].GranteeId != args[0] {
+			continue
+		}
+		if !view.can_see(awards[i].GrantorId, awards[i].GranteeId) {
+			continue
+		}
+		result = append(result, awards[i])
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+
+	return resultAsBytes, nil
+}
+
+// ============================================================================================================================
+// get_award - read one award from the world state, failing if it was never created
+// ============================================================================================================================
+func (t *SimpleChaincode) get_award(stub shim.ChaincodeStubInterface, awardId string) (Award, error) {
+	award := Award{}
+	awardAsBytes, err := stub.GetState(awardId)
+	if err != nil {
+		return award, errors.New("Failed to get award")
+	}
+	json.Unmarshal(awardAsBytes, &award)
+	if award.AwardId != awardId {
+		return award, errors.New("Award " + awardId + " does not exist")
+	}
+	return award, nil
+}
+
+// ============================================================================================================================
+// put_award - store an award that has already been added to the award index
+// ============================================================================================================================
+func (t *SimpleChaincode) put_award(stub shim.ChaincodeStubInterface, award Award) error {
+	awardAsBytes, _ := json.Marshal(award)
+	return stub.PutState(award.AwardId, awardAsBytes)
+}
+
+// ============================================================================================================================
+// get_awards - read every award in the order they were created
+// ============================================================================================================================
+func (t *SimpleChaincode) get_awards(stub shim.ChaincodeStubInterface) ([]Award, error) {
+	awardsAsBytes, err := stub.GetState(awardIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get award index")
+	}
+	var awardIndex []string
+	json.Unmarshal(awardsAsBytes, &awardIndex)
+
+	var awards []Award
+	for i := 0; i < len(awardIndex); i++ {
+		award, err := t.get_award(stub, awardIndex[i])
+		if err != nil {
+			return nil, err
+		}
+		awards = append(awards, award)
+	}
+
+	return awards, nil
+}
+
+// ============================================================================================================================
+// find_award - the award an expense of the grantee is charged to: the named award, or else the first award granted to
+// the grantee. A grantee without any award gets an empty Award and no error.
+// ============================================================================================================================
+func (t *SimpleChaincode) find_award(stub shim.ChaincodeStubInterface, granteeId string, awardId string) (Award, error) {
+	if len(awardId) > 0 {
+		award, err := t.get_award(stub, awardId)
+		if err != nil {
+			return award, err
+		}
+		if award.GranteeId != granteeId {
+			return Award{}, errors.New(granteeId + " is not the grantee of " + awardId)
+		}
+		return award, nil
+	}
+
+	awards, err := t.get_awards(stub)
+	if err != nil {
+		return Award{}, err
+	}
+	for i := 0; i < len(awards); i++ {
+		if awards[i].GranteeId == granteeId {
+			return awards[i], nil
+		}
+	}
+
+	return Award{}, nil
+}
+
+// ============================================================================================================================
+// award_status - the status of an award, awards created before close-out existed are Active
+// ============================================================================================================================
+func award_status(award Award) string {
+	if len(award.Status) <= 0 {
+		return "Active"
+	}
+	return award.Status
+}
+
+// ============================================================================================================================
+// check_award_period - refuse an expense dated outside the award period, or submitted after the liquidation window
+// ============================================================================================================================
+func check_award_period(award Award, expDate string, submitted time.Time) error {
+	if len(award.StartDate) <= 0 {
+		return nil
+	}
+	if expDate < award.StartDate || expDate > award.EndDate {
+		return errors.New("Expenditure date " + expDate + " is outside the period of " + award.AwardId + ", " + award.StartDate + " to " + award.EndDate)
+	}
+
+	end, err := time.Parse(dateFormat, award.EndDate)
+	if err != nil {
+		return errors.New("Award " + award.AwardId + " has an invalid end date")
+	}
+	liquidationDays, err := strconv.Atoi(award.LiquidationDays)
+	if err != nil {
+		liquidationDays = 0
+	}
+	// the window runs to the end of its last day
+	if !submitted.Before(end.AddDate(0, 0, liquidationDays+1)) {
+		return errors.New("The liquidation window of " + award.AwardId + " closed " + strconv.Itoa(liquidationDays) + " days after " + award.EndDate)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// check_award_open - refuse to write anything charged to a closed award
+// ============================================================================================================================
+func (t *SimpleChaincode) check_award_open(stub shim.ChaincodeStubInterface, awardId string) error {
+	if len(awardId) <= 0 {
+		return nil
+	}
+	award, err := t.get_award(stub, awardId)
+	if err != nil {
+		return err
+	}
+	if award_status(award) == "Closed" {
+		return errors.New("Award " + awardId + " is closed and its records are locked")
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// check_record_open - refuse to overwrite or delete a record that belongs to a closed award
+// ============================================================================================================================
+func (t *SimpleChaincode) check_record_open(stub shim.ChaincodeStubInterface, key string) error {
+	recordAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return errors.New("Failed to get state for " + key)
+	}
+
+	type awardRecord struct {
+		AwardId       string `json:"awardid"`
+		ExpenditureId string `json:"expenditureid"`
+	}
+	record := awardRecord{}
+	json.Unmarshal(recordAsBytes, &record)
+
+	// a reimbursement belongs to the award of the expense it paid
+	if len(record.AwardId) <= 0 && len(record.ExpenditureId) > 0 && record.ExpenditureId != key {
+		oneExp, err := t.get_expenditure(stub, record.ExpenditureId)
+		if err == nil {
+			record.AwardId = oneExp.AwardId
+		}
+	}
+	return t.check_award_open(stub, record.AwardId)
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSubAwardBoundByParentRemaining(t *testing.T) {
+	cc, m := setup(t)
+	m.attrs["role"] = "admin"
+
+	// AWD-401 gave 45000 to AWD-402 and ACT-102 charged expenses to it, so not all of the 80000 is left
+	_, err := cc.Invoke(m, "createaward", []string{"AWD-403", "ACT-102", "ACT-103", "80000", "USD", "AWD-401", "2017-03-01", "2018-06-30", "90"})
+	fails(t, nil, err, "left on its parent award AWD-401")
+
+	must(t)(cc.Invoke(m, "createaward", []string{"AWD-403", "ACT-102", "ACT-103", "10000", "USD", "AWD-401", "2017-03-01", "2018-06-30", "90"}))
+	_, err = cc.Invoke(m, "createaward", []string{"AWD-404", "ACT-102", "ACT-103", "80000", "USD", "AWD-401", "2017-03-01", "2018-06-30", "90"})
+	fails(t, nil, err, "left on its parent award AWD-401")
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Batch spend - a monthly expense sheet is submitted as one invoke. Every line goes through Spend, so it is checked
+//				  against the balances, the allowability rules and the award like a single spend. Writes are staged:
+//				  a line that fails leaves nothing behind. In "all" mode a single failed line discards the whole sheet
+//				  and rejects the transaction with the error of that line, in "besteffort" mode the caller gets a
+//				  result per line.
+//==============================================================================================================================
+
+// one line of an expense sheet, the arguments of a spend
+type SpendLine struct {
+	FromActor string       `json:"fromactor"`
+	ToActor   string       `json:"toactor"`
+	Amount    string       `json:"amount"`
+	Type      string       `json:"type"`
+	Options   SpendOptions `json:"options"`
+}
+
+// the outcome of one line (line number, status, expenditure id, reimbursement id, error)
+type SpendLineResult struct {
+	Line            int    `json:"line"`
+	Status          string `json:"status"`
+	ExpenditureId   string `json:"expenditureid"`
+	ReimbursementId string `json:"reimbursementid"`
+	Error           string `json:"error"`
+}
+
+type SpendBatchResult struct {
+	Mode    string            `json:"mode"`
+	Applied bool              `json:"applied"`
+	Lines   []SpendLineResult `json:"lines"`
+}
+
+// ============================================================================================================================
+// SpendBatch Function - Called when a grantee submits an expense sheet
+// Function: spend every line of a JSON array, all or nothing ("all") or keeping the lines that pass ("besteffort")
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) SpendBatch(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//      0          1
+	// "lines json"  "all|besteffort"
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+	var lines []SpendLine
+	err := json.Unmarshal([]byte(args[0]), &lines)
+	if err != nil {
+		return nil, errors.New("1st argument must be a JSON array of spend lines")
+	}
+	if len(lines) <= 0 {
+		return nil, errors.New("The expense sheet has no lines")
+	}
+	if args[1] != "all" && args[1] != "besteffort" {
+		return nil, errors.New("2nd argument must be all or besteffort")
+	}
+
+	result := SpendBatchResult{Mode: args[1], Applied: true}
+	batch := new_staging_stub(stub)
+	batchExpNumber, batchReimbNumber := expNumber, reimbNumber
+	for i := 0; i < len(lines); i++ {
+		line := SpendLineResult{Line: i + 1}
+
+		// a failed line must not use up ids either
+		savedExpNumber, savedReimbNumber := expNumber, reimbNumber
+		line.ExpenditureId = next_expenditure_id()
+		remId := next_reimbursement_id()
+
+		optionsAsBytes, _ := json.Marshal(lines[i].Options)
+		lineStub := new_staging_stub(batch)
+		_, err := t.Spend(lineStub, []string{lines[i].FromActor, lines[i].ToActor, lines[i].Amount, lines[i].Type, string(optionsAsBytes)})
+		if err != nil {
+			if args[1] == "all" {
+				// nothing of the sheet is kept
+				expNumber, reimbNumber = batchExpNumber, batchReimbNumber
+				return nil, errors.New("Line " + strconv.Itoa(i+1) + " of the expense sheet failed, nothing of it is kept: " + err.Error())
+			}
+			expNumber, reimbNumber = savedExpNumber, savedReimbNumber
+			line.Status = "Failed"
+			line.ExpenditureId = ""
+			line.Error = err.Error()
+			result.Lines = append(result.Lines, line)
+			continue
+		}
+		err = lineStub.flush()
+		if err != nil {
+			return nil, err
+		}
+
+		oneExp := Expenditure{}
+		expAsBytes, _ := batch.GetState(line.ExpenditureId)
+		json.Unmarshal(expAsBytes, &oneExp)
+		line.Status = oneExp.Status
+		if reimbNumber != savedReimbNumber {
+			line.ReimbursementId = remId
+		}
+		result.Lines = append(result.Lines, line)
+	}
+
+	err = batch.flush()
+	if err != nil {
+		return nil, err
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+
+	return resultAsBytes, nil
+}
+
+//==============================================================================================================================
+//	stagingStub - a stub that keeps its writes in memory until they are flushed to the stub it wraps. Reads see the
+//				  staged writes first. Range queries are not staged and read the wrapped stub only. The event is
+//				  staged as well, so a write that is never flushed is never announced either.
+//==============================================================================================================================
+
+type stagingStub struct {
+	shim.ChaincodeStubInterface
+	writes  map[string][]byte
+	deleted map[string]bool
+	order   []string
+	event   string
+	payload []byte
+}
+
+func new_staging_stub(stub shim.ChaincodeStubInterface) *stagingStub {
+	return &stagingStub{ChaincodeStubInterface: stub, writes: map[string][]byte{}, deleted: map[string]bool{}}
+}
+
+func (s *stagingStub) GetState(key string) ([]byte, error) {
+	if s.deleted[key] {
+		return nil, nil
+	}
+	if value, ok := s.writes[key]; ok {
+		return value, nil
+	}
+	return s.ChaincodeStubInterface.GetState(key)
+}
+
+func (s *stagingStub) PutState(key string, value []byte) error {
+	if _, ok := s.writes[key]; !ok && !s.deleted[key] {
+		s.order = append(s.order, key)
+	}
+	delete(s.deleted, key)
+	s.writes[key] = value
+	return nil
+}
+
+func (s *stagingStub) DelState(key string) error {
+	if _, ok := s.writes[key]; !ok && !s.deleted[key] {
+		s.order = append(s.order, key)
+	}
+	delete(s.writes, key)
+	s.deleted[key] = true
+	return nil
+}
+
+func (s *stagingStub) SetEvent(name string, payload []byte) error {
+	s.event = name
+	s.payload = payload
+	return nil
+}
+
+// flush - apply the staged writes to the wrapped stub in the order they were first made, then set the staged event
+func (s *stagingStub) flush() error {
+	for i := 0; i < len(s.order); i++ {
+		key := s.order[i]
+		var err error
+		if s.deleted[key] {
+			err = s.ChaincodeStubInterface.DelState(key)
+		} else {
+			err = s.ChaincodeStubInterface.PutState(key, s.writes[key])
+		}
+		if err != nil {
+			return errors.New("Failed to write " + key + ": " + err.Error())
+		}
+	}
+	if len(s.event) > 0 {
+		err := s.ChaincodeStubInterface.SetEvent(s.event, s.payload)
+		if err != nil {
+			return err
+		}
+	}
+	s.writes = map[string][]byte{}
+	s.deleted = map[string]bool{}
+	s.order = nil
+	s.event = ""
+	s.payload = nil
+	return nil
+}
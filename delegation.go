@@ -0,0 +1,618 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Delegation and escalation - an approver on leave can delegate their authority to another actor for a date range.
+//								The delegate may then sign any step waiting for the approver, and every such signature
+//								is logged on the delegation. An award can also set an approval SLA: once a step has
+//								waited more than SlaDays, measured on transaction timestamps from the spend or the
+//								previous signature, it escalates one level along the EscalationPath, and again after
+//								every further SlaDays. An escalation approver that has been reached, or their delegate,
+//								may sign for the waiting approver.
+//==============================================================================================================================
+
+type ApprovalDelegation struct {
+	DelegationId string          `json:"delegationid"`
+	ApproverId   string          `json:"approverid"`
+	DelegateId   string          `json:"delegateid"`
+	StartDate    string          `json:"startdate"`
+	EndDate      string          `json:"enddate"`
+	Status       string          `json:"status"`
+	Uses         []DelegationUse `json:"uses"`
+}
+
+// one signature a delegate made under a delegation (expenditure id, date)
+type DelegationUse struct {
+	ExpenditureId string `json:"expenditureid"`
+	Date          string `json:"date"`
+}
+
+// an approval step escalated to a level of the award's escalation path (step, level, approver id, date)
+type Escalation struct {
+	Step       int    `json:"step"`
+	Level      int    `json:"level"`
+	ApproverId string `json:"approverid"`
+	Date       string `json:"date"`
+}
+
+// an approval step that has waited longer than the SLA of its award
+type OverdueApproval struct {
+	ExpenditureId string   `json:"expenditureid"`
+	AwardId       string   `json:"awardid"`
+	Amount        string   `json:"amount"`
+	Step          int      `json:"step"`
+	WaitingSince  string   `json:"waitingsince"`
+	AgeDays       int      `json:"agedays"`
+	SlaDays       string   `json:"sladays"`
+	Level         int      `json:"level"`
+	EscalatedTo   []string `json:"escalatedto"`
+}
+
+// the overdue approvals waiting for one approver
+type ApproverOverdue struct {
+	ApproverId string            `json:"approverid"`
+	Overdue    []OverdueApproval `json:"overdue"`
+}
+
+var delegationIndexStr = "_delegationindex" // Define an index variable to track all the delegations stored in the world state
+
+// ============================================================================================================================
+// DelegateApproval Function - Called when an approver hands their approval authority to another actor for a while
+// Function: create ApprovalDelegation struct, the caller is the approver
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) DelegateApproval(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//       0              1             2
+	// "delegate id"  "start date"  "end date"
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	callerId, err := t.get_caller_actor(stub)
+	if err != nil {
+		return nil, err
+	}
+	if args[0] == callerId {
+		return nil, errors.New("An approver cannot delegate to themselves")
+	}
+	actorAsBytes, err := stub.GetState(args[0])
+	if err != nil {
+		return nil, errors.New("Failed to get delegate")
+	}
+	actor := Actor{}
+	json.Unmarshal(actorAsBytes, &actor)
+	if actor.ActorId != args[0] {
+		return nil, errors.New("Delegate " + args[0] + " does not exist")
+	}
+
+	startDate, err := time.Parse(dateFormat, args[1])
+	if err != nil {
+		return nil, errors.New("2nd argument must be a date formatted as " + dateFormat)
+	}
+	endDate, err := time.Parse(dateFormat, args[2])
+	if err != nil {
+		return nil, errors.New("3rd argument must be a date formatted as " + dateFormat)
+	}
+	if endDate.Before(startDate) {
+		return nil, errors.New("The delegation cannot end before it starts")
+	}
+
+	//get the delegation index
+	delegationsAsBytes, err := stub.GetState(delegationIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get delegation index")
+	}
+	var delegationIndex []string
+	json.Unmarshal(delegationsAsBytes, &delegationIndex)
+
+	delegation := ApprovalDelegation{}
+	delegation.DelegationId = "DLG-" + strconv.Itoa(len(delegationIndex)+1)
+	delegation.ApproverId = callerId
+	delegation.DelegateId = args[0]
+	delegation.StartDate = startDate.Format(dateFormat)
+	delegation.EndDate = endDate.Format(dateFormat)
+	delegation.Status = "Active"
+
+	delegationAsBytes, _ := json.Marshal(delegation)
+	err = stub.PutState(delegation.DelegationId, delegationAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	//append the index
+	delegationIndex = append(delegationIndex, delegation.DelegationId)
+	jsonAsBytes, _ := json.Marshal(delegationIndex)
+	err = stub.PutState(delegationIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(delegation.DelegationId), nil
+}
+
+// ============================================================================================================================
+// RevokeDelegation Function - Called when an approver takes their authority back before the delegation ends
+// Function: update ApprovalDelegation struct (status), the uses already logged are kept
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) RevokeDelegation(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//        0
+	// "delegation id"
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	delegation, err := t.get_delegation(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	callerId, err := t.get_caller_actor(stub)
+	if err != nil {
+		return nil, err
+	}
+	if callerId != delegation.ApproverId && !t.caller_has_role(stub, "admin") {
+		return nil, errors.New("Only " + delegation.ApproverId + " can revoke " + delegation.DelegationId)
+	}
+	if delegation.Status == "Revoked" {
+		return nil, errors.New("Delegation " + delegation.DelegationId + " is already revoked")
+	}
+
+	delegation.Status = "Revoked"
+	delegationAsBytes, _ := json.Marshal(delegation)
+	err = stub.PutState(delegation.DelegationId, delegationAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// ============================================================================================================================
+// SetApprovalSla Function - Called when the grantor sets how long approval steps of an award may wait
+// Function: update Award struct (SLA days, escalation path), the escalation approvers are listed from the first level up
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) SetApprovalSla(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//      0            1              2                 3 ...
+	// "award id"  "sla days"  "escalation approver"  "escalation approver" ...
+
+	if len(args) < 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting award id, sla days and at least 1 escalation approver")
+	}
+
+	award, err := t.get_award(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if !t.caller_has_role(stub, "admin") {
+		callerId, err := t.get_caller_actor(stub)
+		if err != nil {
+			return nil, err
+		}
+		if callerId != award.GrantorId {
+			return nil, errors.New("Only the grantor " + award.GrantorId + " can set the approval SLA of " + award.AwardId)
+		}
+	}
+	err = t.check_award_open(stub, award.AwardId)
+	if err != nil {
+		return nil, err
+	}
+
+	slaDays, err := strconv.Atoi(args[1])
+	if err != nil || slaDays <= 0 {
+		return nil, errors.New("2nd argument must be a positive whole number of days")
+	}
+
+	var path []string
+	for i := 2; i < len(args); i++ {
+		actorAsBytes, err := stub.GetState(args[i])
+		if err != nil {
+			return nil, errors.New("Failed to get escalation approver")
+		}
+		actor := Actor{}
+		json.Unmarshal(actorAsBytes, &actor)
+		if actor.ActorId != args[i] {
+			return nil, errors.New("Escalation approver " + args[i] + " does not exist")
+		}
+		for j := 0; j < len(path); j++ {
+			if path[j] == args[i] {
+				return nil, errors.New("Escalation approver " + args[i] + " is listed twice")
+			}
+		}
+		path = append(path, args[i])
+	}
+
+	award.SlaDays = strconv.Itoa(slaDays)
+	award.EscalationPath = path
+	err = t.put_award(stub, award)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// ============================================================================================================================
+// EscalateApprovals Function - Called periodically to record the escalation of approval steps that are past their SLA
+// Function: update Expenditure struct (escalations) of every pending expenditure whose step reached a new level, and
+// return the ids of the expenditures that were escalated. The alerts of the awards with pending expenses are evaluated
+// too, so an overdue step raises its SLA alert even when nothing is spent on the award any more
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) EscalateApprovals(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	current_time, err := tx_time(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	expsIndexAsBytes, err := stub.GetState(expIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get expenditure index")
+	}
+	var expIndex []string
+	json.Unmarshal(expsIndexAsBytes, &expIndex)
+
+	var escalated []string
+	var awardIds []string
+	pendingOn := map[string]bool{}
+	for i := 0; i < len(expIndex); i++ {
+		oneExp, err := t.get_expenditure(stub, expIndex[i])
+		if err != nil {
+			return nil, err
+		}
+		if oneExp.Status != "Pending" || len(oneExp.AwardId) <= 0 {
+			continue
+		}
+		if !pendingOn[oneExp.AwardId] {
+			pendingOn[oneExp.AwardId] = true
+			awardIds = append(awardIds, oneExp.AwardId)
+		}
+		award, err := t.get_award(stub, oneExp.AwardId)
+		if err != nil {
+			return nil, err
+		}
+		level, _ := escalation_level(oneExp, award, current_time)
+
+		// the highest level already recorded for the waiting step
+		step := len(oneExp.Approvals)
+		recorded := 0
+		for j := 0; j < len(oneExp.Escalations); j++ {
+			if oneExp.Escalations[j].Step == step && oneExp.Escalations[j].Level > recorded {
+				recorded = oneExp.Escalations[j].Level
+			}
+		}
+		if level <= recorded {
+			continue
+		}
+
+		for l := recorded + 1; l <= level; l++ {
+			oneExp.Escalations = append(oneExp.Escalations, Escalation{Step: step, Level: l, ApproverId: award.EscalationPath[l-1], Date: current_time.Format(time.RFC3339)})
+		}
+		err = t.put_expenditure(stub, oneExp)
+		if err != nil {
+			return nil, err
+		}
+		escalated = append(escalated, oneExp.ExpenditureId)
+	}
+
+	for i := 0; i < len(awardIds); i++ {
+		err = t.evaluate_alerts(stub, awardIds[i], "")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	escalatedAsBytes, _ := json.Marshal(escalated)
+
+	return escalatedAsBytes, nil
+}
+
+// ============================================================================================================================
+// Query Function - Called when query delegations
+// Function: query all the delegations the caller sees with their logged uses, optionally only those given or received
+// by one actor
+// Query
+// ============================================================================================================================
+func (t *SimpleChaincode) QueryDelegations(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//args[0] = optional actor id
+
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
+	delegations, err := t.get_delegations(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []ApprovalDelegation
+	for i := 0; i < len(delegations); i++ {
+		if len(args) > 0 && len(args[0]) > 0 && delegations[i].ApproverId != args[0] && delegations[i].DelegateId != args[0] {
+			continue
+		}
+		if !view.can_see(delegations[i].ApproverId, delegations[i].DelegateId) {
+			continue
+		}
+		result = append(result, delegations[i])
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+
+	return resultAsBytes, nil
+}
+
+// ============================================================================================================================
+// Query Function - Called when query overdue approvals
+// Function: list every pending approval step that has waited longer than the SLA of its award, grouped per waiting
+// approver, optionally only those one actor is waited for or has been escalated to. A caller sees the steps of the
+// expenses it sees and those it is waited for or escalated to.
+// Query
+// ============================================================================================================================
+func (t *SimpleChaincode) QueryOverdueApprovals(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//args[0] = optional approver id
+
+	current_time, err := tx_time(stub)
+	if err != nil {
+		return nil, err
+	}
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	expsIndexAsBytes, err := stub.GetState(expIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get expenditure index")
+	}
+	var expIndex []string
+	json.Unmarshal(expsIndexAsBytes, &expIndex)
+
+	var result []ApproverOverdue
+	for i := 0; i < len(expIndex); i++ {
+		oneExp, err := t.get_expenditure(stub, expIndex[i])
+		if err != nil {
+			return nil, err
+		}
+		if oneExp.Status != "Pending" || len(oneExp.AwardId) <= 0 {
+			continue
+		}
+		award, err := t.get_award(stub, oneExp.AwardId)
+		if err != nil {
+			return nil, err
+		}
+		slaDays, err := strconv.Atoi(award.SlaDays)
+		if err != nil || slaDays <= 0 {
+			continue
+		}
+		since, err := step_started(oneExp)
+		if err != nil {
+			return nil, err
+		}
+		ageDays := int(current_time.Sub(since).Hours() / 24)
+		if ageDays < slaDays {
+			continue
+		}
+
+		waiting := award.GrantorId
+		if approvals_outstanding(oneExp) {
+			waiting = oneExp.Approvers[len(oneExp.Approvals)]
+		}
+		level, _ := escalation_level(oneExp, award, current_time)
+		item := OverdueApproval{}
+		item.ExpenditureId = oneExp.ExpenditureId
+		item.AwardId = oneExp.AwardId
+		item.Amount = oneExp.Amount
+		item.Step = len(oneExp.Approvals)
+		item.WaitingSince = since.Format(time.RFC3339)
+		item.AgeDays = ageDays
+		item.SlaDays = award.SlaDays
+		item.Level = level
+		item.EscalatedTo = award.EscalationPath[:level]
+
+		if len(args) > 0 && len(args[0]) > 0 && waiting != args[0] {
+			reached := false
+			for j := 0; j < len(item.EscalatedTo); j++ {
+				if item.EscalatedTo[j] == args[0] {
+					reached = true
+				}
+			}
+			if !reached {
+				continue
+			}
+		}
+
+		if !view.can_see(append([]string{oneExp.FromActor, oneExp.ToActor, waiting}, item.EscalatedTo...)...) {
+			continue
+		}
+
+		k := 0
+		for k < len(result) && result[k].ApproverId != waiting {
+			k++
+		}
+		if k == len(result) {
+			result = append(result, ApproverOverdue{ApproverId: waiting})
+		}
+		result[k].Overdue = append(result[k].Overdue, item)
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+
+	return resultAsBytes, nil
+}
+
+// ============================================================================================================================
+// authorise_approval - check that the caller may sign the waiting step of an expenditure, and fill in on whose behalf
+// The waiting approver signs first; otherwise an escalation approver the step has reached, then a delegate of any of them.
+// ============================================================================================================================
+func (t *SimpleChaincode) authorise_approval(stub shim.ChaincodeStubInterface, oneExp Expenditure, award Award, callerId string, now time.Time) (Approval, error) {
+	if !approvals_outstanding(oneExp) {
+		return Approval{}, errors.New("Expenditure " + oneExp.ExpenditureId + " waits for no further approval")
+	}
+	waiting := oneExp.Approvers[len(oneExp.Approvals)]
+	level, err := escalation_level(oneExp, award, now)
+	if err != nil {
+		return Approval{}, err
+	}
+
+	// the waiting approver is level 0, the escalation approvers follow in order
+	candidates := append([]string{waiting}, award.EscalationPath[:level]...)
+	for l := 0; l < len(candidates); l++ {
+		if candidates[l] != callerId {
+			continue
+		}
+		approval := Approval{ApproverId: callerId, Level: l}
+		if l > 0 {
+			approval.OnBehalfOf = waiting
+		}
+		return approval, nil
+	}
+
+	for l := 0; l < len(candidates); l++ {
+		delegation, err := t.find_delegation(stub, candidates[l], callerId, now)
+		if err != nil {
+			return Approval{}, err
+		}
+		if len(delegation.DelegationId) > 0 {
+			return Approval{ApproverId: callerId, OnBehalfOf: waiting, DelegationId: delegation.DelegationId, Level: l}, nil
+		}
+	}
+
+	return Approval{}, errors.New("Expenditure " + oneExp.ExpenditureId + " is waiting for the approval of " + waiting)
+}
+
+// ============================================================================================================================
+// find_delegation - the first active delegation from an approver to a delegate covering the date, empty if there is none
+// ============================================================================================================================
+func (t *SimpleChaincode) find_delegation(stub shim.ChaincodeStubInterface, approverId string, delegateId string, now time.Time) (ApprovalDelegation, error) {
+	delegations, err := t.get_delegations(stub)
+	if err != nil {
+		return ApprovalDelegation{}, err
+	}
+
+	today := now.Format(dateFormat)
+	for i := 0; i < len(delegations); i++ {
+		delegation := delegations[i]
+		if delegation.ApproverId != approverId || delegation.DelegateId != delegateId || delegation.Status != "Active" {
+			continue
+		}
+		if today < delegation.StartDate || today > delegation.EndDate {
+			continue
+		}
+		return delegation, nil
+	}
+
+	return ApprovalDelegation{}, nil
+}
+
+// ============================================================================================================================
+// log_delegation_use - record on the delegation that its delegate signed an expenditure
+// ============================================================================================================================
+func (t *SimpleChaincode) log_delegation_use(stub shim.ChaincodeStubInterface, delegationId string, expId string, now time.Time) error {
+	delegation, err := t.get_delegation(stub, delegationId)
+	if err != nil {
+		return err
+	}
+
+	delegation.Uses = append(delegation.Uses, DelegationUse{ExpenditureId: expId, Date: now.Format(time.RFC3339)})
+	delegationAsBytes, _ := json.Marshal(delegation)
+	return stub.PutState(delegation.DelegationId, delegationAsBytes)
+}
+
+// ============================================================================================================================
+// escalation_level - how many levels of the escalation path the waiting step of an expenditure has reached
+// ============================================================================================================================
+func escalation_level(oneExp Expenditure, award Award, now time.Time) (int, error) {
+	slaDays, err := strconv.Atoi(award.SlaDays)
+	if err != nil || slaDays <= 0 {
+		return 0, nil
+	}
+	since, err := step_started(oneExp)
+	if err != nil {
+		return 0, err
+	}
+
+	level := int(now.Sub(since).Hours()/24) / slaDays
+	if level < 0 {
+		level = 0
+	}
+	if level > len(award.EscalationPath) {
+		level = len(award.EscalationPath)
+	}
+	return level, nil
+}
+
+// ============================================================================================================================
+// step_started - when the waiting approval step of an expenditure began: the last signature, else the spend
+// ============================================================================================================================
+func step_started(oneExp Expenditure) (time.Time, error) {
+	if len(oneExp.Approvals) > 0 {
+		since, err := time.Parse(time.RFC3339, oneExp.Approvals[len(oneExp.Approvals)-1].Date)
+		if err != nil {
+			return time.Time{}, errors.New("Expenditure " + oneExp.ExpenditureId + " has an approval with an invalid time")
+		}
+		return since, nil
+	}
+	if len(oneExp.Submitted) > 0 {
+		since, err := time.Parse(time.RFC3339, oneExp.Submitted)
+		if err != nil {
+			return time.Time{}, errors.New("Expenditure " + oneExp.ExpenditureId + " has an invalid submission time")
+		}
+		return since, nil
+	}
+
+	// expenditures spent before submissions were timed only carry their date
+	since, err := time.Parse(dateFormat, oneExp.Date)
+	if err != nil {
+		return time.Time{}, errors.New("Expenditure " + oneExp.ExpenditureId + " has an invalid date")
+	}
+	return since, nil
+}
+
+// ============================================================================================================================
+// get_delegation / get_delegations - read one delegation, or every delegation in the order they were given
+// ============================================================================================================================
+func (t *SimpleChaincode) get_delegation(stub shim.ChaincodeStubInterface, delegationId string) (ApprovalDelegation, error) {
+	delegationAsBytes, err := stub.GetState(delegationId)
+	if err != nil {
+		return ApprovalDelegation{}, errors.New("Failed to get delegation")
+	}
+	delegation := ApprovalDelegation{}
+	json.Unmarshal(delegationAsBytes, &delegation)
+	if delegation.DelegationId != delegationId {
+		return ApprovalDelegation{}, errors.New("Delegation " + delegationId + " does not exist")
+	}
+	return delegation, nil
+}
+
+func (t *SimpleChaincode) get_delegations(stub shim.ChaincodeStubInterface) ([]ApprovalDelegation, error) {
+	delegationsAsBytes, err := stub.GetState(delegationIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get delegation index")
+	}
+	var delegationIndex []string
+	json.Unmarshal(delegationsAsBytes, &delegationIndex)
+
+	var delegations []ApprovalDelegation
+	for i := 0; i < len(delegationIndex); i++ {
+		delegationAsBytes, err := stub.GetState(delegationIndex[i])
+		if err != nil {
+			return nil, errors.New("Failed to get delegation")
+		}
+		delegation := ApprovalDelegation{}
+		json.Unmarshal(delegationAsBytes, &delegation)
+		delegations = append(delegations, delegation)
+	}
+
+	return delegations, nil
+}
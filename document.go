@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Documents - the receipts, invoices and delivery notes behind an expenditure stay off the ledger; only their SHA-256
+//				hash, type, file name and size are anchored to it, at spend time through the spend options or later
+//				through attachdocument. An auditor holding a file can then prove it is the one the expense was
+//				claimed with. A noevidence allowability rule makes evidence mandatory above an amount.
+//==============================================================================================================================
+
+// a supporting document anchored to an expenditure (hash, type, file name, size in bytes, who anchored it and when)
+type Document struct {
+	Hash       string `json:"hash"`
+	Type       string `json:"type"`
+	FileName   string `json:"filename"`
+	Size       string `json:"size"`
+	AnchoredBy string `json:"anchoredby"`
+	AnchoredAt string `json:"anchoredat"`
+}
+
+// the answer of verifydocument
+type DocumentVerification struct {
+	ExpenditureId string   `json:"expenditureid"`
+	Hash          string   `json:"hash"`
+	Anchored      bool     `json:"anchored"`
+	Document      Document `json:"document"`
+}
+
+var documentTypes = []string{"receipt", "invoice", "deliverynote"}
+
+// ============================================================================================================================
+// AttachDocument Function - Called when the grantee adds evidence to an expenditure after it was spent
+// Function: update Expenditure struct (documents)
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) AttachDocument(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//     0         1        2          3           4
+	// "exp id"  "sha256"  "type"  "file name"  "size"
+
+	if len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 5")
+	}
+
+	oneExp, err := t.get_expenditure(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	err = t.check_record_open(stub, oneExp.ExpenditureId)
+	if err != nil {
+		return nil, err
+	}
+	callerId, err := t.get_caller_actor(stub)
+	if err != nil {
+		return nil, err
+	}
+	if callerId != oneExp.FromActor && !t.caller_has_role(stub, "admin") {
+		return nil, errors.New("Only " + oneExp.FromActor + " can attach documents to " + oneExp.ExpenditureId)
+	}
+	current_time, err := tx_time(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	document := Document{Hash: args[1], Type: args[2], FileName: args[3], Size: args[4]}
+	documents, err := check_documents(append(oneExp.Documents, document), len(oneExp.Documents), callerId, current_time)
+	if err != nil {
+		return nil, err
+	}
+
+	oneExp.Documents = documents
+	err = t.put_expenditure(stub, oneExp)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Query Function - Called when verify a document
+// Function: whether a file hash is anchored to an expenditure the caller sees, and the details it was anchored with
+// Query
+// ============================================================================================================================
+func (t *SimpleChaincode) VerifyDocument(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//     0         1
+	// "exp id"  "sha256"
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	oneExp, err := t.get_expenditure(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
+	if !view.can_see(oneExp.FromActor, oneExp.ToActor) {
+		return nil, errors.New("Expenditure " + args[0] + " does not exist")
+	}
+
+	result := DocumentVerification{}
+	result.ExpenditureId = oneExp.ExpenditureId
+	result.Hash = strings.ToLower(args[1])
+	for i := 0; i < len(oneExp.Documents); i++ {
+		if oneExp.Documents[i].Hash == result.Hash {
+			result.Anchored = true
+			result.Document = oneExp.Documents[i]
+		}
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+
+	return resultAsBytes, nil
+}
+
+// ============================================================================================================================
+// check_documents - validate the documents of an expenditure, the first anchored of which are already on the ledger,
+// and stamp the new ones with who anchored them and when. A hash may only be anchored once per expenditure.
+// ============================================================================================================================
+func check_documents(documents []Document, anchored int, actorId string, now time.Time) ([]Document, error) {
+	seen := map[string]bool{}
+	for i := 0; i < len(documents); i++ {
+		document := &documents[i]
+		document.Hash = strings.ToLower(document.Hash)
+		if !valid_sha256(document.Hash) {
+			return nil, errors.New("Document hash " + document.Hash + " must be a hex SHA-256 hash")
+		}
+		if seen[document.Hash] {
+			return nil, errors.New("Document " + document.Hash + " is already anchored to this expenditure")
+		}
+		seen[document.Hash] = true
+
+		document.Type = strings.ToLower(document.Type)
+		known := false
+		for j := 0; j < len(documentTypes); j++ {
+			if documentTypes[j] == document.Type {
+				known = true
+			}
+		}
+		if !known {
+			return nil, errors.New("Document type must be one of " + strings.Join(documentTypes, ", "))
+		}
+		if len(document.FileName) <= 0 {
+			return nil, errors.New("Document " + document.Hash + " needs a file name")
+		}
+		size, err := strconv.ParseInt(document.Size, 10, 64)
+		if err != nil || size <= 0 {
+			return nil, errors.New("Document " + document.Hash + " needs a positive size in bytes")
+		}
+
+		if i >= anchored {
+			document.AnchoredBy = actorId
+			document.AnchoredAt = now.Format(time.RFC3339)
+		}
+	}
+	return documents, nil
+}
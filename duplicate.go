@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Duplicate invoices - an expenditure can carry the supplier's invoice number, invoice date and vendor reference.
+//						 Invoice numbers are unique per supplier: Spend refuses an invoice number the supplier was
+//						 already paid for, compared without case, spaces or punctuation, unless that expenditure was
+//						 reversed. An expense to the same supplier for the same amount in the same currency, as
+//						 invoiced before any conversion into the award currency, within the duplicate window (14
+//						 days unless an admin sets it) of another is a suspected duplicate: it is kept Pending for
+//						 review instead of being approved automatically. Spend finds those through a per-supplier
+//						 index of the amounts, currencies and dates it paid, not by reading every expense.
+//==============================================================================================================================
+
+// an expenditure that may duplicate earlier ones (expenditure id, supplier id, amount, date, invoice number, status)
+type SuspectedDuplicate struct {
+	ExpenditureId string   `json:"expenditureid"`
+	SupplierId    string   `json:"supplierid"`
+	Amount        string   `json:"amount"`
+	Date          string   `json:"date"`
+	InvoiceNumber string   `json:"invoicenumber"`
+	Status        string   `json:"status"`
+	DuplicateOf   []string `json:"duplicateof"`
+}
+
+// one payment to a supplier in the payment index (expenditure id, amount and currency paid, date)
+type PaymentIndexEntry struct {
+	ExpenditureId string `json:"expenditureid"`
+	Amount        string `json:"amount"`
+	Currency      string `json:"currency"`
+	Date          string `json:"date"`
+}
+
+var invoiceIndexStr = "_invoiceindex"       // Prefix of the per-supplier index of invoice numbers to expenditure ids
+var paymentIndexStr = "_paymentindex"       // Prefix of the per-supplier index of the amounts and dates paid
+var duplicateWindowStr = "_duplicatewindow" // Define a variable to hold the days within which equal payments are suspects
+var defaultDuplicateWindow = 14             // Duplicate window used until an admin sets one
+
+// ============================================================================================================================
+// SetDuplicateWindow Function - Called when an admin changes how close in time equal payments are suspected duplicates
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) SetDuplicateWindow(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//args[0] days
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+	if !t.caller_has_role(stub, "admin") {
+		return nil, errors.New("Only an admin can set the duplicate window")
+	}
+	days, err := strconv.Atoi(args[0])
+	if err != nil || days < 0 {
+		return nil, errors.New("1st argument must be a non-negative whole number of days")
+	}
+
+	err = stub.PutState(duplicateWindowStr, []byte(strconv.Itoa(days)))
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Query Function - Called when query suspected duplicate expenditures
+// Function: list every expenditure the caller sees that shares its invoice number with an earlier one of the supplier,
+// or its supplier and amount with one within the duplicate window, optionally only those paid to one supplier
+// Query
+// ============================================================================================================================
+func (t *SimpleChaincode) QuerySuspectedDuplicates(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//args[0] = optional supplier id
+
+	window, err := t.duplicate_window(stub)
+	if err != nil {
+		return nil, err
+	}
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
+	expenses, err := t.get_expenditures(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []SuspectedDuplicate
+	for i := 0; i < len(expenses); i++ {
+		if len(args) > 0 && len(args[0]) > 0 && expenses[i].ToActor != args[0] {
+			continue
+		}
+		if !view.can_see(expenses[i].FromActor, expenses[i].ToActor) {
+			continue
+		}
+		duplicateOf, err := suspected_duplicates(expenses[:i], expenses[i], window)
+		if err != nil {
+			return nil, err
+		}
+		if len(duplicateOf) <= 0 {
+			continue
+		}
+		item := SuspectedDuplicate{}
+		item.ExpenditureId = expenses[i].ExpenditureId
+		item.SupplierId = expenses[i].ToActor
+		item.Amount = expenses[i].Amount
+		item.Date = expenses[i].Date
+		item.InvoiceNumber = expenses[i].InvoiceNumber
+		item.Status = expenses[i].Status
+		item.DuplicateOf = duplicateOf
+		result = append(result, item)
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+
+	return resultAsBytes, nil
+}
+
+// ============================================================================================================================
+// suspected_duplicates - the ids of the earlier expenditures a candidate may duplicate: paid to the same supplier with the
+// same invoice number, or with the same amount paid in the same currency within window days, leaving out reversed ones
+// and reversals
+// ============================================================================================================================
+func suspected_duplicates(earlier []Expenditure, candidate Expenditure, window int) ([]string, error) {
+	if len(candidate.ReversalOf) > 0 {
+		return nil, nil
+	}
+	amountStr, currency := paid_amount(candidate)
+	amount, err := strconv.ParseFloat(amountStr, 64)
+	if err != nil {
+		return nil, errors.New("Expenditure " + candidate.ExpenditureId + " has a non-numeric amount")
+	}
+	date, err := time.Parse(dateFormat, candidate.Date)
+	if err != nil {
+		return nil, errors.New("Expenditure " + candidate.ExpenditureId + " has an invalid date")
+	}
+	invoiceNumber := normalize_invoice_number(candidate.InvoiceNumber)
+
+	var duplicateOf []string
+	for i := 0; i < len(earlier); i++ {
+		other := earlier[i]
+		if other.ExpenditureId == candidate.ExpenditureId || other.ToActor != candidate.ToActor {
+			continue
+		}
+		if len(other.ReversalOf) > 0 || len(other.ReversedBy) > 0 || other.Status == "Reversed" {
+			continue
+		}
+		if len(invoiceNumber) > 0 && normalize_invoice_number(other.InvoiceNumber) == invoiceNumber {
+			duplicateOf = append(duplicateOf, other.ExpenditureId)
+			continue
+		}
+		otherAmountStr, otherCurrency := paid_amount(other)
+		if otherCurrency != currency {
+			continue
+		}
+		otherAmount, err := strconv.ParseFloat(otherAmountStr, 64)
+		if err != nil || math.Abs(otherAmount-amount) >= 0.005 {
+			continue
+		}
+		otherDate, err := time.Parse(dateFormat, other.Date)
+		if err != nil {
+			continue
+		}
+		if math.Abs(date.Sub(otherDate).Hours()/24) <= float64(window) {
+			duplicateOf = append(duplicateOf, other.ExpenditureId)
+		}
+	}
+	return duplicateOf, nil
+}
+
+// ============================================================================================================================
+// payment_suspects - the suspected duplicates of a new payment to a supplier, read from the supplier's payment index:
+// only the expenditures paid the same amount in the same currency within the window are read to check they still stand
+// ============================================================================================================================
+func (t *SimpleChaincode) payment_suspects(stub shim.ChaincodeStubInterface, candidate Expenditure, window int) ([]string, error) {
+	amountStr, currency := paid_amount(candidate)
+	amount, err := strconv.ParseFloat(amountStr, 64)
+	if err != nil {
+		return nil, errors.New("Expenditure " + candidate.ExpenditureId + " has a non-numeric amount")
+	}
+	date, err := time.Parse(dateFormat, candidate.Date)
+	if err != nil {
+		return nil, errors.New("Expenditure " + candidate.ExpenditureId + " has an invalid date")
+	}
+	paymentIndex, err := t.get_payment_index(stub, candidate.ToActor)
+	if err != nil {
+		return nil, err
+	}
+
+	var earlier []Expenditure
+	for i := 0; i < len(paymentIndex); i++ {
+		payment := paymentIndex[i]
+		if payment.Currency != currency {
+			continue
+		}
+		paidAmount, err := strconv.ParseFloat(payment.Amount, 64)
+		if err != nil || math.Abs(paidAmount-amount) >= 0.005 {
+			continue
+		}
+		paidDate, err := time.Parse(dateFormat, payment.Date)
+		if err != nil || math.Abs(date.Sub(paidDate).Hours()/24) > float64(window) {
+			continue
+		}
+		oneExp, err := t.get_expenditure(stub, payment.ExpenditureId)
+		if err != nil {
+			return nil, err
+		}
+		earlier = append(earlier, oneExp)
+	}
+
+	return suspected_duplicates(earlier, candidate, window)
+}
+
+// ============================================================================================================================
+// paid_amount - the amount and currency a supplier was paid in: the original ones of an expense converted into the award
+// currency, else its amount in the award currency
+// ============================================================================================================================
+func paid_amount(oneExp Expenditure) (string, string) {
+	if len(oneExp.OriginalAmount) > 0 && len(oneExp.OriginalCurrency) > 0 {
+		return oneExp.OriginalAmount, oneExp.OriginalCurrency
+	}
+	return oneExp.Amount, oneExp.Currency
+}
+
+// ============================================================================================================================
+// register_payment - add an expenditure to the payment index of the supplier it paid
+// ============================================================================================================================
+func (t *SimpleChaincode) register_payment(stub shim.ChaincodeStubInterface, oneExp Expenditure) error {
+	paymentIndex, err := t.get_payment_index(stub, oneExp.ToActor)
+	if err != nil {
+		return err
+	}
+	amount, currency := paid_amount(oneExp)
+	paymentIndex = append(paymentIndex, PaymentIndexEntry{ExpenditureId: oneExp.ExpenditureId, Amount: amount, Currency: currency, Date: oneExp.Date})
+	jsonAsBytes, _ := json.Marshal(paymentIndex)
+	return stub.PutState(paymentIndexStr+"-"+oneExp.ToActor, jsonAsBytes)
+}
+
+// ============================================================================================================================
+// get_payment_index - the payments made to a supplier in the order they were made
+// ============================================================================================================================
+func (t *SimpleChaincode) get_payment_index(stub shim.ChaincodeStubInterface, supplierId string) ([]PaymentIndexEntry, error) {
+	paymentIndexAsBytes, err := stub.GetState(paymentIndexStr + "-" + supplierId)
+	if err != nil {
+		return nil, errors.New("Failed to get payment index of " + supplierId)
+	}
+	var paymentIndex []PaymentIndexEntry
+	json.Unmarshal(paymentIndexAsBytes, &paymentIndex)
+	return paymentIndex, nil
+}
+
+// ============================================================================================================================
+// check_invoice - refuse an invoice number the supplier was already paid for by an expenditure that still stands
+// ============================================================================================================================
+func (t *SimpleChaincode) check_invoice(stub shim.ChaincodeStubInterface, supplierId string, invoiceNumber string) error {
+	invoiceIndex, err := t.get_invoice_index(stub, supplierId)
+	if err != nil {
+		return err
+	}
+	normalized := normalize_invoice_number(invoiceNumber)
+	if len(normalized) <= 0 {
+		return errors.New("Invoice number " + invoiceNumber + " has no letters or digits")
+	}
+	expId, ok := invoiceIndex[normalized]
+	if !ok {
+		return nil
+	}
+	oneExp, err := t.get_expenditure(stub, expId)
+	if err != nil {
+		return err
+	}
+	if len(oneExp.ReversedBy) > 0 || oneExp.Status == "Reversed" {
+		return nil
+	}
+	return errors.New("Invoice " + invoiceNumber + " of " + supplierId + " was already submitted as " + expId)
+}
+
+// ============================================================================================================================
+// register_invoice - record the expenditure that paid an invoice number of a supplier
+// ============================================================================================================================
+func (t *SimpleChaincode) register_invoice(stub shim.ChaincodeStubInterface, supplierId string, invoiceNumber string, expId string) error {
+	invoiceIndex, err := t.get_invoice_index(stub, supplierId)
+	if err != nil {
+		return err
+	}
+	invoiceIndex[normalize_invoice_number(invoiceNumber)] = expId
+	jsonAsBytes, _ := json.Marshal(invoiceIndex)
+	return stub.PutState(invoiceIndexStr+"-"+supplierId, jsonAsBytes)
+}
+
+// ============================================================================================================================
+// get_invoice_index - the invoice numbers of a supplier, normalized, mapped to the expenditures that paid them
+// ============================================================================================================================
+func (t *SimpleChaincode) get_invoice_index(stub shim.ChaincodeStubInterface, supplierId string) (map[string]string, error) {
+	invoiceIndexAsBytes, err := stub.GetState(invoiceIndexStr + "-" + supplierId)
+	if err != nil {
+		return nil, errors.New("Failed to get invoice index of " + supplierId)
+	}
+	invoiceIndex := map[string]string{}
+	json.Unmarshal(invoiceIndexAsBytes, &invoiceIndex)
+	return invoiceIndex, nil
+}
+
+// ============================================================================================================================
+// normalize_invoice_number - an invoice number in upper case without spaces or punctuation, so INV-001 equals inv 001
+// ============================================================================================================================
+func normalize_invoice_number(invoiceNumber string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= '0' && r <= '9') || (r >= 'A' && r <= 'Z') {
+			return r
+		}
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		return -1
+	}, invoiceNumber)
+}
+
+// ============================================================================================================================
+// duplicate_window - the days within which equal payments to a supplier are suspected duplicates
+// ============================================================================================================================
+func (t *SimpleChaincode) duplicate_window(stub shim.ChaincodeStubInterface) (int, error) {
+	windowAsBytes, err := stub.GetState(duplicateWindowStr)
+	if err != nil {
+		return 0, errors.New("Failed to get duplicate window")
+	}
+	if len(windowAsBytes) <= 0 {
+		return defaultDuplicateWindow, nil
+	}
+	window, err := strconv.Atoi(string(windowAsBytes))
+	if err != nil {
+		return defaultDuplicateWindow, nil
+	}
+	return window, nil
+}
+
+// ============================================================================================================================
+// get_expenditures - read every expenditure in the order they were created
+// ============================================================================================================================
+func (t *SimpleChaincode) get_expenditures(stub shim.ChaincodeStubInterface) ([]Expenditure, error) {
+	expsIndexAsBytes, err := stub.GetState(expIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get expenditure index")
+	}
+	var expIndex []string
+	json.Unmarshal(expsIndexAsBytes, &expIndex)
+
+	var expenses []Expenditure
+	for i := 0; i < len(expIndex); i++ {
+		oneExp, err := t.get_expenditure(stub, expIndex[i])
+		if err != nil {
+			return nil, err
+		}
+		expenses = append(expenses, oneExp)
+	}
+
+	return expenses, nil
+}
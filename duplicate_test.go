@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSuspectedDuplicatesKeepToTheirCurrency(t *testing.T) {
+	cc, m := setup(t)
+	m.attrs["role"] = "admin"
+	must(t)(cc.Invoke(m, "createaward", []string{"AWD-403", "ACT-101", "ACT-102", "10000", "EUR", "", "2017-03-01", "2018-06-30", "90"}))
+
+	must(t)(cc.Invoke(m, "spend", []string{"ACT-102", "ACT-104", "640", "Travel", `{"awardid":"AWD-401"}`}))
+
+	// the same amount paid to the same supplier in euros is not the same payment
+	must(t)(cc.Invoke(m, "spend", []string{"ACT-102", "ACT-104", "640", "Travel", `{"awardid":"AWD-403"}`}))
+	r := string(m.state["EXP-211"])
+	if !strings.Contains(r, `"suspectedduplicates":null`) || !strings.Contains(r, `"currency":"EUR"`) {
+		t.Fatal(r)
+	}
+
+	must(t)(cc.Invoke(m, "spend", []string{"ACT-102", "ACT-104", "640", "Travel", `{"awardid":"AWD-401"}`}))
+	r = string(m.state["EXP-212"])
+	if !strings.Contains(r, `"suspectedduplicates":["EXP-210"]`) || !strings.Contains(r, `"status":"Pending"`) {
+		t.Fatal(r)
+	}
+}
+
+func TestSuspectedDuplicatesCompareTheInvoicedAmount(t *testing.T) {
+	cc, m := setup(t)
+	m.attrs["role"] = "admin"
+	must(t)(cc.Invoke(m, "initactor", []string{"ACT-105", "ECB", "0", "0", "0", "0", "0", "0"}))
+	must(t)(cc.Invoke(m, "setfxprovider", []string{"ACT-105"}))
+	must(t)(cc.Invoke(m, "createaward", []string{"AWD-403", "ACT-101", "ACT-102", "10000", "EUR", "", "2017-03-01", "2018-06-30", "90"}))
+	m.attrs["actorid"] = "ACT-105"
+	must(t)(cc.Invoke(m, "postfxrate", []string{"EUR", "USD", "1.1", "2017-07-01"}))
+	must(t)(cc.Invoke(m, "postfxrate", []string{"EUR", "USD", "1.2", "2017-07-10"}))
+
+	must(t)(cc.Invoke(m, "spend", []string{"ACT-102", "ACT-104", "1000", "Travel", `{"awardid":"AWD-401","currency":"EUR","date":"2017-07-05"}`}))
+
+	// the same euro invoice charged to the euro award
+	must(t)(cc.Invoke(m, "spend", []string{"ACT-102", "ACT-104", "1000", "Travel", `{"awardid":"AWD-403","date":"2017-07-06"}`}))
+	r := string(m.state["EXP-211"])
+	if !strings.Contains(r, `"suspectedduplicates":["EXP-210"]`) {
+		t.Fatal(r)
+	}
+
+	// and charged to the dollar award again once the rate has moved
+	must(t)(cc.Invoke(m, "spend", []string{"ACT-102", "ACT-104", "1000", "Travel", `{"awardid":"AWD-401","currency":"EUR","date":"2017-07-12"}`}))
+	r = string(m.state["EXP-212"])
+	if !strings.Contains(r, `"amount":"1200"`) || !strings.Contains(r, `"suspectedduplicates":["EXP-210","EXP-211"]`) {
+		t.Fatal(r)
+	}
+}
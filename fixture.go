@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Fixtures - seed data for an environment, given as one JSON document of actors, awards, suppliers, expenditures and
+//			   reimbursements in the same JSON form the records are stored in. Records are loaded in that order,
+//			   so a record may refer to any record listed before it or already on the ledger. Every record is
+//			   loaded on its own: one that fails, or refers to a record that failed, leaves nothing behind and is
+//			   reported with its error while the rest of the fixture still loads. Wallets are never taken from
+//			   the fixture, they are posted through the journal from the awards, expenditures and reimbursements.
+//			   Expenditures and reimbursements are numbered like any other: the id in the fixture only names the
+//			   record within the fixture, and the result reports the id each one was given on the ledger.
+//==============================================================================================================================
+
+type Fixture struct {
+	Actors         []Actor         `json:"actors"`
+	Awards         []Award         `json:"awards"`
+	Suppliers      []Supplier      `json:"suppliers"`
+	Expenditures   []Expenditure   `json:"expenditures"`
+	Reimbursements []Reimbursement `json:"reimbursements"`
+}
+
+// the outcome of loading one record (kind, id in the fixture, id on the ledger, status, error)
+type FixtureRecordResult struct {
+	Kind     string `json:"kind"`
+	Id       string `json:"id"`
+	LedgerId string `json:"ledgerid"`
+	Status   string `json:"status"`
+	Error    string `json:"error"`
+}
+
+type FixtureResult struct {
+	Loaded  int                   `json:"loaded"`
+	Failed  int                   `json:"failed"`
+	Records []FixtureRecordResult `json:"records"`
+}
+
+// ============================================================================================================================
+// LoadFixture Function - Called when an admin seeds an environment with its own data set
+// Function: create the Actor, Award, Supplier, Expenditure and Reimbursement structs of a JSON fixture and report the
+// result of every record
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) LoadFixture(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//      0
+	// "fixture json"
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+	if !t.caller_has_role(stub, "admin") {
+		return nil, errors.New("Only an admin can load a fixture")
+	}
+
+	fixture := Fixture{}
+	err := json.Unmarshal([]byte(args[0]), &fixture)
+	if err != nil {
+		return nil, errors.New("1st argument must be a JSON fixture")
+	}
+
+	result, err := t.load_fixture(stub, fixture)
+	if err != nil {
+		return nil, err
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+
+	return resultAsBytes, nil
+}
+
+// ============================================================================================================================
+// load_fixture - load every record of a fixture in its own staging stub and keep the ones that succeed
+// ============================================================================================================================
+func (t *SimpleChaincode) load_fixture(stub shim.ChaincodeStubInterface, fixture Fixture) (FixtureResult, error) {
+	result := FixtureResult{}
+
+	load := func(kind string, id string, ledgerId string, loader func(stub shim.ChaincodeStubInterface) error) error {
+		record := FixtureRecordResult{Kind: kind, Id: id, LedgerId: ledgerId, Status: "Loaded"}
+		savedExpNumber, savedReimbNumber := expNumber, reimbNumber
+		recordStub := new_staging_stub(stub)
+		err := loader(recordStub)
+		if err == nil {
+			err = recordStub.flush()
+			if err != nil {
+				return err
+			}
+			result.Loaded++
+		} else {
+			expNumber, reimbNumber = savedExpNumber, savedReimbNumber
+			record.LedgerId = ""
+			record.Status = "Failed"
+			record.Error = err.Error()
+			result.Failed++
+		}
+		result.Records = append(result.Records, record)
+		return nil
+	}
+
+	for i := 0; i < len(fixture.Actors); i++ {
+		actor := fixture.Actors[i]
+		err := load("actor", actor.ActorId, actor.ActorId, func(stub shim.ChaincodeStubInterface) error {
+			_, err := t.Init_actor(stub, []string{actor.ActorId, actor.ActorName, "0", "0", "0", "0", "0", "0"})
+			return err
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+
+	for i := 0; i < len(fixture.Awards); i++ {
+		award := fixture.Awards[i]
+		err := load("award", award.AwardId, award.AwardId, func(stub shim.ChaincodeStubInterface) error {
+			return t.load_fixture_award(stub, award)
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+
+	for i := 0; i < len(fixture.Suppliers); i++ {
+		supplier := fixture.Suppliers[i]
+		err := load("supplier", supplier.ActorId, supplier.ActorId, func(stub shim.ChaincodeStubInterface) error {
+			return t.load_fixture_supplier(stub, supplier)
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+
+	// the ledger id of every expenditure of the fixture, empty for the ones that failed
+	expIds := map[string]string{}
+	for i := 0; i < len(fixture.Expenditures); i++ {
+		oneExp := fixture.Expenditures[i]
+		fixtureId := oneExp.ExpenditureId
+		oneExp.ExpenditureId = next_expenditure_id()
+		err := load("expenditure", fixtureId, oneExp.ExpenditureId, func(stub shim.ChaincodeStubInterface) error {
+			return t.load_fixture_expenditure(stub, oneExp)
+		})
+		if err != nil {
+			return result, err
+		}
+		expIds[fixtureId] = result.Records[len(result.Records)-1].LedgerId
+	}
+
+	for i := 0; i < len(fixture.Reimbursements); i++ {
+		oneRem := fixture.Reimbursements[i]
+		fixtureId := oneRem.ReimbursementId
+		oneRem.ReimbursementId = next_reimbursement_id()
+		ledgerExpId, inFixture := expIds[oneRem.ExpenditureId]
+		err := load("reimbursement", fixtureId, oneRem.ReimbursementId, func(stub shim.ChaincodeStubInterface) error {
+			if inFixture && len(ledgerExpId) <= 0 {
+				return errors.New("Reimbursement " + fixtureId + " refers to expenditure " + oneRem.ExpenditureId + " which is not loaded")
+			}
+			if inFixture {
+				oneRem.ExpenditureId = ledgerExpId
+			}
+			return t.load_fixture_reimbursement(stub, oneRem)
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// ============================================================================================================================
+// load_fixture_award - create an award of a fixture, its grantor and grantee must exist
+// ============================================================================================================================
+func (t *SimpleChaincode) load_fixture_award(stub shim.ChaincodeStubInterface, award Award) error {
+	err := fixture_actor_exists(stub, award.GrantorId)
+	if err != nil {
+		return err
+	}
+	err = fixture_actor_exists(stub, award.GranteeId)
+	if err != nil {
+		return err
+	}
+
+	args := []string{award.AwardId, award.GrantorId, award.GranteeId, award.Amount, award.Currency}
+	if len(award.ParentAwardId) > 0 || len(award.StartDate) > 0 {
+		args = append(args, award.ParentAwardId)
+	}
+	if len(award.StartDate) > 0 {
+		args = append(args, award.StartDate, award.EndDate, award.LiquidationDays)
+	}
+	_, err = t.CreateAward(stub, args)
+	return err
+}
+
+// ============================================================================================================================
+// load_fixture_supplier - register a supplier of a fixture with the status the fixture gives it
+// ============================================================================================================================
+func (t *SimpleChaincode) load_fixture_supplier(stub shim.ChaincodeStubInterface, supplier Supplier) error {
+	err := fixture_actor_exists(stub, supplier.ActorId)
+	if err != nil {
+		return err
+	}
+	if !valid_sha256(supplier.TaxIdHash) {
+		return errors.New("Supplier " + supplier.ActorId + " must carry the hex SHA-256 hash of its tax id")
+	}
+	if supplier.Status != "Unverified" && supplier.Status != "Verified" && supplier.Status != "Rejected" {
+		return errors.New("Supplier " + supplier.ActorId + " must be Unverified, Verified or Rejected")
+	}
+	_, err = t.get_supplier(stub, supplier.ActorId)
+	if err == nil {
+		return errors.New("Supplier " + supplier.ActorId + " is already registered")
+	}
+
+	supplier.SupplierId = supplier_key(supplier.ActorId)
+	return t.put_supplier(stub, supplier, true)
+}
+
+// ============================================================================================================================
+// load_fixture_expenditure - create an expenditure of a fixture, charge it to the spender's award and post the spend
+// ============================================================================================================================
+func (t *SimpleChaincode) load_fixture_expenditure(stub shim.ChaincodeStubInterface, oneExp Expenditure) error {
+	err := fixture_actor_exists(stub, oneExp.FromActor)
+	if err != nil {
+		return err
+	}
+	err = fixture_actor_exists(stub, oneExp.ToActor)
+	if err != nil {
+		return err
+	}
+	if oneExp.Status != "Approved" && oneExp.Status != "Pending" {
+		return errors.New("Expenditure " + oneExp.ExpenditureId + " must be Approved or Pending")
+	}
+	amount, err := strconv.ParseFloat(oneExp.Amount, 64)
+	if err != nil || amount <= 0 {
+		return errors.New("Expenditure " + oneExp.ExpenditureId + " must have a positive numeric amount")
+	}
+	expDate, err := time.Parse(dateFormat, oneExp.Date)
+	if err != nil {
+		return errors.New("Expenditure " + oneExp.ExpenditureId + " date must be formatted " + dateFormat)
+	}
+	award, err := t.find_award(stub, oneExp.FromActor, oneExp.AwardId)
+	if err != nil {
+		return err
+	}
+	if len(award.AwardId) <= 0 {
+		return errors.New(oneExp.FromActor + " has no award to charge " + oneExp.ExpenditureId + " to")
+	}
+
+	// a fixture records past spending, so the expense counts as submitted on its own date
+	err = check_award_period(award, oneExp.Date, expDate)
+	if err != nil {
+		return err
+	}
+
+	if len(oneExp.InvoiceNumber) > 0 {
+		err = t.check_invoice(stub, oneExp.ToActor, oneExp.InvoiceNumber)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = t.init_expenditure(stub, []string{oneExp.ExpenditureId, oneExp.Amount, oneExp.Date, oneExp.Type, oneExp.Status, oneExp.FromActor, oneExp.ToActor})
+	if err != nil {
+		return err
+	}
+	_, err = t.Transfer_balance(stub, []string{oneExp.FromActor, oneExp.ToActor, oneExp.Amount, "spend", oneExp.ExpenditureId})
+	if err != nil {
+		return err
+	}
+
+	newExp, err := t.get_expenditure(stub, oneExp.ExpenditureId)
+	if err != nil {
+		return err
+	}
+	newExp.AwardId = award.AwardId
+	newExp.Currency = award.Currency
+	newExp.InvoiceNumber = oneExp.InvoiceNumber
+	newExp.InvoiceDate = oneExp.InvoiceDate
+	newExp.VendorRef = oneExp.VendorRef
+	err = t.put_expenditure(stub, newExp)
+	if err != nil {
+		return err
+	}
+	err = t.register_payment(stub, newExp)
+	if err != nil {
+		return err
+	}
+	if len(oneExp.InvoiceNumber) > 0 {
+		return t.register_invoice(stub, oneExp.ToActor, oneExp.InvoiceNumber, oneExp.ExpenditureId)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// load_fixture_reimbursement - create a reimbursement of a fixture and post the payment, it must be paid by the grantor
+// of the expenditure's award to the spender
+// ============================================================================================================================
+func (t *SimpleChaincode) load_fixture_reimbursement(stub shim.ChaincodeStubInterface, oneRem Reimbursement) error {
+	oneExp, err := t.get_expenditure(stub, oneRem.ExpenditureId)
+	if err != nil {
+		return errors.New("Reimbursement " + oneRem.ReimbursementId + " refers to expenditure " + oneRem.ExpenditureId + " which is not loaded")
+	}
+	if oneExp.Status == "Pending" {
+		return errors.New("Reimbursement " + oneRem.ReimbursementId + " pays " + oneExp.ExpenditureId + " which is still pending")
+	}
+	award, err := t.get_award(stub, oneExp.AwardId)
+	if err != nil {
+		return err
+	}
+	if oneRem.FromActor != award.GrantorId || oneRem.ToActor != oneExp.FromActor {
+		return errors.New("Reimbursement " + oneRem.ReimbursementId + " must be paid by " + award.GrantorId + " to " + oneExp.FromActor)
+	}
+	_, err = time.Parse(dateFormat, oneRem.Date)
+	if err != nil {
+		return errors.New("Reimbursement " + oneRem.ReimbursementId + " date must be formatted " + dateFormat)
+	}
+
+	// the paid and disallowed amounts add up to the expense, as approve_expenditure requires
+	requested, err := strconv.ParseFloat(oneExp.Amount, 64)
+	if err != nil {
+		return errors.New("Expenditure " + oneExp.ExpenditureId + " has a non-numeric amount")
+	}
+	approved, err := strconv.ParseFloat(oneRem.Amount, 64)
+	if err != nil || approved < 0 {
+		return errors.New("Reimbursement " + oneRem.ReimbursementId + " must have a non-negative numeric amount")
+	}
+	disallowed := 0.0
+	if len(oneRem.DisallowedAmount) > 0 {
+		disallowed, err = strconv.ParseFloat(oneRem.DisallowedAmount, 64)
+		if err != nil || disallowed < 0 {
+			return errors.New("Reimbursement " + oneRem.ReimbursementId + " must have a non-negative numeric disallowed amount")
+		}
+	}
+	if len(oneRem.RequestedAmount) > 0 {
+		asked, err := strconv.ParseFloat(oneRem.RequestedAmount, 64)
+		if err != nil || math.Abs(asked-requested) > 0.000001 {
+			return errors.New("Reimbursement " + oneRem.ReimbursementId + " requests " + oneRem.RequestedAmount + " but " + oneExp.ExpenditureId + " is " + oneExp.Amount)
+		}
+	}
+	if math.Abs(approved+disallowed-requested) > 0.000001 {
+		return errors.New("Reimbursement " + oneRem.ReimbursementId + " paid and disallowed amounts must add up to " + oneExp.Amount + " for " + oneExp.ExpenditureId)
+	}
+	if disallowed > 0 && len(oneRem.ReasonCode) <= 0 {
+		return errors.New("A reason code is required to disallow costs on " + oneExp.ExpenditureId)
+	}
+
+	args := []string{oneRem.ReimbursementId, oneRem.Amount, oneRem.FromActor, oneRem.ToActor, oneRem.Date, oneRem.ExpenditureId}
+	if len(oneRem.RequestedAmount) > 0 {
+		args = append(args, oneRem.RequestedAmount, oneRem.DisallowedAmount, oneRem.ReasonCode)
+	}
+	_, err = t.init_reimbursement(stub, args)
+	if err != nil {
+		return err
+	}
+	_, err = t.Transfer_balance(stub, []string{oneRem.FromActor, oneRem.ToActor, oneRem.Amount, "fund", oneRem.ReimbursementId})
+	return err
+}
+
+// ============================================================================================================================
+// fixture_actor_exists - refuse a fixture record that refers to an actor that is not loaded
+// ============================================================================================================================
+func fixture_actor_exists(stub shim.ChaincodeStubInterface, actorId string) error {
+	actorAsBytes, err := stub.GetState(actorId)
+	if err != nil {
+		return errors.New("Failed to get actor " + actorId)
+	}
+	actor := Actor{}
+	json.Unmarshal(actorAsBytes, &actor)
+	if actor.ActorId != actorId || len(actorId) <= 0 {
+		return errors.New("Actor " + actorId + " is not loaded")
+	}
+	return nil
+}
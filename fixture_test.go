@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFixtureIdsDoNotCollideWithTheLedger(t *testing.T) {
+	cc, m := setup(t)
+	m.attrs["role"] = "admin"
+
+	// EXP-201 and REM-301 are already on the ledger, the fixture records get the next ids instead
+	f := `{"expenditures":[{"expenditureid":"EXP-201","amount":"50","date":"2017-07-01","type":"Travel","status":"Approved","fromactor":"ACT-102","toactor":"ACT-104"}],
+	"reimbursements":[{"reimbursementid":"REM-301","amount":"50","fromactor":"ACT-101","toactor":"ACT-102","date":"2017-07-02","expenditureid":"EXP-201"}]}`
+	r := must(t)(cc.Invoke(m, "loadfixture", []string{f}))
+	if !strings.Contains(r, `{"kind":"expenditure","id":"EXP-201","ledgerid":"EXP-210","status":"Loaded"`) || !strings.Contains(r, `{"kind":"reimbursement","id":"REM-301","ledgerid":"REM-308","status":"Loaded"`) {
+		t.Fatal(r)
+	}
+
+	exp := must(t)(cc.Query(m, "read", []string{"EXP-201"}))
+	if !strings.Contains(exp, `"amount":"3000"`) {
+		t.Fatal(exp)
+	}
+	rem := must(t)(cc.Query(m, "read", []string{"REM-308"}))
+	if !strings.Contains(rem, `"expenditureid":"EXP-210"`) {
+		t.Fatal(rem)
+	}
+	must(t)(cc.Invoke(m, "spend", []string{"ACT-102", "ACT-104", "20", "Travel"}))
+	exp = must(t)(cc.Query(m, "read", []string{"EXP-211"}))
+	if !strings.Contains(exp, `"amount":"20"`) {
+		t.Fatal(exp)
+	}
+}
+
+func TestOnlyAnAdminSetsUpTheDemo(t *testing.T) {
+	expNumber, reimbNumber = 0, 0
+	cc := new(SimpleChaincode)
+	m := newMock()
+	must(t)(cc.Init(m, "init", []string{"1"}))
+
+	m.attrs["actorid"] = "ACT-101"
+	_, err := cc.Invoke(m, "setup", nil)
+	fails(t, nil, err, "Only an admin can load the demo fixture")
+	if m.state["ACT-101"] != nil {
+		t.Fatal("the demo was loaded")
+	}
+}
+
+func TestFixtureRecordsAreCheckedLikeSpends(t *testing.T) {
+	cc, m := setup(t)
+	m.attrs["role"] = "admin"
+
+	f := `{"expenditures":[{"expenditureid":"EXP-501","amount":"50","date":"2017-7-1","type":"Travel","status":"Approved","fromactor":"ACT-102","toactor":"ACT-104"},
+	{"expenditureid":"EXP-502","amount":"50","date":"2016-12-31","type":"Travel","status":"Approved","fromactor":"ACT-102","toactor":"ACT-104"},
+	{"expenditureid":"EXP-503","amount":"50","date":"2017-07-01","type":"Travel","status":"Approved","fromactor":"ACT-102","toactor":"ACT-104"}],
+	"reimbursements":[{"reimbursementid":"REM-501","amount":"500","fromactor":"ACT-101","toactor":"ACT-102","date":"2017-07-02","expenditureid":"EXP-503"},
+	{"reimbursementid":"REM-502","amount":"40","fromactor":"ACT-101","toactor":"ACT-102","date":"2017-07-02","expenditureid":"EXP-503","requestedamount":"50","disallowedamount":"10"},
+	{"reimbursementid":"REM-503","amount":"40","fromactor":"ACT-101","toactor":"ACT-102","date":"2017-07-02","expenditureid":"EXP-503","requestedamount":"50","disallowedamount":"10","reasoncode":"AUDIT"}]}`
+	r := must(t)(cc.Invoke(m, "loadfixture", []string{f}))
+	for _, text := range []string{
+		`"id":"EXP-501","ledgerid":"","status":"Failed","error":"Expenditure EXP-210 date must be formatted 2006-01-02"`,
+		`"id":"EXP-502","ledgerid":"","status":"Failed","error":"Expenditure date 2016-12-31 is outside the period of AWD-401`,
+		`"id":"EXP-503","ledgerid":"EXP-210","status":"Loaded"`,
+		`"id":"REM-501","ledgerid":"","status":"Failed","error":"Reimbursement REM-308 paid and disallowed amounts must add up to 50 for EXP-210"`,
+		`"id":"REM-502","ledgerid":"","status":"Failed","error":"A reason code is required to disallow costs on EXP-210"`,
+		`"id":"REM-503","ledgerid":"REM-308","status":"Loaded"`,
+	} {
+		if !strings.Contains(r, text) {
+			t.Fatal(text, r)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Spend-rate forecast - when an award will run out of money at the rate its grantee spends it. The spend history is
+//						  every expenditure charged to the award that was not disallowed, compensating records included,
+//						  totalled per month from the start of the award (or its first expense) to today.
+//
+//	Burn rate  - the average spend per month over that history
+//	Trend      - the least-squares slope of the monthly totals, how much the burn rate grows or shrinks each month
+//	Exhaustion - the day the remaining amount, what is neither passed on in sub-awards nor spent, is used up at the
+//				 burn rate
+//	Plan       - an award with a start and an end date is planned to be spent in a straight line, the grantee is
+//				 over- or under-spending when its spend is more than the tolerance (10% by default) off the plan
+//==============================================================================================================================
+
+// spend of an award in one month (month as 2017-08, amount)
+type MonthlySpend struct {
+	Month  string `json:"month"`
+	Amount string `json:"amount"`
+}
+
+type SpendForecast struct {
+	AwardId           string         `json:"awardid"`
+	GranteeId         string         `json:"granteeid"`
+	Amount            string         `json:"amount"`
+	Spent             string         `json:"spent"`
+	Remaining         string         `json:"remaining"`
+	StartDate         string         `json:"startdate"`
+	EndDate           string         `json:"enddate"`
+	AsOf              string         `json:"asof"`
+	Months            []MonthlySpend `json:"months"`
+	BurnRate          string         `json:"burnrate"`
+	Trend             string         `json:"trend"`
+	ExhaustionDate    string         `json:"exhaustiondate"`
+	ExhaustsBeforeEnd bool           `json:"exhaustsbeforeend"`
+	PlannedSpent      string         `json:"plannedspent"`
+	SpendRatio        string         `json:"spendratio"`
+	Flag              string         `json:"flag"`
+}
+
+var daysPerMonth = 365.25 / 12 // Average length of a month when projecting an exhaustion date
+
+// ============================================================================================================================
+// Query Function - Called when query the spend-rate forecast of one award or every award the caller sees
+// Function: compute the monthly burn rate and trend of the award, project its exhaustion date and compare its spend
+// with a straight-line plan
+// Query
+// ============================================================================================================================
+func (t *SimpleChaincode) QueryForecast(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//      0              1
+	// [award id]  [tolerance, e.g. 0.1]
+
+	if len(args) > 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0 to 2")
+	}
+	tolerance := 0.1
+	if len(args) > 1 && len(args[1]) > 0 {
+		var err error
+		tolerance, err = strconv.ParseFloat(args[1], 64)
+		if err != nil || tolerance < 0 {
+			return nil, errors.New("2nd argument must be the tolerance as a fraction, e.g. 0.1")
+		}
+	}
+	current_time, err := tx_time(stub)
+	if err != nil {
+		return nil, err
+	}
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var awards []Award
+	if len(args) > 0 && len(args[0]) > 0 {
+		award, err := t.get_award(stub, args[0])
+		if err != nil {
+			return nil, err
+		}
+		if !view.can_see(award.GrantorId, award.GranteeId) {
+			return nil, errors.New("Award " + args[0] + " does not exist")
+		}
+		awards = append(awards, award)
+	} else {
+		all, err := t.get_awards(stub)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < len(all); i++ {
+			if view.can_see(all[i].GrantorId, all[i].GranteeId) {
+				awards = append(awards, all[i])
+			}
+		}
+	}
+
+	expsIndexAsBytes, err := stub.GetState(expIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get expenditure index")
+	}
+	var expIndex []string
+	json.Unmarshal(expsIndexAsBytes, &expIndex)
+	var expenses []Expenditure
+	for i := 0; i < len(expIndex); i++ {
+		oneExp, err := t.get_expenditure(stub, expIndex[i])
+		if err != nil {
+			return nil, err
+		}
+		if len(oneExp.AwardId) > 0 && oneExp.Status != "Disallowed" {
+			expenses = append(expenses, oneExp)
+		}
+	}
+
+	var result []SpendForecast
+	for i := 0; i < len(awards); i++ {
+		remaining, err := t.award_remaining(stub, awards[i])
+		if err != nil {
+			return nil, err
+		}
+		forecast, err := forecast_award(awards[i], expenses, remaining, current_time, tolerance)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, forecast)
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+
+	return resultAsBytes, nil
+}
+
+// ============================================================================================================================
+// forecast_award - the burn rate, trend, exhaustion date and plan comparison of one award with the amount remaining on it
+// as of a day
+// ============================================================================================================================
+func forecast_award(award Award, expenses []Expenditure, remaining float64, asOf time.Time, tolerance float64) (SpendForecast, error) {
+	forecast := SpendForecast{AwardId: award.AwardId, GranteeId: award.GranteeId, Amount: award.Amount, StartDate: award.StartDate, EndDate: award.EndDate, AsOf: asOf.Format(dateFormat)}
+	amount, err := strconv.ParseFloat(award.Amount, 64)
+	if err != nil {
+		return forecast, errors.New("Award " + award.AwardId + " has a non-numeric amount")
+	}
+
+	// monthly totals of the award's expenses up to today
+	first := award.StartDate
+	perMonth := map[string]float64{}
+	spent := 0.0
+	for i := 0; i < len(expenses); i++ {
+		if expenses[i].AwardId != award.AwardId {
+			continue
+		}
+		expDate, err := time.Parse(dateFormat, expenses[i].Date)
+		if err != nil {
+			return forecast, errors.New("Expenditure " + expenses[i].ExpenditureId + " date is not formatted as " + dateFormat)
+		}
+		if expDate.After(asOf) {
+			continue
+		}
+		expAmount, err := strconv.ParseFloat(expenses[i].Amount, 64)
+		if err != nil {
+			return forecast, errors.New("Expenditure " + expenses[i].ExpenditureId + " has a non-numeric amount")
+		}
+		spent += expAmount
+		perMonth[expDate.Format("2006-01")] += expAmount
+		if len(first) <= 0 || expenses[i].Date < first {
+			first = expenses[i].Date
+		}
+	}
+	forecast.Spent = format_amount(spent)
+	forecast.Remaining = format_amount(remaining)
+
+	var totals []float64
+	if len(first) > 0 {
+		start, err := time.Parse(dateFormat, first)
+		if err != nil {
+			return forecast, errors.New("Award " + award.AwardId + " start date is not formatted as " + dateFormat)
+		}
+		for month := time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.UTC); month.Format("2006-01") <= forecast.AsOf[:7]; month = month.AddDate(0, 1, 0) {
+			key := month.Format("2006-01")
+			forecast.Months = append(forecast.Months, MonthlySpend{Month: key, Amount: format_amount(perMonth[key])})
+			totals = append(totals, perMonth[key])
+		}
+	}
+
+	burnRate, trend := burn_rate(totals)
+	forecast.BurnRate = format_amount(burnRate)
+	forecast.Trend = format_amount(trend)
+	if remaining <= 0 {
+		forecast.ExhaustionDate = forecast.AsOf
+	} else if burnRate > 0 {
+		days := int(math.Ceil(remaining / burnRate * daysPerMonth))
+		forecast.ExhaustionDate = asOf.AddDate(0, 0, days).Format(dateFormat)
+	}
+	forecast.ExhaustsBeforeEnd = len(forecast.ExhaustionDate) > 0 && len(award.EndDate) > 0 && forecast.ExhaustionDate < award.EndDate
+
+	// the straight-line plan needs both ends of the award
+	if len(award.StartDate) <= 0 || len(award.EndDate) <= 0 {
+		forecast.Flag = "noplan"
+		return forecast, nil
+	}
+	start, err := time.Parse(dateFormat, award.StartDate)
+	if err != nil {
+		return forecast, errors.New("Award " + award.AwardId + " start date is not formatted as " + dateFormat)
+	}
+	end, err := time.Parse(dateFormat, award.EndDate)
+	if err != nil {
+		return forecast, errors.New("Award " + award.AwardId + " end date is not formatted as " + dateFormat)
+	}
+	duration := end.Sub(start).Hours()
+	elapsed := math.Min(math.Max(asOf.Sub(start).Hours(), 0), duration)
+	planned := 0.0
+	if duration > 0 {
+		planned = math.Round(amount*elapsed/duration*100) / 100
+	}
+	forecast.PlannedSpent = format_amount(planned)
+
+	if planned <= 0 {
+		forecast.Flag = "ontrack"
+		if spent > 0 {
+			forecast.Flag = "overspending"
+		}
+		return forecast, nil
+	}
+	ratio := spent / planned
+	forecast.SpendRatio = strconv.FormatFloat(math.Round(ratio*100)/100, 'f', -1, 64)
+	if ratio > 1+tolerance {
+		forecast.Flag = "overspending"
+	} else if ratio < 1-tolerance {
+		forecast.Flag = "underspending"
+	} else {
+		forecast.Flag = "ontrack"
+	}
+	return forecast, nil
+}
+
+// ============================================================================================================================
+// burn_rate - the average of monthly totals and the least-squares slope through them, both rounded to cents
+// ============================================================================================================================
+func burn_rate(totals []float64) (float64, float64) {
+	n := float64(len(totals))
+	if n <= 0 {
+		return 0, 0
+	}
+	var sumX, sumY, sumXY, sumXX float64
+	for i := 0; i < len(totals); i++ {
+		x := float64(i)
+		sumX += x
+		sumY += totals[i]
+		sumXY += x * totals[i]
+		sumXX += x * x
+	}
+	average := math.Round(sumY/n*100) / 100
+	if n < 2 {
+		return average, 0
+	}
+	slope := (n*sumXY - sumX*sumY) / (n*sumXX - sumX*sumX)
+	return average, math.Round(slope*100) / 100
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestForecastRefusesAnUnreadableExpenseDate(t *testing.T) {
+	cc, m := setup(t)
+	m.attrs["role"] = "admin"
+
+	m.state["EXP-201"] = []byte(strings.Replace(string(m.state["EXP-201"]), `"date":"2017-08-18"`, `"date":"2017"`, 1))
+	_, err := cc.Query(m, "queryforecast", []string{"AWD-401"})
+	fails(t, nil, err, "Expenditure EXP-201 date is not formatted as 2006-01-02")
+}
+
+func TestForecastLeavesOutTheFundsPassedToSubAwards(t *testing.T) {
+	cc, m := setup(t)
+	m.attrs["role"] = "admin"
+
+	// AWD-401 passed 45000 of its 125000 on to AWD-402 and its grantee charged 23000 to it
+	r := must(t)(cc.Query(m, "queryforecast", []string{"AWD-401"}))
+	if !strings.Contains(r, `"remaining":"57000"`) {
+		t.Fatal(r)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	FX rates - exchange rates are posted on the ledger by a single designated rate-provider actor, one rate per
+//			   currency pair and date, stored under "FX-<from>-<to>-<date>". An expense is converted at the latest rate
+//			   posted on or before its date.
+//==============================================================================================================================
+
+// fx rate (from currency, to currency, rate, date, posted by); 1 FromCurrency = Rate ToCurrency
+type FxRate struct {
+	FromCurrency string `json:"fromcurrency"`
+	ToCurrency   string `json:"tocurrency"`
+	Rate         string `json:"rate"`
+	Date         string `json:"date"`
+	PostedBy     string `json:"postedby"`
+}
+
+var fxProviderStr = "_fxprovider" // Define a variable to hold the actor id allowed to post exchange rates
+
+// ============================================================================================================================
+// SetFxProvider Function - Called by an admin to designate the actor that posts exchange rates
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) SetFxProvider(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//      0
+	// "actor id"
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+	if !t.caller_has_role(stub, "admin") {
+		return nil, errors.New("Only an admin can designate the rate provider")
+	}
+
+	actorAsBytes, err := stub.GetState(args[0])
+	if err != nil {
+		return nil, errors.New("Failed to get actor")
+	}
+	actor := Actor{}
+	json.Unmarshal(actorAsBytes, &actor)
+	if actor.ActorId != args[0] {
+		return nil, errors.New("Actor " + args[0] + " does not exist")
+	}
+
+	err = stub.PutState(fxProviderStr, []byte(args[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// ============================================================================================================================
+// PostFxRate Function - Called by the rate provider to publish the rate of a currency pair for a date
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) PostFxRate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//       0                1            2        3
+	// "from currency"  "to currency"  "rate"   "date"
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+
+	providerAsBytes, err := stub.GetState(fxProviderStr)
+	if err != nil {
+		return nil, errors.New("Failed to get rate provider")
+	}
+	callerId, err := t.get_caller_actor(stub)
+	if err != nil {
+		return nil, err
+	}
+	if len(providerAsBytes) <= 0 || callerId != string(providerAsBytes) {
+		return nil, errors.New(callerId + " is not the designated rate provider")
+	}
+
+	if !valid_currency(args[0]) {
+		return nil, errors.New("1st argument must be a 3 letter currency code")
+	}
+	if !valid_currency(args[1]) || args[1] == args[0] {
+		return nil, errors.New("2nd argument must be a different 3 letter currency code")
+	}
+	rate, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || rate <= 0 {
+		return nil, errors.New("3rd argument must be a positive numeric string")
+	}
+	_, err = time.Parse(dateFormat, args[3])
+	if err != nil {
+		return nil, errors.New("4th argument must be a date formatted " + dateFormat)
+	}
+
+	// a posted rate may already have been used, so it is never overwritten
+	key := fx_key(args[0], args[1], args[3])
+	rateAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Failed to get exchange rate")
+	}
+	if len(rateAsBytes) > 0 {
+		return nil, errors.New("A " + args[0] + "/" + args[1] + " rate has already been posted for " + args[3])
+	}
+
+	fxRate := FxRate{}
+	fxRate.FromCurrency = args[0]
+	fxRate.ToCurrency = args[1]
+	fxRate.Rate = strconv.FormatFloat(rate, 'f', -1, 64)
+	fxRate.Date = args[3]
+	fxRate.PostedBy = callerId
+
+	rateAsBytes, _ = json.Marshal(fxRate)
+	err = stub.PutState(key, rateAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Query Function - Called when query the exchange rate that applies to a date
+// Query
+// ============================================================================================================================
+func (t *SimpleChaincode) QueryFxRate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//       0                1            2
+	// "from currency"  "to currency"   "date"
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	fxRate, err := t.get_fx_rate(stub, args[0], args[1], args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	rateAsBytes, _ := json.Marshal(fxRate)
+
+	return rateAsBytes, nil
+}
+
+// ============================================================================================================================
+// get_fx_rate - the latest rate posted on or before a date, derived from the reverse pair when only that was posted
+// ============================================================================================================================
+func (t *SimpleChaincode) get_fx_rate(stub shim.ChaincodeStubInterface, from string, to string, date string) (FxRate, error) {
+	fxRate, err := t.latest_fx_rate(stub, from, to, date)
+	if err != nil {
+		return fxRate, err
+	}
+	if len(fxRate.Rate) > 0 {
+		return fxRate, nil
+	}
+
+	inverse, err := t.latest_fx_rate(stub, to, from, date)
+	if err != nil {
+		return fxRate, err
+	}
+	if len(inverse.Rate) > 0 {
+		rate, err := strconv.ParseFloat(inverse.Rate, 64)
+		if err != nil || rate <= 0 {
+			return fxRate, errors.New("Stored " + to + "/" + from + " rate is not numeric")
+		}
+		fxRate = inverse
+		fxRate.FromCurrency = from
+		fxRate.ToCurrency = to
+		fxRate.Rate = strconv.FormatFloat(1/rate, 'f', -1, 64)
+		return fxRate, nil
+	}
+
+	return fxRate, errors.New("No " + from + "/" + to + " rate has been posted on or before " + date)
+}
+
+// ============================================================================================================================
+// latest_fx_rate - the rate of one pair with the latest date not after the given date, empty if there is none
+// ============================================================================================================================
+func (t *SimpleChaincode) latest_fx_rate(stub shim.ChaincodeStubInterface, from string, to string, date string) (FxRate, error) {
+	fxRate := FxRate{}
+
+	keysIter, err := stub.RangeQueryState(fx_key(from, to, ""), fx_key(from, to, date)+"~")
+	if err != nil {
+		return fxRate, errors.New("Failed to get exchange rates")
+	}
+	defer keysIter.Close()
+
+	// keys sort by date, so the last one wins
+	for keysIter.HasNext() {
+		_, rateAsBytes, err := keysIter.Next()
+		if err != nil {
+			return fxRate, errors.New("Failed to get exchange rates")
+		}
+		json.Unmarshal(rateAsBytes, &fxRate)
+	}
+
+	return fxRate, nil
+}
+
+// ============================================================================================================================
+// convert_amount - convert an amount in one currency into another at the rate for a date
+// No currency, or the same currency, means no conversion. An expense outside any award has no currency to convert into.
+// ============================================================================================================================
+func (t *SimpleChaincode) convert_amount(stub shim.ChaincodeStubInterface, amount float64, from string, to string, date string) (float64, FxRate, error) {
+	if len(from) <= 0 || from == to {
+		return amount, FxRate{FromCurrency: to, ToCurrency: to, Rate: "1", Date: date}, nil
+	}
+	if !valid_currency(from) {
+		return 0, FxRate{}, errors.New("Currency must be a 3 letter currency code")
+	}
+	if len(to) <= 0 {
+		return 0, FxRate{}, errors.New("An expense in " + from + " must be charged to an award to be converted")
+	}
+
+	fxRate, err := t.get_fx_rate(stub, from, to, date)
+	if err != nil {
+		return 0, fxRate, err
+	}
+	rate, err := strconv.ParseFloat(fxRate.Rate, 64)
+	if err != nil {
+		return 0, fxRate, errors.New("Stored " + from + "/" + to + " rate is not numeric")
+	}
+
+	// converted amounts are kept to the cent
+	return math.Round(amount*rate*100) / 100, fxRate, nil
+}
+
+// ============================================================================================================================
+// fx_key - the world state key of the rate of a currency pair on a date
+// ============================================================================================================================
+func fx_key(from string, to string, date string) string {
+	return "FX-" + from + "-" + to + "-" + date
+}
+
+// ============================================================================================================================
+// valid_currency - whether a string is a 3 letter upper case currency code such as USD
+// ============================================================================================================================
+func valid_currency(currency string) bool {
+	if len(currency) != 3 {
+		return false
+	}
+	for i := 0; i < len(currency); i++ {
+		if currency[i] < 'A' || currency[i] > 'Z' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Identity - callers are bound to actors through the attributes of their enrollment certificate: "actorid" names
+//			   the actor the caller acts for and "role" grants chaincode-wide rights such as "admin".
+//
+//	Visibility - what queries return to a caller. A caller sees the records of its own actor and of every grantee
+//				 below it in the award tree: a grantor its portfolio, a grantee its sub-grantees, a supplier only
+//				 the payments made to it. A record is visible when any actor it names is, records naming no actor
+//				 (fx rates) are visible to all, and an admin or an "auditor" sees everything. State that is not a
+//				 record, such as the indexes listing the ids, amounts and invoice numbers of every actor and the
+//				 settings, is only read by an admin or an auditor. Every invoke is refused to an auditor, so an auditor only
+//				 reads. Hidden records are left out of results, and a hidden record asked for by id reads as if it
+//				 did not exist.
+//==============================================================================================================================
+
+// the actors whose records a caller may see, every actor if all is set
+type visibility struct {
+	all    bool
+	actors map[string]bool
+}
+
+// ============================================================================================================================
+// get_caller_actor - the actor id the caller's certificate is bound to
+// ============================================================================================================================
+func (t *SimpleChaincode) get_caller_actor(stub shim.ChaincodeStubInterface) (string, error) {
+	actorId, err := stub.ReadCertAttribute("actorid")
+	if err != nil || len(actorId) <= 0 {
+		return "", errors.New("Caller certificate is not bound to an actor")
+	}
+	return string(actorId), nil
+}
+
+// ============================================================================================================================
+// caller_has_role - whether the caller's certificate carries the given role
+// ============================================================================================================================
+func (t *SimpleChaincode) caller_has_role(stub shim.ChaincodeStubInterface, role string) bool {
+	ok, err := stub.VerifyAttribute("role", []byte(role))
+	return err == nil && ok
+}
+
+// ============================================================================================================================
+// caller_visibility - the caller's actor and the grantees below it through the awards, a caller bound to no actor sees
+// no actor's records
+// ============================================================================================================================
+func (t *SimpleChaincode) caller_visibility(stub shim.ChaincodeStubInterface) (visibility, error) {
+	view := visibility{actors: map[string]bool{}}
+	if t.caller_has_role(stub, "admin") || t.caller_has_role(stub, "auditor") {
+		view.all = true
+		return view, nil
+	}
+	callerId, err := t.get_caller_actor(stub)
+	if err != nil {
+		return view, nil
+	}
+	view.actors[callerId] = true
+
+	awards, err := t.get_awards(stub)
+	if err != nil {
+		return view, err
+	}
+	for grown := true; grown; {
+		grown = false
+		for i := 0; i < len(awards); i++ {
+			if view.actors[awards[i].GrantorId] && !view.actors[awards[i].GranteeId] {
+				view.actors[awards[i].GranteeId] = true
+				grown = true
+			}
+		}
+	}
+	return view, nil
+}
+
+// ============================================================================================================================
+// can_see - whether any of the actors a record names is visible
+// ============================================================================================================================
+func (view visibility) can_see(actorIds ...string) bool {
+	if view.all {
+		return true
+	}
+	for i := 0; i < len(actorIds); i++ {
+		if view.actors[actorIds[i]] {
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================================================================================
+// can_see_record - whether a stored record is visible, judged by the actors it names. The indexes and settings, stored
+// under keys starting with an underscore, are not records.
+// ============================================================================================================================
+func (view visibility) can_see_record(key string, recordAsBytes []byte) bool {
+	if view.all || len(recordAsBytes) <= 0 {
+		return true
+	}
+	if strings.HasPrefix(key, "_") {
+		return false
+	}
+
+	type partyRecord struct {
+		ActorId     string `json:"actorid"`
+		FromActor   string `json:"fromactor"`
+		ToActor     string `json:"toactor"`
+		GrantorId   string `json:"grantorid"`
+		GranteeId   string `json:"granteeid"`
+		ApproverId  string `json:"approverid"`
+		DelegateId  string `json:"delegateid"`
+		RecipientId string `json:"recipientid"`
+		CallerId    string `json:"callerid"`
+		Lines       []struct {
+			ActorId string `json:"actorid"`
+		} `json:"lines"`
+	}
+
+	record := partyRecord{}
+	err := json.Unmarshal(recordAsBytes, &record)
+	if err != nil {
+		// not a JSON object, so naming no actor it could be judged by
+		return false
+	}
+	parties := []string{record.ActorId, record.FromActor, record.ToActor, record.GrantorId, record.GranteeId, record.ApproverId, record.DelegateId, record.RecipientId, record.CallerId}
+	for i := 0; i < len(record.Lines); i++ {
+		parties = append(parties, record.Lines[i].ActorId)
+	}
+
+	named := false
+	for i := 0; i < len(parties); i++ {
+		if len(parties[i]) > 0 {
+			named = true
+		}
+	}
+	return !named || view.can_see(parties...)
+}
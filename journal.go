@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Journal - every money movement is posted as a balanced double-entry journal entry. Each wallet counter of an Actor
+//			  is an account in the journal, and the counters stored on the Actor are only ever changed by posting.
+//			  Awarded, Spent and Reimbursed are debit-normal accounts; Committed, Delegated and Received are
+//			  credit-normal. Opening balances are posted against the system "opening" account so the books stay
+//			  balanced.
+//==============================================================================================================================
+
+// journal line (actor id, account, debit, credit)
+type JournalLine struct {
+	ActorId string `json:"actorid"`
+	Account string `json:"account"`
+	Debit   string `json:"debit"`
+	Credit  string `json:"credit"`
+}
+
+// journal entry (entry id, date, function, reference, lines)
+// Date is the transaction timestamp in RFC 3339 and TxId the transaction that posted the entry
+type JournalEntry struct {
+	EntryId   string        `json:"entryid"`
+	Date      string        `json:"date"`
+	Function  string        `json:"function"`
+	Reference string        `json:"reference"`
+	Lines     []JournalLine `json:"lines"`
+	TxId      string        `json:"txid"`
+}
+
+// trial balance row (actor id, account, total debits, total credits, balance on the normal side)
+type TrialBalanceRow struct {
+	ActorId string `json:"actorid"`
+	Account string `json:"account"`
+	Debit   string `json:"debit"`
+	Credit  string `json:"credit"`
+	Balance string `json:"balance"`
+	Wallet  string `json:"wallet"`
+}
+
+type TrialBalance struct {
+	Rows         []TrialBalanceRow `json:"rows"`
+	TotalDebit   string            `json:"totaldebit"`
+	TotalCredit  string            `json:"totalcredit"`
+	Balanced     bool              `json:"balanced"`
+	WalletsMatch bool              `json:"walletsmatch"`
+}
+
+var journalIndexStr = "_journalindex" // Define an index variable to track all the journal entries stored in the world state
+var openingAccount = "opening"        // Offset account for opening balances, it belongs to no actor
+
+// ============================================================================================================================
+// debit_line / credit_line - build one side of a journal entry
+// ============================================================================================================================
+func debit_line(actorId string, account string, amount string) JournalLine {
+	return JournalLine{ActorId: actorId, Account: account, Debit: amount, Credit: "0"}
+}
+
+func credit_line(actorId string, account string, amount string) JournalLine {
+	return JournalLine{ActorId: actorId, Account: account, Debit: "0", Credit: amount}
+}
+
+// ============================================================================================================================
+// debit_normal - whether the balance of an account grows with debits
+// ============================================================================================================================
+func debit_normal(account string) bool {
+	return account == "awarded" || account == "spent" || account == "reimbursed"
+}
+
+// ============================================================================================================================
+// actor_counter - the Actor wallet field a journal account maps to
+// ============================================================================================================================
+func actor_counter(actor *Actor, account string) (*string, error) {
+	switch account {
+	case "committed":
+		return &actor.Committed, nil
+	case "reimbursed":
+		return &actor.Reimbursed, nil
+	case "awarded":
+		return &actor.Awarded, nil
+	case "spent":
+		return &actor.Spent, nil
+	case "received":
+		return &actor.Received, nil
+	case "delegated":
+		return &actor.Delegated, nil
+	}
+	return nil, errors.New("Unknown journal account " + account)
+}
+
+// ============================================================================================================================
+// line_balance - the signed effect of a line on the balance of its account
+// ============================================================================================================================
+func line_balance(line JournalLine) (float64, error) {
+	debit, err := strconv.ParseFloat(line.Debit, 64)
+	if err != nil {
+		return 0, errors.New("Journal debit must be a numeric string")
+	}
+	credit, err := strconv.ParseFloat(line.Credit, 64)
+	if err != nil {
+		return 0, errors.New("Journal credit must be a numeric string")
+	}
+	if debit_normal(line.Account) {
+		return debit - credit, nil
+	}
+	return credit - debit, nil
+}
+
+// ============================================================================================================================
+// post_journal_entry - check that an entry balances, store it, append the journal index and apply it to the wallets
+// ============================================================================================================================
+func (t *SimpleChaincode) post_journal_entry(stub shim.ChaincodeStubInterface, function string, reference string, lines []JournalLine) (string, error) {
+	if len(lines) < 2 {
+		return "", errors.New("A journal entry needs at least 2 lines")
+	}
+
+	var totalDebit, totalCredit float64
+	for i := 0; i < len(lines); i++ {
+		debit, err := strconv.ParseFloat(lines[i].Debit, 64)
+		if err != nil {
+			return "", errors.New("Journal debit must be a numeric string")
+		}
+		credit, err := strconv.ParseFloat(lines[i].Credit, 64)
+		if err != nil {
+			return "", errors.New("Journal credit must be a numeric string")
+		}
+		totalDebit += debit
+		totalCredit += credit
+	}
+	if math.Abs(totalDebit-totalCredit) > 0.000001 {
+		return "", errors.New("Journal entry for " + function + " does not balance")
+	}
+
+	//get the journal index
+	journalAsBytes, err := stub.GetState(journalIndexStr)
+	if err != nil {
+		return "", errors.New("Failed to get journal index")
+	}
+	var journalIndex []string
+	json.Unmarshal(journalAsBytes, &journalIndex)
+
+	current_time, err := tx_time(stub)
+	if err != nil {
+		return "", err
+	}
+
+	entry := JournalEntry{}
+	entry.EntryId = "JNL-" + strconv.Itoa(len(journalIndex)+1)
+	entry.Date = current_time.Format(time.RFC3339Nano)
+	entry.TxId = stub.GetTxID()
+	entry.Function = function
+	entry.Reference = reference
+	entry.Lines = lines
+
+	entryAsBytes, _ := json.Marshal(entry)
+	err = stub.PutState(entry.EntryId, entryAsBytes)
+	if err != nil {
+		return "", err
+	}
+
+	//append the index
+	journalIndex = append(journalIndex, entry.EntryId)
+	jsonAsBytes, _ := json.Marshal(journalIndex)
+	err = stub.PutState(journalIndexStr, jsonAsBytes)
+	if err != nil {
+		return "", err
+	}
+
+	// apply every line to the wallet it belongs to
+	for i := 0; i < len(lines); i++ {
+		if lines[i].Account == openingAccount {
+			continue
+		}
+		actorAsBytes, err := stub.GetState(lines[i].ActorId)
+		if err != nil {
+			return "", errors.New("Failed to get actor " + lines[i].ActorId)
+		}
+		actor := Actor{}
+		json.Unmarshal(actorAsBytes, &actor)
+		if actor.ActorId != lines[i].ActorId {
+			return "", errors.New("Actor " + lines[i].ActorId + " does not exist")
+		}
+
+		counter, err := actor_counter(&actor, lines[i].Account)
+		if err != nil {
+			return "", err
+		}
+		balance, err := strconv.ParseFloat(*counter, 64)
+		if err != nil {
+			balance = 0
+		}
+		change, err := line_balance(lines[i])
+		if err != nil {
+			return "", err
+		}
+		*counter = strconv.FormatFloat(balance+change, 'f', -1, 64)
+
+		actorAsBytes, _ = json.Marshal(actor)
+		err = stub.PutState(actor.ActorId, actorAsBytes)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return entry.EntryId, nil
+}
+
+// ============================================================================================================================
+// Query Function - Called when query the journal
+// Function: query all the journal entries touching an actor the caller sees, optionally only those touching one actor
+// Query
+// ============================================================================================================================
+func (t *SimpleChaincode) QueryJournal(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//args[0] = optional actor id
+
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := t.get_journal(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []JournalEntry
+	for i := 0; i < len(entries); i++ {
+		var actorIds []string
+		touches := false
+		for j := 0; j < len(entries[i].Lines); j++ {
+			actorIds = append(actorIds, entries[i].Lines[j].ActorId)
+			if len(args) > 0 && entries[i].Lines[j].ActorId == args[0] {
+				touches = true
+			}
+		}
+		if len(args) > 0 && len(args[0]) > 0 && !touches {
+			continue
+		}
+		if !view.can_see(actorIds...) {
+			continue
+		}
+		result = append(result, entries[i])
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+
+	return resultAsBytes, nil
+}
+
+// ============================================================================================================================
+// Query Function - Called when query the trial balance
+// Function: total the debits and credits of every account over the whole journal, prove the books balance and that
+// every wallet equals the balance derived from the journal. A caller who does not see every actor gets the rows of the
+// actors it sees and their totals, the books are still proven balanced over the whole journal.
+// Query
+// ============================================================================================================================
+func (t *SimpleChaincode) QueryTrialBalance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := t.get_journal(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []TrialBalanceRow
+	var debits, credits []float64
+	var totalDebit, totalCredit float64
+	for i := 0; i < len(entries); i++ {
+		for j := 0; j < len(entries[i].Lines); j++ {
+			line := entries[i].Lines[j]
+			debit, err := strconv.ParseFloat(line.Debit, 64)
+			if err != nil {
+				return nil, errors.New("Journal entry " + entries[i].EntryId + " has a non-numeric debit")
+			}
+			credit, err := strconv.ParseFloat(line.Credit, 64)
+			if err != nil {
+				return nil, errors.New("Journal entry " + entries[i].EntryId + " has a non-numeric credit")
+			}
+
+			k := 0
+			for k < len(rows) && (rows[k].ActorId != line.ActorId || rows[k].Account != line.Account) {
+				k++
+			}
+			if k == len(rows) {
+				rows = append(rows, TrialBalanceRow{ActorId: line.ActorId, Account: line.Account})
+				debits = append(debits, 0)
+				credits = append(credits, 0)
+			}
+			debits[k] += debit
+			credits[k] += credit
+			totalDebit += debit
+			totalCredit += credit
+		}
+	}
+
+	result := TrialBalance{}
+	result.WalletsMatch = true
+	result.Balanced = math.Abs(totalDebit-totalCredit) <= 0.000001
+	var shown []TrialBalanceRow
+	totalDebit, totalCredit = 0, 0
+	for k := 0; k < len(rows); k++ {
+		if !view.can_see(rows[k].ActorId) {
+			continue
+		}
+		totalDebit += debits[k]
+		totalCredit += credits[k]
+		balance := credits[k] - debits[k]
+		if debit_normal(rows[k].Account) {
+			balance = debits[k] - credits[k]
+		}
+		rows[k].Debit = strconv.FormatFloat(debits[k], 'f', -1, 64)
+		rows[k].Credit = strconv.FormatFloat(credits[k], 'f', -1, 64)
+		rows[k].Balance = strconv.FormatFloat(balance, 'f', -1, 64)
+		shown = append(shown, rows[k])
+
+		if rows[k].Account == openingAccount {
+			continue
+		}
+		actorAsBytes, err := stub.GetState(rows[k].ActorId)
+		if err != nil {
+			return nil, errors.New("Failed to get actor " + rows[k].ActorId)
+		}
+		actor := Actor{}
+		json.Unmarshal(actorAsBytes, &actor)
+		counter, err := actor_counter(&actor, rows[k].Account)
+		if err != nil {
+			return nil, err
+		}
+		shown[len(shown)-1].Wallet = *counter
+		wallet, err := strconv.ParseFloat(*counter, 64)
+		if err != nil || math.Abs(wallet-balance) > 0.000001 {
+			result.WalletsMatch = false
+		}
+	}
+
+	result.Rows = shown
+	result.TotalDebit = strconv.FormatFloat(totalDebit, 'f', -1, 64)
+	result.TotalCredit = strconv.FormatFloat(totalCredit, 'f', -1, 64)
+
+	resultAsBytes, _ := json.Marshal(result)
+
+	return resultAsBytes, nil
+}
+
+// ============================================================================================================================
+// journal_balance - the balance of one account of an actor derived from the journal, the wallet counters only mirror it
+// ============================================================================================================================
+func (t *SimpleChaincode) journal_balance(stub shim.ChaincodeStubInterface, actorId string, account string) (float64, error) {
+	entries, err := t.get_journal(stub)
+	if err != nil {
+		return 0, err
+	}
+	balance := 0.0
+	for i := 0; i < len(entries); i++ {
+		for j := 0; j < len(entries[i].Lines); j++ {
+			line := entries[i].Lines[j]
+			if line.ActorId != actorId || line.Account != account {
+				continue
+			}
+			change, err := line_balance(line)
+			if err != nil {
+				return 0, errors.New("Journal entry " + entries[i].EntryId + " has a non-numeric line")
+			}
+			balance += change
+		}
+	}
+	return balance, nil
+}
+
+// ============================================================================================================================
+// get_journal - read every journal entry in posting order
+// ============================================================================================================================
+func (t *SimpleChaincode) get_journal(stub shim.ChaincodeStubInterface) ([]JournalEntry, error) {
+	journalAsBytes, err := stub.GetState(journalIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get journal index")
+	}
+	var journalIndex []string
+	json.Unmarshal(journalAsBytes, &journalIndex)
+
+	var entries []JournalEntry
+	for i := 0; i < len(journalIndex); i++ {
+		entryAsBytes, err := stub.GetState(journalIndex[i])
+		if err != nil {
+			return nil, errors.New("Failed to get journal entry")
+		}
+		entry := JournalEntry{}
+		json.Unmarshal(entryAsBytes, &entry)
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSpendIsBoundByTheJournalBalance(t *testing.T) {
+	cc, m := setup(t)
+
+	// a wallet rewritten outside the journal does not raise what can be spent, ACT-102 has 125000 - 23000 left
+	m.state["ACT-102"] = []byte(`{"actorid":"ACT-102","actorname":"stanford university","committed":"0","reimbursed":"4500","awarded":"125000","spent":"0","received":"15000","delegated":"45000"}`)
+	_, err := cc.Invoke(m, "spend", []string{"ACT-102", "ACT-104", "102000.01", "Travel"})
+	fails(t, nil, err, "doesn't have enough balance")
+	must(t)(cc.Invoke(m, "spend", []string{"ACT-102", "ACT-104", "102000", "Travel"}))
+
+	// the generic write is for admins and never reaches a wallet or the journal
+	_, err = cc.Invoke(m, "write", []string{"EXP-201", "{}"})
+	fails(t, nil, err, "Only an admin")
+	m.attrs["role"] = "admin"
+	_, err = cc.Invoke(m, "write", []string{"ACT-102", `{"actorid":"ACT-102","awarded":"999999"}`})
+	fails(t, nil, err, "only be changed through a journal entry")
+	_, err = cc.Invoke(m, "write", []string{"JNL-1", "{}"})
+	fails(t, nil, err, "only be changed through a journal entry")
+	wallet := must(t)(cc.Query(m, "read", []string{"ACT-102"}))
+	if !strings.Contains(wallet, `"awarded":"125000"`) {
+		t.Fatal(wallet)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	mockStub - an in-memory world state for the tests. The certificate attributes of the caller are set in attrs and
+//			   the transaction timestamp in ts, the transaction id follows the timestamp. Stub methods the chaincode
+//			   never calls are left to the embedded interface.
+//==============================================================================================================================
+
+type mockStub struct {
+	shim.ChaincodeStubInterface
+	state  map[string][]byte
+	attrs  map[string]string
+	ts     int64
+	events []string
+}
+
+func newMock() *mockStub {
+	return &mockStub{state: map[string][]byte{}, attrs: map[string]string{}, ts: 1500000000}
+}
+
+func (m *mockStub) GetTxID() string { return "tx" + strconv.FormatInt(m.ts, 10) }
+
+func (m *mockStub) GetState(key string) ([]byte, error) { return m.state[key], nil }
+
+func (m *mockStub) PutState(key string, value []byte) error {
+	m.state[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (m *mockStub) DelState(key string) error {
+	delete(m.state, key)
+	return nil
+}
+
+func (m *mockStub) RangeQueryState(startKey, endKey string) (shim.StateRangeQueryIteratorInterface, error) {
+	var keys []string
+	for key := range m.state {
+		if key >= startKey && key < endKey {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return &mockIterator{stub: m, keys: keys}, nil
+}
+
+func (m *mockStub) ReadCertAttribute(attributeName string) ([]byte, error) {
+	value, ok := m.attrs[attributeName]
+	if !ok {
+		return nil, errors.New("no attribute " + attributeName)
+	}
+	return []byte(value), nil
+}
+
+func (m *mockStub) VerifyAttribute(attributeName string, attributeValue []byte) (bool, error) {
+	return m.attrs[attributeName] == string(attributeValue), nil
+}
+
+func (m *mockStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: m.ts}, nil
+}
+
+func (m *mockStub) SetEvent(name string, payload []byte) error {
+	m.events = append(m.events, name+":"+string(payload))
+	return nil
+}
+
+type mockIterator struct {
+	stub *mockStub
+	keys []string
+	i    int
+}
+
+func (it *mockIterator) HasNext() bool { return it.i < len(it.keys) }
+
+func (it *mockIterator) Next() (string, []byte, error) {
+	key := it.keys[it.i]
+	it.i++
+	return key, it.stub.state[key], nil
+}
+
+func (it *mockIterator) Close() error { return nil }
+
+// setup - a chaincode loaded with the demo fixture, called by no one until a test sets the attributes
+func setup(t *testing.T) (*SimpleChaincode, *mockStub) {
+	expNumber, reimbNumber = 0, 0
+	cc := new(SimpleChaincode)
+	m := newMock()
+	must(t)(cc.Init(m, "init", []string{"1"}))
+	m.attrs["role"] = "admin"
+	must(t)(cc.Invoke(m, "setup", nil))
+	m.attrs["role"] = ""
+	return cc, m
+}
+
+// must - the result of a call that has to succeed, as a string
+func must(t *testing.T) func([]byte, error) string {
+	return func(result []byte, err error) string {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(result)
+	}
+}
+
+// fails - check that a call failed with an error containing the given text
+func fails(t *testing.T, result []byte, err error, text string) {
+	t.Helper()
+	if err == nil || !strings.Contains(err.Error(), text) {
+		t.Fatalf("expected an error containing %q, got %v / %s", text, err, result)
+	}
+}
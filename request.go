@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Client request ids - a client that may retry an invoke, e.g. after a timeout, passes "requestid=<id>" as the first
+//						 argument. The first invoke with that id runs normally and its result is recorded with the
+//						 hash of the function and arguments. A replay with the same function and arguments returns
+//						 the recorded result without running again, so no second expenditure or reimbursement is
+//						 created; reusing the id for anything else is refused. Ids are scoped to the calling actor.
+//==============================================================================================================================
+
+// the recorded outcome of an invoke made with a client request id
+type ClientRequest struct {
+	RequestId string `json:"requestid"`
+	CallerId  string `json:"callerid"`
+	Function  string `json:"function"`
+	ArgsHash  string `json:"argshash"`
+	Result    []byte `json:"result"`
+	Date      string `json:"date"`
+}
+
+var requestIdPrefix = "requestid=" // Marks the optional client request id in the first invoke argument
+
+// ============================================================================================================================
+// split_request_id - take the client request id off the invoke arguments, empty if none was given
+// ============================================================================================================================
+func split_request_id(args []string) (string, []string) {
+	if len(args) > 0 && strings.HasPrefix(args[0], requestIdPrefix) {
+		return strings.TrimPrefix(args[0], requestIdPrefix), args[1:]
+	}
+	return "", args
+}
+
+// ============================================================================================================================
+// invoke_once - run an invoke at most once per client request id, replaying the recorded result afterwards
+// ============================================================================================================================
+func (t *SimpleChaincode) invoke_once(stub shim.ChaincodeStubInterface, requestId string, function string, args []string) ([]byte, error) {
+	callerId, err := t.get_caller_actor(stub)
+	if err != nil {
+		callerId = ""
+	}
+
+	argsAsBytes, _ := json.Marshal(append([]string{function}, args...))
+	sum := sha256.Sum256(argsAsBytes)
+	argsHash := hex.EncodeToString(sum[:])
+
+	key := request_key(callerId, requestId)
+	requestAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Failed to get request id")
+	}
+	if len(requestAsBytes) > 0 {
+		request := ClientRequest{}
+		json.Unmarshal(requestAsBytes, &request)
+		if request.ArgsHash != argsHash {
+			return nil, errors.New("Request id " + requestId + " was already used for a different " + request.Function)
+		}
+		return request.Result, nil
+	}
+
+	result, err := t.dispatch_invoke(stub, function, args)
+	if err != nil {
+		return nil, err
+	}
+
+	current_time, err := tx_time(stub)
+	if err != nil {
+		return nil, err
+	}
+	request := ClientRequest{}
+	request.RequestId = requestId
+	request.CallerId = callerId
+	request.Function = function
+	request.ArgsHash = argsHash
+	request.Result = result
+	request.Date = current_time.Format(time.RFC3339)
+
+	requestAsBytes, _ = json.Marshal(request)
+	err = stub.PutState(key, requestAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ============================================================================================================================
+// request_key - the world state key of a client request id, the caller id is prefixed with its length so that no two
+// pairs of caller and request id share a key
+// ============================================================================================================================
+func request_key(callerId string, requestId string) string {
+	return "REQ-" + strconv.Itoa(len(callerId)) + "-" + callerId + "-" + requestId
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRequestKeysOfDifferentCallersDoNotCollide(t *testing.T) {
+	if request_key("ACT-1", "02-X") == request_key("ACT-1-02", "X") {
+		t.Fatal(request_key("ACT-1", "02-X"))
+	}
+	if request_key("", "ACT-1-X") == request_key("ACT-1", "X") {
+		t.Fatal(request_key("", "ACT-1-X"))
+	}
+}
+
+func TestRequestIdReplaysPerCaller(t *testing.T) {
+	cc, m := setup(t)
+	m.attrs["actorid"] = "ACT-102"
+
+	must(t)(cc.Invoke(m, "spend", []string{"requestid=R-1", "ACT-102", "ACT-104", "20", "Travel"}))
+	must(t)(cc.Invoke(m, "spend", []string{"requestid=R-1", "ACT-102", "ACT-104", "20", "Travel"}))
+	if m.state["EXP-211"] != nil {
+		t.Fatal("replayed request spent again")
+	}
+	_, err := cc.Invoke(m, "spend", []string{"requestid=R-1", "ACT-102", "ACT-104", "30", "Travel"})
+	fails(t, nil, err, "already used for a different spend")
+
+	// another caller may use the same request id
+	m.attrs["actorid"] = "ACT-103"
+	must(t)(cc.Invoke(m, "spend", []string{"requestid=R-1", "ACT-103", "ACT-104", "20", "Travel"}))
+	if m.state["EXP-211"] == nil {
+		t.Fatal("request of another caller was replayed")
+	}
+}
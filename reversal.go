@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Reversals - undo a reimbursement or an expenditure, or claw funds back from a grantee. Nothing is ever edited in
+//				place: every operation creates a compensating record with the negated amounts, links it to the
+//				original through ReversalOf/ReversedBy and restores the wallets. A record that already carries a
+//				ReversedBy link, or is itself a compensating record, cannot be reversed again. A clawback may take
+//				back part of a payment: it only adds to the ClawedBack amount of the original, which can be
+//				clawed back again until nothing is left, and a later reversal takes back only the remainder.
+//==============================================================================================================================
+
+// ============================================================================================================================
+// ReverseReimbursement Function - Called when a reimbursement was paid in error
+// Function: create a compensating Reimbursement, update Actor struct (take the payment back), put an Approved or
+// Partially Approved Expenditure back to Pending with its approvals and escalations cleared, so it goes through approval
+// again before it is paid. A reimbursement that paid nothing, e.g. of a disallowed expense, has nothing to reverse.
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) ReverseReimbursement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//       0             1
+	// "reimb id"   "reason code"
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+	if len(args[1]) <= 0 {
+		return nil, errors.New("2nd argument must be a non-empty string")
+	}
+
+	oneRem, err := t.get_reimbursement(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	paid, err := strconv.ParseFloat(oneRem.Amount, 64)
+	if err != nil {
+		return nil, errors.New("Reimbursement " + oneRem.ReimbursementId + " has a non-numeric amount")
+	}
+	if paid == 0 {
+		return nil, errors.New("Reimbursement " + oneRem.ReimbursementId + " paid nothing and cannot be reversed")
+	}
+
+	remId, err := t.reverse_reimbursement(stub, oneRem, args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	// the expense is unpaid again and waits for a fresh approval, its SLA counted from now
+	if len(oneRem.ExpenditureId) > 0 {
+		oneExp, err := t.get_expenditure(stub, oneRem.ExpenditureId)
+		if err != nil {
+			return nil, err
+		}
+		if oneExp.Status != "Approved" && oneExp.Status != "Partially Approved" {
+			return []byte(remId), nil
+		}
+		current_time, err := tx_time(stub)
+		if err != nil {
+			return nil, err
+		}
+		oneExp.Status = "Pending"
+		oneExp.Approvals = nil
+		oneExp.Escalations = nil
+		oneExp.Submitted = current_time.Format(time.RFC3339)
+		oneExpAsBytes, _ := json.Marshal(oneExp)
+		err = stub.PutState(oneExp.ExpenditureId, oneExpAsBytes)
+		if err != nil {
+			return nil, err
+		}
+		err = t.evaluate_alerts(stub, oneExp.AwardId, remId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return []byte(remId), nil
+}
+
+// ============================================================================================================================
+// ReverseExpenditure Function - Called when a supplier refunds an expenditure or it was recorded in error
+// Function: reverse every reimbursement still paid against it, create a compensating Expenditure, update Actor struct
+// (restore Spent and Received), mark the Expenditure Reversed
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) ReverseExpenditure(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//      0            1
+	// "exp id"   "reason code"
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+	if len(args[1]) <= 0 {
+		return nil, errors.New("2nd argument must be a non-empty string")
+	}
+
+	oneExp, err := t.get_expenditure(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(oneExp.ReversalOf) > 0 {
+		return nil, errors.New(oneExp.ExpenditureId + " is itself a reversal of " + oneExp.ReversalOf)
+	}
+	if len(oneExp.ReversedBy) > 0 {
+		return nil, errors.New(oneExp.ExpenditureId + " has already been reversed by " + oneExp.ReversedBy)
+	}
+	err = t.check_award_open(stub, oneExp.AwardId)
+	if err != nil {
+		return nil, err
+	}
+
+	// the grantee cannot keep a reimbursement for an expense that no longer exists
+	reimbsIndexAsBytes, err := stub.GetState(reimbIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get reimbursement index")
+	}
+	var reimbIndex []string
+	json.Unmarshal(reimbsIndexAsBytes, &reimbIndex)
+
+	for i := 0; i < len(reimbIndex); i++ {
+		oneRem, err := t.get_reimbursement(stub, reimbIndex[i])
+		if err != nil {
+			return nil, err
+		}
+		if oneRem.ExpenditureId != oneExp.ExpenditureId || len(oneRem.ReversalOf) > 0 || len(oneRem.ReversedBy) > 0 {
+			continue
+		}
+		_, err = t.reverse_reimbursement(stub, oneRem, args[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	amount, err := strconv.ParseFloat(oneExp.Amount, 64)
+	if err != nil {
+		return nil, errors.New("Expenditure " + oneExp.ExpenditureId + " has a non-numeric amount")
+	}
+	_, err = t.Transfer_balance(stub, []string{oneExp.FromActor, oneExp.ToActor, oneExp.Amount, "reversespend", oneExp.ExpenditureId})
+	if err != nil {
+		return nil, err
+	}
+
+	// create the compensating expenditure
+	expId := next_expenditure_id()
+	current_time, err := tx_time(stub)
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.init_expenditure(stub, []string{expId, strconv.FormatFloat(-amount, 'f', -1, 64), current_time.Format(dateFormat), oneExp.Type, "Reversal", oneExp.FromActor, oneExp.ToActor})
+	if err != nil {
+		return nil, err
+	}
+	reversal, err := t.get_expenditure(stub, expId)
+	if err != nil {
+		return nil, err
+	}
+	reversal.ReversalOf = oneExp.ExpenditureId
+	reversal.ReasonCode = args[1]
+	reversal.AwardId = oneExp.AwardId
+	reversal.Currency = oneExp.Currency
+	err = t.put_expenditure(stub, reversal)
+	if err != nil {
+		return nil, err
+	}
+
+	oneExp.Status = "Reversed"
+	oneExp.ReversedBy = expId
+	oneExpAsBytes, _ := json.Marshal(oneExp)
+	err = stub.PutState(oneExp.ExpenditureId, oneExpAsBytes)
+	if err != nil {
+		return nil, err
+	}
+	err = t.evaluate_alerts(stub, oneExp.AwardId, expId)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(expId), nil
+}
+
+// ============================================================================================================================
+// Clawback Function - Called when the grantor takes back funds it paid to a grantee
+// Function: create a compensating Reimbursement for the clawed back amount, which is recorded as disallowed, add it to
+// the ClawedBack amount of the original and update Actor struct (take the amount back from the grantee)
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) Clawback(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//       0              1          2           3
+	// "grantor id"   "reimb id"   "amount"  "reason code"
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+	if len(args[3]) <= 0 {
+		return nil, errors.New("4th argument must be a non-empty string")
+	}
+
+	oneRem, err := t.get_reimbursement(stub, args[1])
+	if err != nil {
+		return nil, err
+	}
+	if oneRem.FromActor != args[0] {
+		return nil, errors.New(args[0] + " did not pay " + oneRem.ReimbursementId)
+	}
+	if len(oneRem.ReversalOf) > 0 {
+		return nil, errors.New(oneRem.ReimbursementId + " is itself a reversal of " + oneRem.ReversalOf)
+	}
+	if len(oneRem.ReversedBy) > 0 {
+		return nil, errors.New(oneRem.ReimbursementId + " has already been reversed by " + oneRem.ReversedBy)
+	}
+	err = t.check_record_open(stub, oneRem.ReimbursementId)
+	if err != nil {
+		return nil, err
+	}
+
+	paid, err := strconv.ParseFloat(oneRem.Amount, 64)
+	if err != nil {
+		return nil, errors.New("Reimbursement " + oneRem.ReimbursementId + " has a non-numeric amount")
+	}
+	amount, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || amount <= 0 {
+		return nil, errors.New("3rd argument must be a positive numeric string")
+	}
+	clawedBack, err := strconv.ParseFloat(oneRem.ClawedBack, 64)
+	if err != nil {
+		clawedBack = 0
+	}
+	if clawedBack >= paid {
+		return nil, errors.New(oneRem.ReimbursementId + " has already been clawed back in full")
+	}
+	if amount > paid-clawedBack+0.000001 {
+		return nil, errors.New("Cannot claw back more than the " + format_amount(paid-clawedBack) + " still paid by " + oneRem.ReimbursementId)
+	}
+
+	amountStr := strconv.FormatFloat(amount, 'f', -1, 64)
+	_, err = t.Transfer_balance(stub, []string{oneRem.FromActor, oneRem.ToActor, amountStr, "reversefund", oneRem.ReimbursementId})
+	if err != nil {
+		return nil, err
+	}
+
+	remId := next_reimbursement_id()
+	current_time, err := tx_time(stub)
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.init_reimbursement(stub, []string{remId, "-" + amountStr, oneRem.FromActor, oneRem.ToActor, current_time.Format(dateFormat), oneRem.ExpenditureId, "0", amountStr, args[3]})
+	if err != nil {
+		return nil, err
+	}
+
+	// the clawback points at the original, which stays in force for what is left of it
+	clawback, err := t.get_reimbursement(stub, remId)
+	if err != nil {
+		return nil, err
+	}
+	clawback.ReversalOf = oneRem.ReimbursementId
+	clawbackAsBytes, _ := json.Marshal(clawback)
+	err = stub.PutState(remId, clawbackAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	oneRem.ClawedBack = format_amount(clawedBack + amount)
+	oneRem.Clawbacks = append(oneRem.Clawbacks, remId)
+	oneRemAsBytes, _ := json.Marshal(oneRem)
+	err = stub.PutState(oneRem.ReimbursementId, oneRemAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(remId), nil
+}
+
+// ============================================================================================================================
+// reverse_reimbursement - take back what is still paid of a reimbursement and record the compensating reimbursement
+// The expenditure it paid for is left untouched; callers decide what status it goes back to.
+// ============================================================================================================================
+func (t *SimpleChaincode) reverse_reimbursement(stub shim.ChaincodeStubInterface, oneRem Reimbursement, reasonCode string) (string, error) {
+	if len(oneRem.ReversalOf) > 0 {
+		return "", errors.New(oneRem.ReimbursementId + " is itself a reversal of " + oneRem.ReversalOf)
+	}
+	if len(oneRem.ReversedBy) > 0 {
+		return "", errors.New(oneRem.ReimbursementId + " has already been reversed by " + oneRem.ReversedBy)
+	}
+	err := t.check_record_open(stub, oneRem.ReimbursementId)
+	if err != nil {
+		return "", err
+	}
+
+	paid, err := strconv.ParseFloat(oneRem.Amount, 64)
+	if err != nil {
+		return "", errors.New("Reimbursement " + oneRem.ReimbursementId + " has a non-numeric amount")
+	}
+	requested, err := strconv.ParseFloat(oneRem.RequestedAmount, 64)
+	if err != nil {
+		requested = paid
+	}
+	disallowed, err := strconv.ParseFloat(oneRem.DisallowedAmount, 64)
+	if err != nil {
+		disallowed = 0
+	}
+	clawedBack, err := strconv.ParseFloat(oneRem.ClawedBack, 64)
+	if err != nil {
+		clawedBack = 0
+	}
+
+	// the clawbacks already took back part of the payment, as disallowed costs
+	paid -= clawedBack
+	disallowed += clawedBack
+	if paid != 0 {
+		_, err = t.Transfer_balance(stub, []string{oneRem.FromActor, oneRem.ToActor, format_amount(paid), "reversefund", oneRem.ReimbursementId})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// negate every figure so the original, its clawbacks and its reversal net to zero
+	remId := next_reimbursement_id()
+	current_time, err := tx_time(stub)
+	if err != nil {
+		return "", err
+	}
+	_, err = t.init_reimbursement(stub, []string{remId, format_amount(-paid), oneRem.FromActor, oneRem.ToActor, current_time.Format(dateFormat), oneRem.ExpenditureId, format_amount(-requested), format_amount(-disallowed), reasonCode})
+	if err != nil {
+		return "", err
+	}
+
+	err = t.link_reversal(stub, oneRem, remId)
+	if err != nil {
+		return "", err
+	}
+
+	return remId, nil
+}
+
+// ============================================================================================================================
+// link_reversal - point a compensating reimbursement at the original and mark the original as reversed by it
+// ============================================================================================================================
+func (t *SimpleChaincode) link_reversal(stub shim.ChaincodeStubInterface, original Reimbursement, remId string) error {
+	reversal, err := t.get_reimbursement(stub, remId)
+	if err != nil {
+		return err
+	}
+	reversal.ReversalOf = original.ReimbursementId
+	reversalAsBytes, _ := json.Marshal(reversal)
+	err = stub.PutState(remId, reversalAsBytes)
+	if err != nil {
+		return err
+	}
+
+	original.ReversedBy = remId
+	originalAsBytes, _ := json.Marshal(original)
+	return stub.PutState(original.ReimbursementId, originalAsBytes)
+}
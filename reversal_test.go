@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPartialClawbackThenReverseExpenditure(t *testing.T) {
+	cc, m := setup(t)
+	m.attrs["role"] = "admin"
+
+	// REM-301 paid 3000 for EXP-201, take it back in two parts
+	must(t)(cc.Invoke(m, "clawback", []string{"ACT-101", "REM-301", "1000", "AUDIT"}))
+	must(t)(cc.Invoke(m, "clawback", []string{"ACT-101", "REM-301", "500", "AUDIT"}))
+	_, err := cc.Invoke(m, "clawback", []string{"ACT-101", "REM-301", "2000", "AUDIT"})
+	fails(t, nil, err, "1500 still paid")
+	rem := must(t)(cc.Query(m, "read", []string{"REM-301"}))
+	if !strings.Contains(rem, `"reversedby":""`) || !strings.Contains(rem, `"clawedback":"1500"`) || !strings.Contains(rem, `"clawbacks":["REM-308","REM-309"]`) {
+		t.Fatal(rem)
+	}
+
+	// the reversal takes back only the 1500 left
+	must(t)(cc.Invoke(m, "reverseexpenditure", []string{"EXP-201", "REFUND"}))
+	reversal := must(t)(cc.Query(m, "read", []string{"REM-310"}))
+	if !strings.Contains(reversal, `"amount":"-1500"`) || !strings.Contains(reversal, `"reversalof":"REM-301"`) {
+		t.Fatal(reversal)
+	}
+	_, err = cc.Invoke(m, "clawback", []string{"ACT-101", "REM-301", "100", "AUDIT"})
+	fails(t, nil, err, "already been reversed")
+
+	wallet := must(t)(cc.Query(m, "read", []string{"ACT-102"}))
+	if !strings.Contains(wallet, `"spent":"20000","received":"12000"`) {
+		t.Fatal(wallet)
+	}
+	trial := must(t)(cc.Query(m, "querytrialbalance", nil))
+	if !strings.Contains(trial, `"balanced":true`) || !strings.Contains(trial, `"walletsmatch":true`) {
+		t.Fatal(trial)
+	}
+	ledger := must(t)(cc.Query(m, "verifyledger", nil))
+	if strings.Contains(ledger, `"kind"`) {
+		t.Fatal(ledger)
+	}
+}
+
+func TestReverseReimbursementClearsApprovals(t *testing.T) {
+	cc, m := setup(t)
+	m.attrs["role"] = "admin"
+
+	must(t)(cc.Invoke(m, "reversereimbursement", []string{"REM-301", "ERROR"}))
+	exp := must(t)(cc.Query(m, "read", []string{"EXP-201"}))
+	if !strings.Contains(exp, `"status":"Pending"`) || !strings.Contains(exp, `"approvals":null`) || !strings.Contains(exp, `"submitted":"2017-07-14T02:40:00Z"`) {
+		t.Fatal(exp)
+	}
+	must(t)(cc.Invoke(m, "releasefund", []string{"ACT-101", "EXP-201"}))
+}
+
+func TestReverseOnlyWhatWasPaid(t *testing.T) {
+	cc, m := setup(t)
+	m.attrs["role"] = "admin"
+
+	// a fully disallowed expense stays closed
+	must(t)(cc.Invoke(m, "approveexpense", []string{"ACT-101", "EXP-202", "0", "8000", "AUDIT"}))
+	_, err := cc.Invoke(m, "reversereimbursement", []string{"REM-308", "ERROR"})
+	fails(t, nil, err, "REM-308 paid nothing and cannot be reversed")
+	exp := must(t)(cc.Query(m, "read", []string{"EXP-202"}))
+	if !strings.Contains(exp, `"status":"Disallowed"`) {
+		t.Fatal(exp)
+	}
+
+	// a partly approved one is paid again after a fresh approval, and no figure of the reversal is -0
+	must(t)(cc.Invoke(m, "approveexpense", []string{"ACT-102", "EXP-207", "7000", "500", "AUDIT"}))
+	must(t)(cc.Invoke(m, "reversereimbursement", []string{"REM-309", "ERROR"}))
+	exp = must(t)(cc.Query(m, "read", []string{"EXP-207"}))
+	if !strings.Contains(exp, `"status":"Pending"`) {
+		t.Fatal(exp)
+	}
+	must(t)(cc.Invoke(m, "reversereimbursement", []string{"REM-301", "ERROR"}))
+	reversal := must(t)(cc.Query(m, "read", []string{"REM-311"}))
+	if !strings.Contains(reversal, `"amount":"-3000"`) || strings.Contains(reversal, `"-0"`) {
+		t.Fatal(reversal)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Allowability rules - checked by Spend against every new expense. A rule applies to one award, or to a whole
+//						 program, i.e. every award and sub-award funded by one grantor, and to one expense type or
+//						 "*" for all of them. When its condition holds it either rejects the expense, forces it to
+//						 Pending for review, or only annotates it. Every rule that fired is kept on the expenditure.
+//
+//	Conditions:	always     - the expense type alone decides, e.g. Alcohol is unallowable
+//				above      - the amount in the award currency exceeds Limit, e.g. Travel is capped per trip
+//				nocontract - no contract reference was given, e.g. Consultancy needs a contract
+//				noevidence - the amount exceeds Limit and no supporting document was attached, e.g. receipts above 75
+//==============================================================================================================================
+
+type AllowabilityRule struct {
+	RuleId      string `json:"ruleid"`
+	Scope       string `json:"scope"`
+	ExpenseType string `json:"expensetype"`
+	Condition   string `json:"condition"`
+	Limit       string `json:"limit"`
+	Action      string `json:"action"`
+	Explanation string `json:"explanation"`
+}
+
+// a rule that fired on an expenditure (rule id, action, explanation)
+type FiredRule struct {
+	RuleId      string `json:"ruleid"`
+	Action      string `json:"action"`
+	Explanation string `json:"explanation"`
+}
+
+var ruleIndexStr = "_ruleindex" // Define an index variable to track all the allowability rules stored in the world state
+var ruleKeyPrefix = "RULE-"     // Prefix of the world state key of a rule, so a rule id cannot overwrite another record
+
+// ============================================================================================================================
+// PutRule Function - Called when the grantor of an award or program adds or replaces an allowability rule
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) PutRule(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//      0                   1                    2              3          4         5           6
+	// "rule id"  "award id or grantor id"  "expense type"  "condition"  "limit"  "action"  "explanation"
+
+	if len(args) != 7 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 7")
+	}
+	if len(args[0]) <= 0 || len(args[1]) <= 0 || len(args[2]) <= 0 || len(args[6]) <= 0 {
+		return nil, errors.New("Rule id, scope, expense type and explanation must be non-empty strings")
+	}
+
+	rule := AllowabilityRule{}
+	rule.RuleId = args[0]
+	rule.Scope = args[1]
+	rule.ExpenseType = args[2]
+	rule.Condition = args[3]
+	rule.Action = args[5]
+	rule.Explanation = args[6]
+
+	switch rule.Condition {
+	case "always", "nocontract":
+	case "above", "noevidence":
+		limit, err := strconv.ParseFloat(args[4], 64)
+		if err != nil || limit < 0 {
+			return nil, errors.New("5th argument must be a non-negative numeric string for an " + rule.Condition + " rule")
+		}
+		rule.Limit = strconv.FormatFloat(limit, 'f', -1, 64)
+	default:
+		return nil, errors.New("4th argument must be always, above, nocontract or noevidence")
+	}
+	if rule.Action != "reject" && rule.Action != "pending" && rule.Action != "annotate" {
+		return nil, errors.New("6th argument must be reject, pending or annotate")
+	}
+
+	//the scope is an award or the grantor of a program
+	_, err := t.get_award(stub, rule.Scope)
+	if err != nil {
+		actorAsBytes, err := stub.GetState(rule.Scope)
+		if err != nil {
+			return nil, errors.New("Failed to get scope")
+		}
+		actor := Actor{}
+		json.Unmarshal(actorAsBytes, &actor)
+		if actor.ActorId != rule.Scope {
+			return nil, errors.New("2nd argument must be an award id or a grantor id")
+		}
+	}
+
+	err = t.check_rule_owner(stub, rule.Scope)
+	if err != nil {
+		return nil, err
+	}
+
+	//a rule may be replaced, but not an unrelated record with the same key
+	ruleAsBytes, err := stub.GetState(ruleKeyPrefix + rule.RuleId)
+	if err != nil {
+		return nil, errors.New("Failed to get rule id")
+	}
+	existing := AllowabilityRule{}
+	json.Unmarshal(ruleAsBytes, &existing)
+	if len(ruleAsBytes) > 0 && existing.RuleId != rule.RuleId {
+		return nil, errors.New(rule.RuleId + " is already used by another record")
+	}
+
+	ruleAsBytes, _ = json.Marshal(rule)
+	err = stub.PutState(ruleKeyPrefix+rule.RuleId, ruleAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing.RuleId == rule.RuleId {
+		return nil, nil
+	}
+
+	//get the rule index
+	rulesAsBytes, err := stub.GetState(ruleIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get rule index")
+	}
+	var ruleIndex []string
+	json.Unmarshal(rulesAsBytes, &ruleIndex)
+
+	//append the index
+	ruleIndex = append(ruleIndex, rule.RuleId)
+	jsonAsBytes, _ := json.Marshal(ruleIndex)
+	err = stub.PutState(ruleIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// ============================================================================================================================
+// DeleteRule Function - Called when the grantor of an award or program withdraws an allowability rule
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) DeleteRule(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//      0
+	// "rule id"
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	ruleAsBytes, err := stub.GetState(ruleKeyPrefix + args[0])
+	if err != nil {
+		return nil, errors.New("Failed to get rule")
+	}
+	rule := AllowabilityRule{}
+	json.Unmarshal(ruleAsBytes, &rule)
+	if rule.RuleId != args[0] {
+		return nil, errors.New("Rule " + args[0] + " does not exist")
+	}
+
+	err = t.check_rule_owner(stub, rule.Scope)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stub.DelState(ruleKeyPrefix + rule.RuleId)
+	if err != nil {
+		return nil, errors.New("Failed to delete state")
+	}
+
+	//remove rule from index
+	rulesAsBytes, err := stub.GetState(ruleIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get rule index")
+	}
+	var ruleIndex []string
+	json.Unmarshal(rulesAsBytes, &ruleIndex)
+	for i, val := range ruleIndex {
+		if val == rule.RuleId {
+			ruleIndex = append(ruleIndex[:i], ruleIndex[i+1:]...)
+			break
+		}
+	}
+	jsonAsBytes, _ := json.Marshal(ruleIndex)
+	err = stub.PutState(ruleIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Query Function - Called when query allowability rules
+// Function: query all the rules of the awards and programs the caller sees, optionally only those of one award or
+// program
+// Query
+// ============================================================================================================================
+func (t *SimpleChaincode) QueryRules(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//args[0] = optional award id or grantor id
+
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := t.get_rules(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []AllowabilityRule
+	for i := 0; i < len(rules); i++ {
+		if len(args) > 0 && len(args[0]) > 0 && rules[i].Scope != args[0] {
+			continue
+		}
+		// a program rule is scoped to its grantor, an award rule to the award's grantor and grantee
+		parties := []string{rules[i].Scope}
+		award, err := t.get_award(stub, rules[i].Scope)
+		if err == nil {
+			parties = []string{award.GrantorId, award.GranteeId}
+		}
+		if !view.can_see(parties...) {
+			continue
+		}
+		result = append(result, rules[i])
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+
+	return resultAsBytes, nil
+}
+
+// ============================================================================================================================
+// evaluate_rules - the rules of the award and of every program funding it that fire on an expense
+// Returns an error naming the rules when any of them rejects the expense.
+// ============================================================================================================================
+func (t *SimpleChaincode) evaluate_rules(stub shim.ChaincodeStubInterface, award Award, expType string, amount float64, options SpendOptions) ([]FiredRule, error) {
+	if len(award.AwardId) <= 0 {
+		return nil, nil
+	}
+
+	// the award itself and the grantor of every award up to the root
+	scopes := map[string]bool{award.AwardId: true}
+	current := award
+	for {
+		scopes[current.GrantorId] = true
+		if len(current.ParentAwardId) <= 0 {
+			break
+		}
+		parent, err := t.get_award(stub, current.ParentAwardId)
+		if err != nil {
+			return nil, err
+		}
+		current = parent
+	}
+
+	rules, err := t.get_rules(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var fired []FiredRule
+	var rejections []string
+	for i := 0; i < len(rules); i++ {
+		rule := rules[i]
+		if !scopes[rule.Scope] {
+			continue
+		}
+		if rule.ExpenseType != "*" && !strings.EqualFold(rule.ExpenseType, expType) {
+			continue
+		}
+
+		holds := false
+		switch rule.Condition {
+		case "always":
+			holds = true
+		case "above":
+			limit, err := strconv.ParseFloat(rule.Limit, 64)
+			holds = err == nil && amount > limit
+		case "nocontract":
+			holds = len(options.ContractRef) <= 0
+		case "noevidence":
+			limit, err := strconv.ParseFloat(rule.Limit, 64)
+			holds = err == nil && amount > limit && len(options.Documents) <= 0
+		}
+		if !holds {
+			continue
+		}
+
+		fired = append(fired, FiredRule{RuleId: rule.RuleId, Action: rule.Action, Explanation: rule.Explanation})
+		if rule.Action == "reject" {
+			rejections = append(rejections, rule.RuleId+": "+rule.Explanation)
+		}
+	}
+
+	if len(rejections) > 0 {
+		return fired, errors.New("Expense is not allowable. " + strings.Join(rejections, "; "))
+	}
+
+	return fired, nil
+}
+
+// ============================================================================================================================
+// get_rules - read every allowability rule in the order they were added
+// ============================================================================================================================
+func (t *SimpleChaincode) get_rules(stub shim.ChaincodeStubInterface) ([]AllowabilityRule, error) {
+	rulesAsBytes, err := stub.GetState(ruleIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get rule index")
+	}
+	var ruleIndex []string
+	json.Unmarshal(rulesAsBytes, &ruleIndex)
+
+	var rules []AllowabilityRule
+	for i := 0; i < len(ruleIndex); i++ {
+		ruleAsBytes, err := stub.GetState(ruleKeyPrefix + ruleIndex[i])
+		if err != nil {
+			return nil, errors.New("Failed to get rule")
+		}
+		rule := AllowabilityRule{}
+		json.Unmarshal(ruleAsBytes, &rule)
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// ============================================================================================================================
+// check_rule_owner - only the grantor of the award, the grantor whose program it is, or an admin may change its rules
+// ============================================================================================================================
+func (t *SimpleChaincode) check_rule_owner(stub shim.ChaincodeStubInterface, scope string) error {
+	if t.caller_has_role(stub, "admin") {
+		return nil
+	}
+	callerId, err := t.get_caller_actor(stub)
+	if err != nil {
+		return err
+	}
+
+	owner := scope
+	award, err := t.get_award(stub, scope)
+	if err == nil {
+		owner = award.GrantorId
+	}
+	if callerId != owner {
+		return errors.New(callerId + " cannot change the rules of " + scope)
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRuleIdCannotOverwriteAnotherRecord(t *testing.T) {
+	cc, m := setup(t)
+	m.attrs["role"] = "admin"
+
+	// a rule named like an actor is kept apart from the actor
+	must(t)(cc.Invoke(m, "putrule", []string{"ACT-102", "ACT-101", "Alcohol", "always", "", "reject", "Alcohol is unallowable"}))
+	actor := must(t)(cc.Query(m, "read", []string{"ACT-102"}))
+	if !strings.Contains(actor, `"actorid":"ACT-102"`) || strings.Contains(actor, `"ruleid"`) {
+		t.Fatal(actor)
+	}
+	rules := must(t)(cc.Query(m, "queryrules", nil))
+	if !strings.Contains(rules, `"ruleid":"ACT-102"`) {
+		t.Fatal(rules)
+	}
+	must(t)(cc.Invoke(m, "deleterule", []string{"ACT-102"}))
+	actor = must(t)(cc.Query(m, "read", []string{"ACT-102"}))
+	if !strings.Contains(actor, `"actorid":"ACT-102"`) {
+		t.Fatal(actor)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Federal Financial Report - the figures of the SF-425 for one award computed from the ledger instead of re-keyed.
+//							   The cash and indirect expense lines cover the reporting period, the federal and
+//							   recipient share lines are cumulative to its end as the form asks.
+//
+//	Cash receipts            - reimbursements the grantee received for the award's expenses in the period
+//	Cash disbursements       - the grantee's paid or approved expenditures on the award in the period and what it
+//							   reimbursed its sub-recipients in the period
+//	Federal share            - the paid or approved expenditures and sub-recipient payments less the costs that
+//							   were disallowed
+//	Unliquidated obligations - expenses of the grantee and its sub-recipients still pending approval
+//	Recipient share          - no cost sharing is recorded on the ledger, so the required share is 0 and the
+//							   recipient's share of expenditures is the disallowed costs it had to bear
+//	Indirect expense         - the optional indirect rate applied to the federal share of the period less
+//							   equipment, the modified total direct cost base
+//==============================================================================================================================
+
+type FederalFinancialReport struct {
+	AwardId                  string `json:"awardid"`
+	GranteeId                string `json:"granteeid"`
+	PeriodStart              string `json:"periodstart"`
+	PeriodEnd                string `json:"periodend"`
+	CashReceipts             string `json:"cashreceipts"`
+	CashDisbursements        string `json:"cashdisbursements"`
+	CashOnHand               string `json:"cashonhand"`
+	FederalFundsAuthorized   string `json:"federalfundsauthorized"`
+	FederalShareExpenditures string `json:"federalshareexpenditures"`
+	UnliquidatedObligations  string `json:"unliquidatedobligations"`
+	FederalShareTotal        string `json:"federalsharetotal"`
+	UnobligatedBalance       string `json:"unobligatedbalance"`
+	RecipientShareRequired   string `json:"recipientsharerequired"`
+	RecipientShareExpended   string `json:"recipientshareexpended"`
+	RecipientShareRemaining  string `json:"recipientshareremaining"`
+	IndirectRateType         string `json:"indirectratetype"`
+	IndirectRate             string `json:"indirectrate"`
+	IndirectBase             string `json:"indirectbase"`
+	IndirectAmount           string `json:"indirectamount"`
+	IndirectFederalShare     string `json:"indirectfederalshare"`
+}
+
+// one line of the form (line number, label, value)
+type ReportLine struct {
+	Line  string `json:"line"`
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+type FederalFinancialReportResult struct {
+	Report FederalFinancialReport `json:"report"`
+	Lines  []ReportLine           `json:"lines"`
+}
+
+// ============================================================================================================================
+// Query Function - Called when query the federal financial report of an award the caller sees
+// Function: compute the SF-425 figures of the award for the period, cumulative to its end where the form asks, structured
+// and as form lines
+// Query
+// ============================================================================================================================
+func (t *SimpleChaincode) QueryFederalFinancialReport(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//      0              1              2               3                4
+	// "award id"  "period start"  "period end"  [indirect rate]  [rate type]
+
+	if len(args) < 3 || len(args) > 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3 to 5")
+	}
+	award, err := t.get_award(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
+	if !view.can_see(award.GrantorId, award.GranteeId) {
+		return nil, errors.New("Award " + args[0] + " does not exist")
+	}
+	start, end, err := date_range(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(start) <= 0 || len(end) <= 0 {
+		return nil, errors.New("The reporting period needs a start and an end date")
+	}
+	rate := 0.0
+	if len(args) > 3 && len(args[3]) > 0 {
+		rate, err = strconv.ParseFloat(args[3], 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, errors.New("4th argument must be the indirect rate as a fraction, e.g. 0.26")
+		}
+	}
+	rateType := ""
+	if len(args) > 4 {
+		rateType = args[4]
+	}
+
+	// the award and the sub-awards it funds directly
+	subAwards := map[string]bool{}
+	awards, err := t.get_awards(stub)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(awards); i++ {
+		if awards[i].ParentAwardId == award.AwardId {
+			subAwards[awards[i].AwardId] = true
+		}
+	}
+
+	expsIndexAsBytes, err := stub.GetState(expIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get expenditure index")
+	}
+	var expIndex []string
+	json.Unmarshal(expsIndexAsBytes, &expIndex)
+	expenses := map[string]Expenditure{}
+	for i := 0; i < len(expIndex); i++ {
+		oneExp, err := t.get_expenditure(stub, expIndex[i])
+		if err != nil {
+			return nil, err
+		}
+		expenses[oneExp.ExpenditureId] = oneExp
+	}
+
+	// cumulative figures run to the end of the period, cash and indirect figures only cover the period
+	var receipts, disbursements, federalShare, periodShare, equipment, disallowed, obligations float64
+
+	reimbsIndexAsBytes, err := stub.GetState(reimbIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get reimbursement index")
+	}
+	var reimbIndex []string
+	json.Unmarshal(reimbsIndexAsBytes, &reimbIndex)
+	disallowedOn := map[string]float64{}
+	for i := 0; i < len(reimbIndex); i++ {
+		oneRem, err := t.get_reimbursement(stub, reimbIndex[i])
+		if err != nil {
+			return nil, err
+		}
+		if oneRem.Date > end {
+			continue
+		}
+		inPeriod := oneRem.Date >= start
+		paid, err := strconv.ParseFloat(oneRem.Amount, 64)
+		if err != nil {
+			return nil, errors.New("Reimbursement " + oneRem.ReimbursementId + " has a non-numeric amount")
+		}
+		notAllowed, err := strconv.ParseFloat(oneRem.DisallowedAmount, 64)
+		if err != nil {
+			notAllowed = 0
+		}
+
+		oneExp := expenses[oneRem.ExpenditureId]
+		if oneExp.AwardId == award.AwardId {
+			disallowed += notAllowed
+			disallowedOn[oneExp.ExpenditureId] += notAllowed
+			if inPeriod {
+				receipts += paid
+			}
+		}
+		if subAwards[oneExp.AwardId] {
+			// paying a sub-recipient is a disbursement of this award
+			federalShare += paid
+			if inPeriod {
+				disbursements += paid
+				periodShare += paid
+			}
+		}
+	}
+
+	for i := 0; i < len(expIndex); i++ {
+		oneExp := expenses[expIndex[i]]
+		if oneExp.Date > end || (oneExp.AwardId != award.AwardId && !subAwards[oneExp.AwardId]) {
+			continue
+		}
+		inPeriod := oneExp.Date >= start
+		amount, err := strconv.ParseFloat(oneExp.Amount, 64)
+		if err != nil {
+			return nil, errors.New("Expenditure " + oneExp.ExpenditureId + " has a non-numeric amount")
+		}
+		// an expense still pending is an obligation, not yet an expenditure
+		if oneExp.Status == "Pending" {
+			obligations += amount
+			continue
+		}
+		// only what was paid or approved flows out, a reversal nets out what it reverses
+		if oneExp.AwardId != award.AwardId || oneExp.Status == "Disallowed" {
+			continue
+		}
+		share := amount - disallowedOn[oneExp.ExpenditureId]
+		federalShare += share
+		if !inPeriod {
+			continue
+		}
+		disbursements += amount
+		periodShare += share
+		if strings.EqualFold(oneExp.Type, "Equipment") {
+			equipment += share
+		}
+	}
+
+	authorized, err := strconv.ParseFloat(award.Amount, 64)
+	if err != nil {
+		return nil, errors.New("Award " + award.AwardId + " has a non-numeric amount")
+	}
+	base := periodShare - equipment
+	indirect := math.Round(base*rate*100) / 100
+
+	report := FederalFinancialReport{}
+	report.AwardId = award.AwardId
+	report.GranteeId = award.GranteeId
+	report.PeriodStart = start
+	report.PeriodEnd = end
+	report.CashReceipts = format_amount(receipts)
+	report.CashDisbursements = format_amount(disbursements)
+	report.CashOnHand = format_amount(receipts - disbursements)
+	report.FederalFundsAuthorized = format_amount(authorized)
+	report.FederalShareExpenditures = format_amount(federalShare)
+	report.UnliquidatedObligations = format_amount(obligations)
+	report.FederalShareTotal = format_amount(federalShare + obligations)
+	report.UnobligatedBalance = format_amount(authorized - federalShare - obligations)
+	report.RecipientShareRequired = "0"
+	report.RecipientShareExpended = format_amount(disallowed)
+	report.RecipientShareRemaining = "0"
+	report.IndirectRateType = rateType
+	report.IndirectRate = strconv.FormatFloat(rate, 'f', -1, 64)
+	report.IndirectBase = format_amount(base)
+	report.IndirectAmount = format_amount(indirect)
+	report.IndirectFederalShare = format_amount(indirect)
+
+	result := FederalFinancialReportResult{Report: report}
+	result.Lines = []ReportLine{
+		{"5", "Recipient identifying number", report.GranteeId},
+		{"9a", "Reporting period start", report.PeriodStart},
+		{"9b", "Reporting period end", report.PeriodEnd},
+		{"10a", "Cash receipts", report.CashReceipts},
+		{"10b", "Cash disbursements", report.CashDisbursements},
+		{"10c", "Cash on hand", report.CashOnHand},
+		{"10d", "Total federal funds authorized", report.FederalFundsAuthorized},
+		{"10e", "Federal share of expenditures", report.FederalShareExpenditures},
+		{"10f", "Federal share of unliquidated obligations", report.UnliquidatedObligations},
+		{"10g", "Total federal share", report.FederalShareTotal},
+		{"10h", "Unobligated balance of federal funds", report.UnobligatedBalance},
+		{"10i", "Total recipient share required", report.RecipientShareRequired},
+		{"10j", "Recipient share of expenditures", report.RecipientShareExpended},
+		{"10k", "Remaining recipient share to be provided", report.RecipientShareRemaining},
+		{"11a", "Indirect expense type", report.IndirectRateType},
+		{"11b", "Indirect expense rate", report.IndirectRate},
+		{"11c", "Indirect expense period", report.PeriodStart + " " + report.PeriodEnd},
+		{"11d", "Indirect expense base", report.IndirectBase},
+		{"11e", "Indirect amount charged", report.IndirectAmount},
+		{"11f", "Federal share of indirect expense", report.IndirectFederalShare},
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+
+	return resultAsBytes, nil
+}
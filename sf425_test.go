@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFederalFinancialReportCashCoversThePeriod(t *testing.T) {
+	cc, m := setup(t)
+	m.attrs["role"] = "admin"
+
+	// the grantee was reimbursed and paid its sub-recipient in May and spent in August, EXP-202 is still pending
+	r := must(t)(cc.Query(m, "queryfederalfinancialreport", []string{"AWD-401", "2017-05-01", "2017-09-30", "0.1"}))
+	for _, want := range []string{`"cashreceipts":"15000"`, `"cashdisbursements":"19500"`, `"federalshareexpenditures":"19500"`, `"unliquidatedobligations":"15500"`, `"indirectbase":"19500"`} {
+		if !strings.Contains(r, want) {
+			t.Fatal(want, r)
+		}
+	}
+
+	// nothing was paid in September, but the federal share is still cumulative
+	r = must(t)(cc.Query(m, "queryfederalfinancialreport", []string{"AWD-401", "2017-09-01", "2017-09-30", "0.1"}))
+	for _, want := range []string{`"cashreceipts":"0"`, `"cashdisbursements":"0"`, `"federalshareexpenditures":"19500"`, `"indirectbase":"0"`, `"indirectamount":"0"`} {
+		if !strings.Contains(r, want) {
+			t.Fatal(want, r)
+		}
+	}
+}
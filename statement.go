@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Statements - a bank-style statement of one actor over a date range, built from the journal: the balances at the
+//				 start of the range, every entry posted to the actor within it with the running Spent, Received
+//				 and Reimbursed balances, and the closing balances with the totals of the range.
+//==============================================================================================================================
+
+// one movement on a statement, with the change to and running balance of Spent, Received and Reimbursed
+type StatementLine struct {
+	EntryId           string `json:"entryid"`
+	Date              string `json:"date"`
+	Function          string `json:"function"`
+	Reference         string `json:"reference"`
+	Counterparty      string `json:"counterparty"`
+	Spent             string `json:"spent"`
+	Received          string `json:"received"`
+	Reimbursed        string `json:"reimbursed"`
+	SpentBalance      string `json:"spentbalance"`
+	ReceivedBalance   string `json:"receivedbalance"`
+	ReimbursedBalance string `json:"reimbursedbalance"`
+}
+
+type Statement struct {
+	ActorId         string          `json:"actorid"`
+	ActorName       string          `json:"actorname"`
+	From            string          `json:"from"`
+	To              string          `json:"to"`
+	Opening         Actor           `json:"opening"`
+	Lines           []StatementLine `json:"lines"`
+	Closing         Actor           `json:"closing"`
+	TotalSpent      string          `json:"totalspent"`
+	TotalReceived   string          `json:"totalreceived"`
+	TotalReimbursed string          `json:"totalreimbursed"`
+}
+
+// ============================================================================================================================
+// Query Function - Called when query the statement of an actor
+// Function: the opening balances, every journal entry of the actor dated within the range with running balances, and
+// the closing balances and totals, as JSON or, with format csv, as CSV
+// Query
+// ============================================================================================================================
+func (t *SimpleChaincode) QueryStatement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//      0            1           2          3
+	// "actor id"  [from date]  [to date]  [json|csv]
+
+	if len(args) < 1 || len(args) > 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 to 4")
+	}
+	from, to, err := date_range(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	format := "json"
+	if len(args) > 3 && len(args[3]) > 0 {
+		format = args[3]
+	}
+	if format != "json" && format != "csv" {
+		return nil, errors.New("4th argument must be json or csv")
+	}
+
+	actorAsBytes, err := stub.GetState(args[0])
+	if err != nil {
+		return nil, errors.New("Failed to get actor")
+	}
+	actor := Actor{}
+	json.Unmarshal(actorAsBytes, &actor)
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
+	if actor.ActorId != args[0] || !view.can_see(actor.ActorId) {
+		return nil, errors.New("Actor " + args[0] + " does not exist")
+	}
+
+	statement := Statement{ActorId: actor.ActorId, ActorName: actor.ActorName, From: from, To: to}
+	wallet := Actor{ActorId: actor.ActorId, ActorName: actor.ActorName, Committed: "0", Reimbursed: "0", Awarded: "0", Spent: "0", Received: "0", Delegated: "0"}
+	var totalSpent, totalReceived, totalReimbursed float64
+	opened := false
+
+	entries, err := t.get_journal(stub)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(entries); i++ {
+		posted, err := journal_time(entries[i])
+		if err != nil {
+			return nil, err
+		}
+		day := posted.UTC().Format(dateFormat)
+		if len(to) > 0 && day > to {
+			continue
+		}
+		if !opened && (len(from) <= 0 || day >= from) {
+			statement.Opening = wallet
+			opened = true
+		}
+
+		line := StatementLine{EntryId: entries[i].EntryId, Date: entries[i].Date, Function: entries[i].Function, Reference: entries[i].Reference}
+		var spent, received, reimbursed float64
+		touches := false
+		for j := 0; j < len(entries[i].Lines); j++ {
+			journalLine := entries[i].Lines[j]
+			if journalLine.ActorId != actor.ActorId || journalLine.Account == openingAccount {
+				if len(journalLine.ActorId) > 0 && journalLine.ActorId != actor.ActorId {
+					line.Counterparty = journalLine.ActorId
+				}
+				continue
+			}
+			touches = true
+			change, err := apply_journal_line(&wallet, journalLine)
+			if err != nil {
+				return nil, err
+			}
+			switch journalLine.Account {
+			case "spent":
+				spent += change
+			case "received":
+				received += change
+			case "reimbursed":
+				reimbursed += change
+			}
+		}
+		if !touches || !opened {
+			// before the range only the opening balances move
+			continue
+		}
+
+		line.Spent = format_amount(spent)
+		line.Received = format_amount(received)
+		line.Reimbursed = format_amount(reimbursed)
+		line.SpentBalance = wallet.Spent
+		line.ReceivedBalance = wallet.Received
+		line.ReimbursedBalance = wallet.Reimbursed
+		statement.Lines = append(statement.Lines, line)
+		totalSpent += spent
+		totalReceived += received
+		totalReimbursed += reimbursed
+	}
+	if !opened {
+		statement.Opening = wallet
+	}
+	statement.Closing = wallet
+	statement.TotalSpent = format_amount(totalSpent)
+	statement.TotalReceived = format_amount(totalReceived)
+	statement.TotalReimbursed = format_amount(totalReimbursed)
+
+	if format == "csv" {
+		return statement_csv(statement)
+	}
+
+	statementAsBytes, _ := json.Marshal(statement)
+
+	return statementAsBytes, nil
+}
+
+// ============================================================================================================================
+// statement_csv - render a statement as CSV, one row per movement between an opening and a closing row
+// ============================================================================================================================
+func statement_csv(statement Statement) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+
+	rows := [][]string{
+		{"entryid", "date", "function", "reference", "counterparty", "spent", "received", "reimbursed", "spentbalance", "receivedbalance", "reimbursedbalance"},
+		{"", statement.From, "opening", statement.ActorId, "", "", "", "", statement.Opening.Spent, statement.Opening.Received, statement.Opening.Reimbursed},
+	}
+	for i := 0; i < len(statement.Lines); i++ {
+		line := statement.Lines[i]
+		rows = append(rows, []string{line.EntryId, line.Date, line.Function, line.Reference, line.Counterparty, line.Spent, line.Received, line.Reimbursed, line.SpentBalance, line.ReceivedBalance, line.ReimbursedBalance})
+	}
+	rows = append(rows, []string{"", statement.To, "closing", statement.ActorId, "", statement.TotalSpent, statement.TotalReceived, statement.TotalReimbursed, statement.Closing.Spent, statement.Closing.Received, statement.Closing.Reimbursed})
+
+	err := writer.WriteAll(rows)
+	if err != nil {
+		return nil, errors.New("Failed to write the statement as CSV")
+	}
+	return buffer.Bytes(), nil
+}
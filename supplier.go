@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Supplier registry - an actor can only be paid by Spend once it is registered as a supplier and an admin has
+//						verified it. The registry keeps the SHA-256 hash of the supplier's tax id, never the tax id
+//						itself. Admins also upload the debarment list, each upload replacing the previous one; every
+//						entry names a tax id hash and the dates the debarment is effective from and, optionally, to.
+//						Spend screens the payee against the latest list on the transaction date and keeps the
+//						result on the expenditure.
+//==============================================================================================================================
+
+type Supplier struct {
+	SupplierId   string `json:"supplierid"`
+	ActorId      string `json:"actorid"`
+	Name         string `json:"name"`
+	TaxIdHash    string `json:"taxidhash"`
+	Status       string `json:"status"`
+	VerifiedBy   string `json:"verifiedby"`
+	VerifiedDate string `json:"verifieddate"`
+}
+
+// one debarred tax id (tax id hash, name, effective date, optional end date, reason)
+type Debarment struct {
+	TaxIdHash     string `json:"taxidhash"`
+	Name          string `json:"name"`
+	EffectiveDate string `json:"effectivedate"`
+	EndDate       string `json:"enddate"`
+	Reason        string `json:"reason"`
+}
+
+// one upload of the debarment list
+type DebarmentList struct {
+	ListId       string      `json:"listid"`
+	UploadedBy   string      `json:"uploadedby"`
+	UploadedDate string      `json:"uploadeddate"`
+	Entries      []Debarment `json:"entries"`
+}
+
+// the screening of the payee made when an expense was spent (supplier, tax id hash, list checked, date, result)
+type SupplierScreening struct {
+	SupplierId      string `json:"supplierid"`
+	TaxIdHash       string `json:"taxidhash"`
+	SupplierStatus  string `json:"supplierstatus"`
+	DebarmentListId string `json:"debarmentlistid"`
+	Date            string `json:"date"`
+	Result          string `json:"result"`
+}
+
+var supplierIndexStr = "_supplierindex"   // Define an index variable to track all the suppliers stored in the world state
+var debarmentIndexStr = "_debarmentindex" // Define an index variable to track every upload of the debarment list
+
+// ============================================================================================================================
+// RegisterSupplier Function - Called when an actor registers as a supplier, or an admin registers it
+// Function: create Supplier struct, a new supplier is Unverified and so is a supplier whose tax id changed
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) RegisterSupplier(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//      0         1           2
+	// "actor id"  "name"  "tax id hash"
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+	if len(args[1]) <= 0 {
+		return nil, errors.New("2nd argument must be a non-empty string")
+	}
+	taxIdHash := strings.ToLower(args[2])
+	if !valid_sha256(taxIdHash) {
+		return nil, errors.New("3rd argument must be the hex SHA-256 hash of the tax id")
+	}
+
+	actorAsBytes, err := stub.GetState(args[0])
+	if err != nil {
+		return nil, errors.New("Failed to get actor")
+	}
+	actor := Actor{}
+	json.Unmarshal(actorAsBytes, &actor)
+	if actor.ActorId != args[0] {
+		return nil, errors.New("Actor " + args[0] + " does not exist")
+	}
+	if !t.caller_has_role(stub, "admin") {
+		callerId, err := t.get_caller_actor(stub)
+		if err != nil {
+			return nil, err
+		}
+		if callerId != actor.ActorId {
+			return nil, errors.New(callerId + " cannot register " + actor.ActorId + " as a supplier")
+		}
+	}
+
+	supplier, err := t.get_supplier(stub, actor.ActorId)
+	registered := err == nil
+	if !registered || supplier.TaxIdHash != taxIdHash {
+		supplier.Status = "Unverified"
+		supplier.VerifiedBy = ""
+		supplier.VerifiedDate = ""
+	}
+	supplier.SupplierId = supplier_key(actor.ActorId)
+	supplier.ActorId = actor.ActorId
+	supplier.Name = args[1]
+	supplier.TaxIdHash = taxIdHash
+
+	err = t.put_supplier(stub, supplier, !registered)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(supplier.SupplierId), nil
+}
+
+// ============================================================================================================================
+// VerifySupplier Function - Called when an admin has checked a supplier's registration
+// Function: update Supplier struct (status Verified or Rejected)
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) VerifySupplier(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//      0           1
+	// "actor id"  "verified|rejected"
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+	if !t.caller_has_role(stub, "admin") {
+		return nil, errors.New("Only an admin can verify suppliers")
+	}
+
+	var status string
+	switch strings.ToLower(args[1]) {
+	case "verified":
+		status = "Verified"
+	case "rejected":
+		status = "Rejected"
+	default:
+		return nil, errors.New("2nd argument must be verified or rejected")
+	}
+
+	supplier, err := t.get_supplier(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	// an admin certificate need not be bound to an actor, the record then names the role
+	callerId, err := t.get_caller_actor(stub)
+	if err != nil {
+		callerId = "admin"
+	}
+	current_time, err := tx_time(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	supplier.Status = status
+	supplier.VerifiedBy = callerId
+	supplier.VerifiedDate = current_time.Format(dateFormat)
+	err = t.put_supplier(stub, supplier, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// ============================================================================================================================
+// UploadDebarments Function - Called when an admin uploads the current debarment list
+// Function: create DebarmentList struct from a JSON array of debarments, the new list replaces the previous one for
+// screening and the previous uploads are kept
+// Invoke
+// ============================================================================================================================
+func (t *SimpleChaincode) UploadDebarments(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//        0
+	// "debarments json"
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+	if !t.caller_has_role(stub, "admin") {
+		return nil, errors.New("Only an admin can upload the debarment list")
+	}
+
+	var entries []Debarment
+	err := json.Unmarshal([]byte(args[0]), &entries)
+	if err != nil {
+		return nil, errors.New("1st argument must be a JSON array of debarments")
+	}
+	for i := 0; i < len(entries); i++ {
+		entries[i].TaxIdHash = strings.ToLower(entries[i].TaxIdHash)
+		if !valid_sha256(entries[i].TaxIdHash) {
+			return nil, errors.New("Debarment " + strconv.Itoa(i+1) + " must carry the hex SHA-256 hash of a tax id")
+		}
+		effective, err := time.Parse(dateFormat, entries[i].EffectiveDate)
+		if err != nil {
+			return nil, errors.New("Debarment " + strconv.Itoa(i+1) + " must have an effective date formatted as " + dateFormat)
+		}
+		if len(entries[i].EndDate) > 0 {
+			end, err := time.Parse(dateFormat, entries[i].EndDate)
+			if err != nil || end.Before(effective) {
+				return nil, errors.New("Debarment " + strconv.Itoa(i+1) + " must end on a date after it is effective")
+			}
+		}
+	}
+
+	// the list of an admin bound to no actor is recorded as uploaded by the role
+	callerId, err := t.get_caller_actor(stub)
+	if err != nil {
+		callerId = "admin"
+	}
+	current_time, err := tx_time(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	//get the debarment index
+	debarmentsAsBytes, err := stub.GetState(debarmentIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get debarment index")
+	}
+	var debarmentIndex []string
+	json.Unmarshal(debarmentsAsBytes, &debarmentIndex)
+
+	list := DebarmentList{}
+	list.ListId = "DBL-" + strconv.Itoa(len(debarmentIndex)+1)
+	list.UploadedBy = callerId
+	list.UploadedDate = current_time.Format(dateFormat)
+	list.Entries = entries
+
+	listAsBytes, _ := json.Marshal(list)
+	err = stub.PutState(list.ListId, listAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	//append the index
+	debarmentIndex = append(debarmentIndex, list.ListId)
+	jsonAsBytes, _ := json.Marshal(debarmentIndex)
+	err = stub.PutState(debarmentIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(list.ListId), nil
+}
+
+// ============================================================================================================================
+// Query Function - Called when query suppliers
+// Function: query all the registered suppliers the caller sees, optionally only those with one status
+// Query
+// ============================================================================================================================
+func (t *SimpleChaincode) QuerySuppliers(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//args[0] = optional status
+
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
+	suppliersAsBytes, err := stub.GetState(supplierIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get supplier index")
+	}
+	var supplierIndex []string
+	json.Unmarshal(suppliersAsBytes, &supplierIndex)
+
+	var result []Supplier
+	for i := 0; i < len(supplierIndex); i++ {
+		supplierAsBytes, err := stub.GetState(supplierIndex[i])
+		if err != nil {
+			return nil, errors.New("Failed to get supplier")
+		}
+		supplier := Supplier{}
+		json.Unmarshal(supplierAsBytes, &supplier)
+		if len(args) > 0 && len(args[0]) > 0 && !strings.EqualFold(supplier.Status, args[0]) {
+			continue
+		}
+		if !view.can_see(supplier.ActorId) {
+			continue
+		}
+		result = append(result, supplier)
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+
+	return resultAsBytes, nil
+}
+
+// ============================================================================================================================
+// Query Function - Called when query the debarment list
+// Function: query the latest upload of the debarment list, optionally only the entries effective on a date. A caller
+// that does not see every record only gets the entries of the suppliers it sees.
+// Query
+// ============================================================================================================================
+func (t *SimpleChaincode) QueryDebarments(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//args[0] = optional date
+
+	if len(args) > 0 && len(args[0]) > 0 {
+		_, err := time.Parse(dateFormat, args[0])
+		if err != nil {
+			return nil, errors.New("1st argument must be a date formatted as " + dateFormat)
+		}
+	}
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
+	list, err := t.latest_debarment_list(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// the tax id hashes of the suppliers the caller sees
+	visible := map[string]bool{}
+	if !view.all {
+		suppliersAsBytes, err := stub.GetState(supplierIndexStr)
+		if err != nil {
+			return nil, errors.New("Failed to get supplier index")
+		}
+		var supplierIndex []string
+		json.Unmarshal(suppliersAsBytes, &supplierIndex)
+		for i := 0; i < len(supplierIndex); i++ {
+			supplierAsBytes, err := stub.GetState(supplierIndex[i])
+			if err != nil {
+				return nil, errors.New("Failed to get supplier")
+			}
+			supplier := Supplier{}
+			json.Unmarshal(supplierAsBytes, &supplier)
+			if view.can_see(supplier.ActorId) {
+				visible[supplier.TaxIdHash] = true
+			}
+		}
+	}
+
+	var entries []Debarment
+	for i := 0; i < len(list.Entries); i++ {
+		if len(args) > 0 && len(args[0]) > 0 && !debarment_effective(list.Entries[i], args[0]) {
+			continue
+		}
+		if !view.all && !visible[list.Entries[i].TaxIdHash] {
+			continue
+		}
+		entries = append(entries, list.Entries[i])
+	}
+	list.Entries = entries
+
+	listAsBytes, _ := json.Marshal(list)
+
+	return listAsBytes, nil
+}
+
+// ============================================================================================================================
+// screen_supplier - check that a payee is a verified supplier that is not debarred on the date, and return the result
+// ============================================================================================================================
+func (t *SimpleChaincode) screen_supplier(stub shim.ChaincodeStubInterface, actorId string, date string) (SupplierScreening, error) {
+	supplier, err := t.get_supplier(stub, actorId)
+	if err != nil {
+		return SupplierScreening{}, errors.New(actorId + " is not a registered supplier")
+	}
+	if supplier.Status != "Verified" {
+		return SupplierScreening{}, errors.New("Supplier " + actorId + " is " + supplier.Status + " and cannot be paid")
+	}
+
+	list, err := t.latest_debarment_list(stub)
+	if err != nil {
+		return SupplierScreening{}, err
+	}
+	for i := 0; i < len(list.Entries); i++ {
+		if list.Entries[i].TaxIdHash == supplier.TaxIdHash && debarment_effective(list.Entries[i], date) {
+			return SupplierScreening{}, errors.New("Supplier " + actorId + " is debarred since " + list.Entries[i].EffectiveDate + ": " + list.Entries[i].Reason)
+		}
+	}
+
+	screening := SupplierScreening{}
+	screening.SupplierId = supplier.SupplierId
+	screening.TaxIdHash = supplier.TaxIdHash
+	screening.SupplierStatus = supplier.Status
+	screening.DebarmentListId = list.ListId
+	screening.Date = date
+	screening.Result = "Cleared"
+	return screening, nil
+}
+
+// ============================================================================================================================
+// debarment_effective - whether a debarment applies on a date
+// ============================================================================================================================
+func debarment_effective(debarment Debarment, date string) bool {
+	if date < debarment.EffectiveDate {
+		return false
+	}
+	return len(debarment.EndDate) <= 0 || date <= debarment.EndDate
+}
+
+// ============================================================================================================================
+// latest_debarment_list - the last uploaded debarment list, empty if none was uploaded
+// ============================================================================================================================
+func (t *SimpleChaincode) latest_debarment_list(stub shim.ChaincodeStubInterface) (DebarmentList, error) {
+	debarmentsAsBytes, err := stub.GetState(debarmentIndexStr)
+	if err != nil {
+		return DebarmentList{}, errors.New("Failed to get debarment index")
+	}
+	var debarmentIndex []string
+	json.Unmarshal(debarmentsAsBytes, &debarmentIndex)
+	if len(debarmentIndex) <= 0 {
+		return DebarmentList{}, nil
+	}
+
+	listAsBytes, err := stub.GetState(debarmentIndex[len(debarmentIndex)-1])
+	if err != nil {
+		return DebarmentList{}, errors.New("Failed to get debarment list")
+	}
+	list := DebarmentList{}
+	json.Unmarshal(listAsBytes, &list)
+	return list, nil
+}
+
+// ============================================================================================================================
+// get_supplier / put_supplier - read or store the supplier registration of an actor, put_supplier appends the index
+// for a new supplier
+// ============================================================================================================================
+func (t *SimpleChaincode) get_supplier(stub shim.ChaincodeStubInterface, actorId string) (Supplier, error) {
+	supplierAsBytes, err := stub.GetState(supplier_key(actorId))
+	if err != nil {
+		return Supplier{}, errors.New("Failed to get supplier")
+	}
+	supplier := Supplier{}
+	json.Unmarshal(supplierAsBytes, &supplier)
+	if supplier.ActorId != actorId {
+		return Supplier{}, errors.New("Supplier " + actorId + " is not registered")
+	}
+	return supplier, nil
+}
+
+func (t *SimpleChaincode) put_supplier(stub shim.ChaincodeStubInterface, supplier Supplier, isNew bool) error {
+	supplierAsBytes, _ := json.Marshal(supplier)
+	err := stub.PutState(supplier.SupplierId, supplierAsBytes)
+	if err != nil {
+		return err
+	}
+	if !isNew {
+		return nil
+	}
+
+	//get the supplier index
+	suppliersAsBytes, err := stub.GetState(supplierIndexStr)
+	if err != nil {
+		return errors.New("Failed to get supplier index")
+	}
+	var supplierIndex []string
+	json.Unmarshal(suppliersAsBytes, &supplierIndex)
+
+	//append the index
+	supplierIndex = append(supplierIndex, supplier.SupplierId)
+	jsonAsBytes, _ := json.Marshal(supplierIndex)
+	return stub.PutState(supplierIndexStr, jsonAsBytes)
+}
+
+// ============================================================================================================================
+// supplier_key / valid_sha256 - the world state key of a supplier, and the check that a string is a hex SHA-256 hash
+// ============================================================================================================================
+func supplier_key(actorId string) string {
+	return "SUP-" + actorId
+}
+
+func valid_sha256(hash string) bool {
+	if len(hash) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAdminWithoutActorKeepsTheRegistry(t *testing.T) {
+	cc, m := setup(t)
+	delete(m.attrs, "actorid")
+
+	_, err := cc.Invoke(m, "verifysupplier", []string{"ACT-104", "rejected"})
+	fails(t, nil, err, "Only an admin can verify suppliers")
+	_, err = cc.Invoke(m, "uploaddebarments", []string{`[]`})
+	fails(t, nil, err, "Only an admin can upload the debarment list")
+
+	m.attrs["role"] = "admin"
+	must(t)(cc.Invoke(m, "registersupplier", []string{"ACT-103", "JHU", "b0583770ec509e79040a444624d55be4db44cb857be315b2b1a8413c9bf7f6a2"}))
+	must(t)(cc.Invoke(m, "verifysupplier", []string{"ACT-103", "verified"}))
+	r := must(t)(cc.Query(m, "querysuppliers", nil))
+	if !strings.Contains(r, `"actorid":"ACT-103","name":"JHU","taxidhash":"b0583770ec509e79040a444624d55be4db44cb857be315b2b1a8413c9bf7f6a2","status":"Verified","verifiedby":"admin"`) {
+		t.Fatal(r)
+	}
+	must(t)(cc.Invoke(m, "uploaddebarments", []string{`[{"taxidhash":"0000000000000000000000000000000000000000000000000000000000000000","name":"Other","effectivedate":"2017-07-01","reason":"fraud"}]`}))
+	r = must(t)(cc.Query(m, "querydebarments", nil))
+	if !strings.Contains(r, `"uploadedby":"admin"`) {
+		t.Fatal(r)
+	}
+}
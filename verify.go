@@ -0,0 +1,525 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Ledger verification - recompute every derived figure from the underlying records and check every index entry.
+//						  Nothing here writes to the world state.
+//==============================================================================================================================
+
+// one problem found by verifyledger (kind, key, field, expected, actual, message)
+type LedgerDiscrepancy struct {
+	Kind     string `json:"kind"`
+	Key      string `json:"key"`
+	Field    string `json:"field"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+	Message  string `json:"message"`
+}
+
+type LedgerReport struct {
+	Consistent         bool                `json:"consistent"`
+	Discrepancies      []LedgerDiscrepancy `json:"discrepancies"`
+	OrphanedKeys       []string            `json:"orphanedkeys"`
+	DanglingReferences []LedgerDiscrepancy `json:"danglingreferences"`
+}
+
+var walletAccounts = []string{"committed", "reimbursed", "awarded", "spent", "received", "delegated"}
+
+// ============================================================================================================================
+// Query Function - Called when verify the ledger
+// Function: check that every wallet equals both the journal and the sum of its expenditures and reimbursements, that
+// every index entry points to a record, that every record is indexed, and that every reimbursement, journal entry and
+// supplier invoice or payment index entry points to an existing record. Only the problems of records the caller sees
+// are listed, and Consistent covers them.
+// Query
+// ============================================================================================================================
+func (t *SimpleChaincode) VerifyLedger(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	report := LedgerReport{}
+
+	//------------------------------check the indexes----------------------------------------------
+	actorIndex, err := t.verify_index(stub, &report, accountIndexStr, "ACT-", false)
+	if err != nil {
+		return nil, err
+	}
+	expIndex, err := t.verify_index(stub, &report, expIndexStr, "EXP-", false)
+	if err != nil {
+		return nil, err
+	}
+	reimbIndex, err := t.verify_index(stub, &report, reimbIndexStr, "REM-", false)
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.verify_index(stub, &report, journalIndexStr, "JNL-", false)
+	if err != nil {
+		return nil, err
+	}
+	awardIndex, err := t.verify_index(stub, &report, awardIndexStr, "AWD-", false)
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.verify_index(stub, &report, delegationIndexStr, "DLG-", false)
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.verify_index(stub, &report, supplierIndexStr, "SUP-", false)
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.verify_index(stub, &report, debarmentIndexStr, "DBL-", false)
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.verify_index(stub, &report, alertIndexStr, "ALR-", false)
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.verify_index(stub, &report, ruleIndexStr, ruleKeyPrefix, true)
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.verify_index(stub, &report, chainIndexStr, chainKeyPrefix, true)
+	if err != nil {
+		return nil, err
+	}
+	err = t.verify_requests(stub, &report)
+	if err != nil {
+		return nil, err
+	}
+
+	awards := map[string]bool{}
+	for i := 0; i < len(awardIndex); i++ {
+		award := Award{}
+		awardAsBytes, err := stub.GetState(awardIndex[i])
+		if err != nil {
+			return nil, errors.New("Failed to get award")
+		}
+		json.Unmarshal(awardAsBytes, &award)
+		awards[award.AwardId] = award.AwardId == awardIndex[i]
+	}
+
+	actors := map[string]Actor{}
+	for i := 0; i < len(actorIndex); i++ {
+		actorAsBytes, err := stub.GetState(actorIndex[i])
+		if err != nil {
+			return nil, errors.New("Failed to get actor")
+		}
+		actor := Actor{}
+		json.Unmarshal(actorAsBytes, &actor)
+		if actor.ActorId == actorIndex[i] {
+			actors[actor.ActorId] = actor
+		}
+	}
+
+	expenses := map[string]Expenditure{}
+	var expList []Expenditure
+	for i := 0; i < len(expIndex); i++ {
+		expAsBytes, err := stub.GetState(expIndex[i])
+		if err != nil {
+			return nil, errors.New("Failed to get expenditure")
+		}
+		oneExp := Expenditure{}
+		json.Unmarshal(expAsBytes, &oneExp)
+		if oneExp.ExpenditureId == expIndex[i] {
+			expenses[oneExp.ExpenditureId] = oneExp
+			expList = append(expList, oneExp)
+		}
+	}
+
+	reimbursements := map[string]Reimbursement{}
+	var remList []Reimbursement
+	for i := 0; i < len(reimbIndex); i++ {
+		remAsBytes, err := stub.GetState(reimbIndex[i])
+		if err != nil {
+			return nil, errors.New("Failed to get reimbursement")
+		}
+		oneRem := Reimbursement{}
+		json.Unmarshal(remAsBytes, &oneRem)
+		if oneRem.ReimbursementId == reimbIndex[i] {
+			reimbursements[oneRem.ReimbursementId] = oneRem
+			remList = append(remList, oneRem)
+		}
+	}
+
+	err = t.verify_supplier_index(stub, &report, invoiceIndexStr, expenses)
+	if err != nil {
+		return nil, err
+	}
+	err = t.verify_supplier_index(stub, &report, paymentIndexStr, expenses)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := t.get_journal(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	//------------------------------recompute the wallets----------------------------------------------
+	journal := map[string]float64{}
+	opening := map[string]float64{}
+	for i := 0; i < len(entries); i++ {
+		for j := 0; j < len(entries[i].Lines); j++ {
+			line := entries[i].Lines[j]
+			change, err := line_balance(line)
+			if err != nil {
+				return nil, errors.New("Journal entry " + entries[i].EntryId + " has a non-numeric line")
+			}
+			journal[line.ActorId+"/"+line.Account] += change
+			if entries[i].Function == "opening" {
+				opening[line.ActorId+"/"+line.Account] += change
+			}
+		}
+	}
+
+	records := map[string]float64{}
+	for key, value := range opening {
+		records[key] = value
+	}
+	for i := 0; i < len(expList); i++ {
+		amount, err := strconv.ParseFloat(expList[i].Amount, 64)
+		if err != nil {
+			report.Discrepancies = append(report.Discrepancies, LedgerDiscrepancy{Kind: "record", Key: expList[i].ExpenditureId, Field: "amount", Actual: expList[i].Amount, Message: "amount is not numeric"})
+			continue
+		}
+		records[expList[i].FromActor+"/spent"] += amount
+		records[expList[i].ToActor+"/received"] += amount
+	}
+	for i := 0; i < len(remList); i++ {
+		amount, err := strconv.ParseFloat(remList[i].Amount, 64)
+		if err != nil {
+			report.Discrepancies = append(report.Discrepancies, LedgerDiscrepancy{Kind: "record", Key: remList[i].ReimbursementId, Field: "amount", Actual: remList[i].Amount, Message: "amount is not numeric"})
+			continue
+		}
+		records[remList[i].FromActor+"/reimbursed"] += amount
+		records[remList[i].ToActor+"/received"] += amount
+	}
+
+	for i := 0; i < len(actorIndex); i++ {
+		actor, ok := actors[actorIndex[i]]
+		if !ok {
+			continue
+		}
+		for j := 0; j < len(walletAccounts); j++ {
+			key := actor.ActorId + "/" + walletAccounts[j]
+			counter, _ := actor_counter(&actor, walletAccounts[j])
+			wallet, err := strconv.ParseFloat(*counter, 64)
+			if err != nil {
+				report.Discrepancies = append(report.Discrepancies, LedgerDiscrepancy{Kind: "wallet", Key: actor.ActorId, Field: walletAccounts[j], Actual: *counter, Message: "wallet figure is not numeric"})
+				continue
+			}
+			if math.Abs(wallet-journal[key]) > 0.000001 {
+				report.Discrepancies = append(report.Discrepancies, LedgerDiscrepancy{Kind: "wallet", Key: actor.ActorId, Field: walletAccounts[j], Expected: format_amount(journal[key]), Actual: *counter, Message: "wallet does not match the journal"})
+			}
+			// awards and delegations only exist in the journal
+			if walletAccounts[j] != "spent" && walletAccounts[j] != "received" && walletAccounts[j] != "reimbursed" {
+				continue
+			}
+			if math.Abs(wallet-records[key]) > 0.000001 {
+				report.Discrepancies = append(report.Discrepancies, LedgerDiscrepancy{Kind: "wallet", Key: actor.ActorId, Field: walletAccounts[j], Expected: format_amount(records[key]), Actual: *counter, Message: "wallet does not match the expenditures and reimbursements"})
+			}
+		}
+	}
+
+	//------------------------------check the references----------------------------------------------
+	for i := 0; i < len(expList); i++ {
+		oneExp := expList[i]
+		t.verify_actor_ref(&report, actors, oneExp.ExpenditureId, "fromactor", oneExp.FromActor)
+		t.verify_actor_ref(&report, actors, oneExp.ExpenditureId, "toactor", oneExp.ToActor)
+		if len(oneExp.AwardId) > 0 && !awards[oneExp.AwardId] {
+			report.DanglingReferences = append(report.DanglingReferences, LedgerDiscrepancy{Kind: "reference", Key: oneExp.ExpenditureId, Field: "awardid", Actual: oneExp.AwardId, Message: "award does not exist"})
+		}
+		if len(oneExp.ReversalOf) > 0 {
+			if _, ok := expenses[oneExp.ReversalOf]; !ok {
+				report.DanglingReferences = append(report.DanglingReferences, LedgerDiscrepancy{Kind: "reference", Key: oneExp.ExpenditureId, Field: "reversalof", Actual: oneExp.ReversalOf, Message: "reversed expenditure does not exist"})
+			}
+		}
+		if len(oneExp.ReversedBy) > 0 {
+			if _, ok := expenses[oneExp.ReversedBy]; !ok {
+				report.DanglingReferences = append(report.DanglingReferences, LedgerDiscrepancy{Kind: "reference", Key: oneExp.ExpenditureId, Field: "reversedby", Actual: oneExp.ReversedBy, Message: "reversing expenditure does not exist"})
+			}
+		}
+	}
+
+	for i := 0; i < len(remList); i++ {
+		oneRem := remList[i]
+		t.verify_actor_ref(&report, actors, oneRem.ReimbursementId, "fromactor", oneRem.FromActor)
+		t.verify_actor_ref(&report, actors, oneRem.ReimbursementId, "toactor", oneRem.ToActor)
+		if len(oneRem.ReversalOf) > 0 {
+			if _, ok := reimbursements[oneRem.ReversalOf]; !ok {
+				report.DanglingReferences = append(report.DanglingReferences, LedgerDiscrepancy{Kind: "reference", Key: oneRem.ReimbursementId, Field: "reversalof", Actual: oneRem.ReversalOf, Message: "reversed reimbursement does not exist"})
+			}
+		}
+		if len(oneRem.ReversedBy) > 0 {
+			if _, ok := reimbursements[oneRem.ReversedBy]; !ok {
+				report.DanglingReferences = append(report.DanglingReferences, LedgerDiscrepancy{Kind: "reference", Key: oneRem.ReimbursementId, Field: "reversedby", Actual: oneRem.ReversedBy, Message: "reversing reimbursement does not exist"})
+			}
+		}
+
+		oneExp, ok := expenses[oneRem.ExpenditureId]
+		if !ok {
+			report.DanglingReferences = append(report.DanglingReferences, LedgerDiscrepancy{Kind: "reference", Key: oneRem.ReimbursementId, Field: "expenditureid", Actual: oneRem.ExpenditureId, Message: "reimbursed expenditure does not exist"})
+			continue
+		}
+		// a reimbursement still in force must pay for a decided expenditure
+		if len(oneRem.ReversalOf) == 0 && len(oneRem.ReversedBy) == 0 && oneExp.Status != "Approved" && oneExp.Status != "Partially Approved" && oneExp.Status != "Disallowed" {
+			report.DanglingReferences = append(report.DanglingReferences, LedgerDiscrepancy{Kind: "reference", Key: oneRem.ReimbursementId, Field: "expenditureid", Expected: "Approved", Actual: oneExp.Status, Message: "reimbursed expenditure is not approved"})
+		}
+
+		paid, err1 := strconv.ParseFloat(oneRem.Amount, 64)
+		requested, err2 := strconv.ParseFloat(oneRem.RequestedAmount, 64)
+		disallowed, err3 := strconv.ParseFloat(oneRem.DisallowedAmount, 64)
+		if err1 == nil && err2 == nil && err3 == nil && len(oneRem.ReversalOf) == 0 && math.Abs(paid+disallowed-requested) > 0.000001 {
+			report.Discrepancies = append(report.Discrepancies, LedgerDiscrepancy{Kind: "record", Key: oneRem.ReimbursementId, Field: "requestedamount", Expected: format_amount(paid + disallowed), Actual: oneRem.RequestedAmount, Message: "paid and disallowed amounts do not add up to the requested amount"})
+		}
+	}
+
+	for i := 0; i < len(entries); i++ {
+		entry := entries[i]
+		for j := 0; j < len(entry.Lines); j++ {
+			if entry.Lines[j].Account != openingAccount {
+				t.verify_actor_ref(&report, actors, entry.EntryId, "actorid", entry.Lines[j].ActorId)
+			}
+		}
+		found := true
+		switch entry.Function {
+		case "spend", "reversespend":
+			_, found = expenses[entry.Reference]
+		case "fund", "reversefund":
+			_, found = reimbursements[entry.Reference]
+		case "award", "delegate", "returnaward", "returndelegate":
+			found = awards[entry.Reference]
+		}
+		if len(entry.Reference) > 0 && !found {
+			report.DanglingReferences = append(report.DanglingReferences, LedgerDiscrepancy{Kind: "reference", Key: entry.EntryId, Field: "reference", Actual: entry.Reference, Message: "journal entry references a record that does not exist"})
+		}
+	}
+
+	view, err := t.caller_visibility(stub)
+	if err != nil {
+		return nil, err
+	}
+	if !view.all {
+		report.Discrepancies, err = visible_discrepancies(stub, view, report.Discrepancies)
+		if err != nil {
+			return nil, err
+		}
+		report.DanglingReferences, err = visible_discrepancies(stub, view, report.DanglingReferences)
+		if err != nil {
+			return nil, err
+		}
+		var orphanedKeys []string
+		for i := 0; i < len(report.OrphanedKeys); i++ {
+			recordAsBytes, err := stub.GetState(report.OrphanedKeys[i])
+			if err != nil {
+				return nil, errors.New("Failed to get " + report.OrphanedKeys[i])
+			}
+			if view.can_see_record(report.OrphanedKeys[i], recordAsBytes) {
+				orphanedKeys = append(orphanedKeys, report.OrphanedKeys[i])
+			}
+		}
+		report.OrphanedKeys = orphanedKeys
+	}
+
+	// a caller only learns about the problems it sees
+	report.Consistent = len(report.Discrepancies) == 0 && len(report.OrphanedKeys) == 0 && len(report.DanglingReferences) == 0
+
+	reportAsBytes, _ := json.Marshal(report)
+
+	return reportAsBytes, nil
+}
+
+// ============================================================================================================================
+// visible_discrepancies - the problems found on records the caller sees
+// ============================================================================================================================
+func visible_discrepancies(stub shim.ChaincodeStubInterface, view visibility, discrepancies []LedgerDiscrepancy) ([]LedgerDiscrepancy, error) {
+	var visible []LedgerDiscrepancy
+	for i := 0; i < len(discrepancies); i++ {
+		recordAsBytes, err := stub.GetState(discrepancies[i].Key)
+		if err != nil {
+			return nil, errors.New("Failed to get " + discrepancies[i].Key)
+		}
+		if view.can_see_record(discrepancies[i].Key, recordAsBytes) {
+			visible = append(visible, discrepancies[i])
+		}
+	}
+	return visible, nil
+}
+
+// ============================================================================================================================
+// verify_index - check that every entry of an index points to a record with that id, that no id is listed twice and
+// that every record stored under the index's key prefix is listed. An index of rules or chains lists bare ids, their
+// records are stored under the id with the key prefix in front
+// ============================================================================================================================
+func (t *SimpleChaincode) verify_index(stub shim.ChaincodeStubInterface, report *LedgerReport, indexStr string, prefix string, keyed bool) ([]string, error) {
+	indexAsBytes, err := stub.GetState(indexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get index " + indexStr)
+	}
+	var index []string
+	json.Unmarshal(indexAsBytes, &index)
+
+	type keyedRecord struct {
+		ActorId         string `json:"actorid"`
+		ExpenditureId   string `json:"expenditureid"`
+		ReimbursementId string `json:"reimbursementid"`
+		EntryId         string `json:"entryid"`
+		AwardId         string `json:"awardid"`
+		DelegationId    string `json:"delegationid"`
+		SupplierId      string `json:"supplierid"`
+		ListId          string `json:"listid"`
+		AlertId         string `json:"alertid"`
+		RuleId          string `json:"ruleid"`
+		ChainId         string `json:"chainid"`
+	}
+
+	listed := map[string]bool{}
+	for i := 0; i < len(index); i++ {
+		key := index[i]
+		if keyed {
+			key = prefix + index[i]
+		}
+		if listed[key] {
+			report.Discrepancies = append(report.Discrepancies, LedgerDiscrepancy{Kind: "index", Key: indexStr, Field: index[i], Message: "id is listed more than once"})
+			continue
+		}
+		listed[key] = true
+
+		recordAsBytes, err := stub.GetState(key)
+		if err != nil {
+			return nil, errors.New("Failed to get " + key)
+		}
+		if recordAsBytes == nil {
+			report.DanglingReferences = append(report.DanglingReferences, LedgerDiscrepancy{Kind: "index", Key: indexStr, Field: index[i], Message: "indexed record does not exist"})
+			continue
+		}
+		record := keyedRecord{}
+		json.Unmarshal(recordAsBytes, &record)
+		if record.ActorId != index[i] && record.ExpenditureId != index[i] && record.ReimbursementId != index[i] && record.EntryId != index[i] && record.AwardId != index[i] && record.DelegationId != index[i] && record.SupplierId != index[i] && record.ListId != index[i] && record.AlertId != index[i] && record.RuleId != index[i] && record.ChainId != index[i] {
+			report.Discrepancies = append(report.Discrepancies, LedgerDiscrepancy{Kind: "index", Key: indexStr, Field: index[i], Message: "record stored under this key carries a different id"})
+		}
+	}
+
+	keysIter, err := stub.RangeQueryState(prefix, prefix+"~")
+	if err != nil {
+		return nil, errors.New("Failed to scan " + prefix + " keys")
+	}
+	defer keysIter.Close()
+	for keysIter.HasNext() {
+		key, _, err := keysIter.Next()
+		if err != nil {
+			return nil, errors.New("Failed to scan " + prefix + " keys")
+		}
+		if !listed[key] {
+			report.OrphanedKeys = append(report.OrphanedKeys, key)
+		}
+	}
+
+	return index, nil
+}
+
+// ============================================================================================================================
+// verify_requests - check that every client request is stored under the key of its caller and request id, a record
+// stored under any other REQ- key is never found by a replay
+// ============================================================================================================================
+func (t *SimpleChaincode) verify_requests(stub shim.ChaincodeStubInterface, report *LedgerReport) error {
+	keysIter, err := stub.RangeQueryState("REQ-", "REQ-~")
+	if err != nil {
+		return errors.New("Failed to scan REQ- keys")
+	}
+	defer keysIter.Close()
+	for keysIter.HasNext() {
+		key, requestAsBytes, err := keysIter.Next()
+		if err != nil {
+			return errors.New("Failed to scan REQ- keys")
+		}
+		request := ClientRequest{}
+		json.Unmarshal(requestAsBytes, &request)
+		if len(request.RequestId) <= 0 || request_key(request.CallerId, request.RequestId) != key {
+			report.OrphanedKeys = append(report.OrphanedKeys, key)
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// verify_supplier_index - check that every entry of the per-supplier invoice or payment indexes points to an existing
+// expenditure that paid that supplier
+// ============================================================================================================================
+func (t *SimpleChaincode) verify_supplier_index(stub shim.ChaincodeStubInterface, report *LedgerReport, indexStr string, expenses map[string]Expenditure) error {
+	keysIter, err := stub.RangeQueryState(indexStr+"-", indexStr+"-~")
+	if err != nil {
+		return errors.New("Failed to scan " + indexStr + " keys")
+	}
+	defer keysIter.Close()
+	for keysIter.HasNext() {
+		key, indexAsBytes, err := keysIter.Next()
+		if err != nil {
+			return errors.New("Failed to scan " + indexStr + " keys")
+		}
+		supplierId := strings.TrimPrefix(key, indexStr+"-")
+
+		// the invoice index maps invoice numbers to expenditures, the payment index lists the payments in order
+		var fields, expIds []string
+		if indexStr == invoiceIndexStr {
+			invoiceIndex := map[string]string{}
+			json.Unmarshal(indexAsBytes, &invoiceIndex)
+			for invoiceNumber := range invoiceIndex {
+				fields = append(fields, invoiceNumber)
+			}
+			sort.Strings(fields)
+			for i := 0; i < len(fields); i++ {
+				expIds = append(expIds, invoiceIndex[fields[i]])
+			}
+		} else {
+			var paymentIndex []PaymentIndexEntry
+			json.Unmarshal(indexAsBytes, &paymentIndex)
+			for i := 0; i < len(paymentIndex); i++ {
+				fields = append(fields, strconv.Itoa(i))
+				expIds = append(expIds, paymentIndex[i].ExpenditureId)
+			}
+		}
+
+		for i := 0; i < len(expIds); i++ {
+			oneExp, ok := expenses[expIds[i]]
+			if !ok {
+				report.DanglingReferences = append(report.DanglingReferences, LedgerDiscrepancy{Kind: "index", Key: key, Field: fields[i], Actual: expIds[i], Message: "indexed expenditure does not exist"})
+				continue
+			}
+			if oneExp.ToActor != supplierId {
+				report.Discrepancies = append(report.Discrepancies, LedgerDiscrepancy{Kind: "index", Key: key, Field: fields[i], Expected: supplierId, Actual: oneExp.ToActor, Message: "indexed expenditure paid another supplier"})
+			}
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// verify_actor_ref - record a dangling reference when a record names an actor that does not exist
+// ============================================================================================================================
+func (t *SimpleChaincode) verify_actor_ref(report *LedgerReport, actors map[string]Actor, key string, field string, actorId string) {
+	if _, ok := actors[actorId]; !ok {
+		report.DanglingReferences = append(report.DanglingReferences, LedgerDiscrepancy{Kind: "reference", Key: key, Field: field, Actual: actorId, Message: "actor does not exist"})
+	}
+}
+
+// ============================================================================================================================
+// format_amount - render an amount the way the wallets and records store it
+// ============================================================================================================================
+func format_amount(amount float64) string {
+	if amount == 0 {
+		// a negated zero is written as 0, not -0
+		amount = 0
+	}
+	return strconv.FormatFloat(amount, 'f', -1, 64)
+}
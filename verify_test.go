@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerifyLedgerChecksEveryKeyFamily(t *testing.T) {
+	cc, m := setup(t)
+	m.attrs["role"] = "admin"
+	m.attrs["actorid"] = "ACT-101"
+	must(t)(cc.Invoke(m, "putrule", []string{"R-1", "AWD-401", "Alcohol", "always", "", "reject", "Alcohol is unallowable"}))
+	must(t)(cc.Invoke(m, "putapprovalchain", []string{"CH-1", "AWD-401", "1000", "", "ACT-101"}))
+	must(t)(cc.Invoke(m, "spend", []string{"requestid=R-1", "ACT-102", "ACT-104", "20", "Travel", `{"invoicenumber":"INV-1"}`}))
+	r := must(t)(cc.Query(m, "verifyledger", nil))
+	if !strings.Contains(r, `"consistent":true`) {
+		t.Fatal(r)
+	}
+
+	// records nothing lists, a listed rule that is gone and index entries of expenses that do not exist
+	m.state["RULE-R-2"] = []byte(`{"ruleid":"R-2"}`)
+	m.state["CHAIN-CH-2"] = []byte(`{"chainid":"CH-2"}`)
+	m.state["REQ-9-ACT-102-R-2"] = []byte(`{}`)
+	delete(m.state, "RULE-R-1")
+	m.state["_invoiceindex-ACT-104"] = []byte(`{"INV1":"EXP-210","INV2":"EXP-999"}`)
+	m.state["_paymentindex-ACT-103"] = []byte(`[{"expenditureid":"EXP-210","amount":"20","currency":"USD","date":"2017-07-14"}]`)
+	r = must(t)(cc.Query(m, "verifyledger", nil))
+	for _, expected := range []string{
+		`"consistent":false`,
+		`"orphanedkeys":["RULE-R-2","CHAIN-CH-2","REQ-9-ACT-102-R-2"]`,
+		`{"kind":"index","key":"_ruleindex","field":"R-1","expected":"","actual":"","message":"indexed record does not exist"}`,
+		`{"kind":"index","key":"_invoiceindex-ACT-104","field":"INV2","expected":"","actual":"EXP-999","message":"indexed expenditure does not exist"}`,
+		`{"kind":"index","key":"_paymentindex-ACT-103","field":"0","expected":"ACT-103","actual":"ACT-104","message":"indexed expenditure paid another supplier"}`,
+	} {
+		if !strings.Contains(r, expected) {
+			t.Fatal(expected, r)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// hides - fail if a query result names any of the records of ACT-101 and ACT-102 that ACT-103 may not see
+func hides(t *testing.T, result string) {
+	for _, id := range []string{"ACT-101", "EXP-201", "EXP-202", "EXP-205", "EXP-210", "EXP-211", "REM-301", "REM-304", "AWD-401"} {
+		if strings.Contains(result, `"`+id+`"`) {
+			t.Fatal(id, result)
+		}
+	}
+}
+
+// setup_visibility - the demo ledger with an alert, a delegation, an overdue approval, a suspected duplicate and a
+// disallowed cost on the side of ACT-101 and ACT-102, queried by ACT-103 which only sees its own records
+func setup_visibility(t *testing.T) (*SimpleChaincode, *mockStub) {
+	cc, m := setup(t)
+	m.attrs["actorid"] = "ACT-101"
+	must(t)(cc.Invoke(m, "setalertrules", []string{"AWD-401", `[{"type":"funds","thresholds":["1"]}]`}))
+	must(t)(cc.Invoke(m, "setapprovalsla", []string{"AWD-401", "1", "ACT-101"}))
+	must(t)(cc.Invoke(m, "delegateapproval", []string{"ACT-104", "2017-07-01", "2017-12-31"}))
+	must(t)(cc.Invoke(m, "approveexpense", []string{"ACT-101", "EXP-202", "7000", "1000", "AUDIT"}))
+
+	m.attrs["actorid"] = "ACT-102"
+	must(t)(cc.Invoke(m, "spend", []string{"ACT-102", "ACT-104", "640", "Travel", `{"awardid":"AWD-401","invoicenumber":"INV-1"}`}))
+	must(t)(cc.Invoke(m, "spend", []string{"ACT-102", "ACT-104", "640", "Travel", `{"awardid":"AWD-401","invoicenumber":"INV-2"}`}))
+	m.ts += 5 * 86400
+
+	// every query below is asked as an admin first, so it is known to hold hidden records
+	m.attrs["actorid"] = ""
+	m.attrs["role"] = "admin"
+	for _, q := range [][]string{{"queryalerts"}, {"querydelegations"}, {"queryoverdueapprovals"}, {"querysuspectedduplicates"}, {"querydisallowedcosts"}} {
+		r := must(t)(cc.Query(m, q[0], nil))
+		if !strings.Contains(r, `"ACT-101"`) && !strings.Contains(r, `"EXP-211"`) && !strings.Contains(r, `"REM-308"`) {
+			t.Fatal(q[0], r)
+		}
+	}
+
+	m.attrs["role"] = ""
+	m.attrs["actorid"] = "ACT-103"
+	return cc, m
+}
+
+func TestVisibilityOfWalletAndJournalQueries(t *testing.T) {
+	cc, m := setup_visibility(t)
+
+	r := must(t)(cc.Query(m, "querywalletasof", []string{"", "2017-12-31"}))
+	hides(t, r)
+	if strings.Contains(r, `"ACT-102"`) || !strings.Contains(r, `"actorid":"ACT-103"`) {
+		t.Fatal(r)
+	}
+	_, err := cc.Query(m, "querywalletasof", []string{"ACT-102", "2017-12-31"})
+	fails(t, nil, err, "Actor ACT-102 does not exist")
+
+	_, err = cc.Query(m, "querystatement", []string{"ACT-102"})
+	fails(t, nil, err, "Actor ACT-102 does not exist")
+	r = must(t)(cc.Query(m, "querystatement", []string{"ACT-103"}))
+	hides(t, r)
+
+	r = must(t)(cc.Query(m, "queryjournal", nil))
+	hides(t, r)
+	if !strings.Contains(r, `"reference":"EXP-206"`) {
+		t.Fatal(r)
+	}
+
+	r = must(t)(cc.Query(m, "querytrialbalance", nil))
+	hides(t, r)
+	if strings.Contains(r, `"actorid":"ACT-102"`) || !strings.Contains(r, `"balanced":true`) || !strings.Contains(r, `"walletsmatch":true`) {
+		t.Fatal(r)
+	}
+}
+
+func TestVisibilityOfReportQueries(t *testing.T) {
+	cc, m := setup_visibility(t)
+
+	r := must(t)(cc.Query(m, "queryaggregate", []string{"expenditures", "actor"}))
+	if strings.Contains(r, `"ACT-102"`) || !strings.Contains(r, `"key":"ACT-103","count":4`) {
+		t.Fatal(r)
+	}
+	r = must(t)(cc.Query(m, "queryaggregate", []string{"reimbursements", "award"}))
+	if strings.Contains(r, `"AWD-401"`) {
+		t.Fatal(r)
+	}
+
+	r = must(t)(cc.Query(m, "queryaging", nil))
+	hides(t, r)
+	if strings.Contains(r, `"granteeid":"ACT-102"`) || !strings.Contains(r, `"expenditureid":"EXP-207"`) {
+		t.Fatal(r)
+	}
+
+	r = must(t)(cc.Query(m, "queryforecast", nil))
+	hides(t, r)
+	if !strings.Contains(r, `"AWD-402"`) {
+		t.Fatal(r)
+	}
+	_, err := cc.Query(m, "queryforecast", []string{"AWD-401"})
+	fails(t, nil, err, "Award AWD-401 does not exist")
+
+	_, err = cc.Query(m, "queryfederalfinancialreport", []string{"AWD-401", "2017-07-01", "2017-09-30"})
+	fails(t, nil, err, "Award AWD-401 does not exist")
+	must(t)(cc.Query(m, "queryfederalfinancialreport", []string{"AWD-402", "2017-07-01", "2017-09-30"}))
+
+	r = must(t)(cc.Query(m, "queryawards", nil))
+	if strings.Contains(r, `"awardid":"AWD-401"`) || !strings.Contains(r, `"awardid":"AWD-402"`) {
+		t.Fatal(r)
+	}
+
+	r = must(t)(cc.Query(m, "queryblockchain", nil))
+	hides(t, r)
+	if !strings.Contains(r, `"EXP-206"`) {
+		t.Fatal(r)
+	}
+}
+
+func TestVisibilityOfReviewQueries(t *testing.T) {
+	cc, m := setup_visibility(t)
+
+	for _, q := range []string{"queryalerts", "querydelegations", "queryoverdueapprovals", "querysuspectedduplicates", "querydisallowedcosts"} {
+		r := must(t)(cc.Query(m, q, nil))
+		hides(t, r)
+		if strings.Contains(r, `"ACT-102"`) && q != "querydisallowedcosts" {
+			t.Fatal(q, r)
+		}
+	}
+
+	_, err := cc.Query(m, "verifydocument", []string{"EXP-201", "b0583770ec509e79040a444624d55be4db44cb857be315b2b1a8413c9bf7f6a2"})
+	fails(t, nil, err, "Expenditure EXP-201 does not exist")
+	must(t)(cc.Query(m, "verifydocument", []string{"EXP-206", "b0583770ec509e79040a444624d55be4db44cb857be315b2b1a8413c9bf7f6a2"}))
+
+	// a problem on a hidden record is neither listed nor given away by the consistent flag
+	m.state["EXP-201"] = []byte(strings.Replace(string(m.state["EXP-201"]), `"amount":"3000"`, `"amount":"3500"`, 1))
+	r := must(t)(cc.Query(m, "verifyledger", nil))
+	hides(t, r)
+	if !strings.Contains(r, `"consistent":true`) || strings.Contains(r, `"key":"ACT-102"`) || strings.Contains(r, `"key":"ACT-104"`) {
+		t.Fatal(r)
+	}
+	m.attrs["role"] = "auditor"
+	r = must(t)(cc.Query(m, "verifyledger", nil))
+	if !strings.Contains(r, `"consistent":false`) || !strings.Contains(r, `"key":"ACT-102"`) {
+		t.Fatal(r)
+	}
+}
+
+func TestAuditorOnlyReads(t *testing.T) {
+	cc, m := setup(t)
+	m.attrs["role"] = "auditor"
+
+	_, err := cc.Invoke(m, "spend", []string{"ACT-102", "ACT-104", "20", "Travel"})
+	fails(t, nil, err, "An auditor cannot invoke spend")
+	_, err = cc.Invoke(m, "spend", []string{"requestid=R-1", "ACT-102", "ACT-104", "20", "Travel"})
+	fails(t, nil, err, "An auditor cannot invoke spend")
+	if m.state["EXP-210"] != nil {
+		t.Fatal("an auditor spent")
+	}
+	must(t)(cc.Query(m, "queryallexpenses", nil))
+}
+
+func TestVisibilityOfAwardSettingsAndSuppliers(t *testing.T) {
+	cc, m := setup(t)
+	m.attrs["role"] = "admin"
+	m.attrs["actorid"] = "ACT-101"
+	must(t)(cc.Invoke(m, "putapprovalchain", []string{"CH-1", "AWD-401", "1000", "", "ACT-101"}))
+	must(t)(cc.Invoke(m, "putrule", []string{"R-1", "AWD-401", "Alcohol", "always", "", "reject", "Alcohol is unallowable"}))
+	must(t)(cc.Invoke(m, "putrule", []string{"R-2", "ACT-101", "Travel", "above", "5000", "pending", "Travel is capped"}))
+	must(t)(cc.Invoke(m, "uploaddebarments", []string{`[{"taxidhash":"b0583770ec509e79040a444624d55be4db44cb857be315b2b1a8413c9bf7f6a2","name":"Dixon","effectivedate":"2017-07-01","reason":"fraud"},
+		{"taxidhash":"0000000000000000000000000000000000000000000000000000000000000000","name":"Other","effectivedate":"2017-07-01","reason":"fraud"}]`}))
+	m.attrs["role"] = ""
+
+	m.attrs["actorid"] = "ACT-103"
+	for _, q := range []string{"queryapprovalchains", "queryrules", "querysuppliers"} {
+		r := must(t)(cc.Query(m, q, nil))
+		if r != "null" {
+			t.Fatal(q, r)
+		}
+	}
+	r := must(t)(cc.Query(m, "querydebarments", nil))
+	if !strings.Contains(r, `"entries":null`) {
+		t.Fatal(r)
+	}
+
+	// the grantee sees the settings of its award but not the program rules of its grantor
+	m.attrs["actorid"] = "ACT-102"
+	r = must(t)(cc.Query(m, "queryapprovalchains", nil))
+	if !strings.Contains(r, `"chainid":"CH-1"`) {
+		t.Fatal(r)
+	}
+	r = must(t)(cc.Query(m, "queryrules", nil))
+	if !strings.Contains(r, `"ruleid":"R-1"`) || strings.Contains(r, `"ruleid":"R-2"`) {
+		t.Fatal(r)
+	}
+
+	// a supplier sees its own registration and debarment only
+	m.attrs["actorid"] = "ACT-104"
+	r = must(t)(cc.Query(m, "querysuppliers", nil))
+	if !strings.Contains(r, `"actorid":"ACT-104"`) {
+		t.Fatal(r)
+	}
+	r = must(t)(cc.Query(m, "querydebarments", nil))
+	if !strings.Contains(r, `"name":"Dixon"`) || strings.Contains(r, `"name":"Other"`) {
+		t.Fatal(r)
+	}
+}
+
+func TestIndexesOnlyReadByAdminsAndAuditors(t *testing.T) {
+	cc, m := setup(t)
+	m.attrs["actorid"] = "ACT-102"
+	must(t)(cc.Invoke(m, "spend", []string{"ACT-102", "ACT-104", "640", "Travel", `{"invoicenumber":"INV-1"}`}))
+
+	for _, key := range []string{"_expindex", "_reimbindex", "_invoiceindex-ACT-104", "_paymentindex-ACT-104"} {
+		m.attrs["actorid"] = "ACT-104"
+		if r := must(t)(cc.Query(m, "read", []string{key})); r != "" {
+			t.Fatal(key, r)
+		}
+		m.attrs["role"] = "auditor"
+		if r := must(t)(cc.Query(m, "read", []string{key})); r == "" {
+			t.Fatal(key)
+		}
+		m.attrs["role"] = ""
+	}
+}